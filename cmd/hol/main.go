@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/yvv4git/speed-test/internal/hol"
+)
+
+func main() {
+	app := kingpin.New("speed-test", "A benchmark of head-of-line blocking over one and several QUIC streams under injected loss.")
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	logger.Info("Starting application", "type", "hol")
+
+	if err := hol.NewApplication(logger).Start(context.TODO()); err != nil {
+		logger.Error("Failed to start application", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/yvv4git/speed-test/internal/multicast/receiver"
+	"github.com/yvv4git/speed-test/internal/multicast/sender"
+	"github.com/yvv4git/speed-test/internal/utils"
+)
+
+type ApplicationType string
+
+const (
+	ApplicationTypeSender   ApplicationType = "sender"
+	ApplicationTypeReceiver ApplicationType = "receiver"
+)
+
+func main() {
+	app := kingpin.New("speed-test", "A tool for testing multicast throughput, loss and gaps.")
+	appType := app.Flag("type", "Type of application to run (sender or receiver).").Short('t').Required().Enum("sender", "receiver")
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	logger.Info("Starting application", "type", *appType)
+
+	var err error
+	switch ApplicationType(utils.Deref(appType)) {
+	case ApplicationTypeSender:
+		err = sender.NewApplication(logger).Start(context.TODO())
+	case ApplicationTypeReceiver:
+		err = receiver.NewApplication(logger).Start(context.TODO())
+	default:
+		logger.Error("Unknown application type", "type", *appType)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		logger.Error("Failed to start application", "error", err)
+		os.Exit(1)
+	}
+}
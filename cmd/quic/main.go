@@ -8,6 +8,7 @@ import (
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/yvv4git/speed-test/internal/quic/client"
 	"github.com/yvv4git/speed-test/internal/quic/server"
+	"github.com/yvv4git/speed-test/internal/quicconf"
 	"github.com/yvv4git/speed-test/internal/utils"
 )
 
@@ -21,6 +22,7 @@ const (
 func main() {
 	app := kingpin.New("speed-test", "A tool for testing QUIC server and client performance.")
 	appType := app.Flag("type", "Type of application to run (server or client).").Short('t').Required().Enum("server", "client")
+	transportFlags := quicconf.RegisterFlags(app)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
@@ -29,6 +31,17 @@ func main() {
 
 	logger.Info("Starting application", "type", *appType)
 
+	// Transport flags override QUIC_SERVER_* or QUIC_CLIENT_* variables
+	envPrefix := "QUIC_CLIENT_"
+	if ApplicationType(utils.Deref(appType)) == ApplicationTypeServer {
+		envPrefix = "QUIC_SERVER_"
+	}
+
+	if err := transportFlags.Apply(envPrefix); err != nil {
+		logger.Error("Failed to apply transport flags", "error", err)
+		os.Exit(1)
+	}
+
 	var err error
 	switch ApplicationType(utils.Deref(appType)) {
 	case ApplicationTypeServer:
@@ -0,0 +1,204 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/session"
+)
+
+const (
+	ReasonCompleted = "completed"
+	ReasonKilled    = "killed"
+	ReasonShutdown  = "server_shutdown"
+	ReasonError     = "error"
+)
+
+// Record is one line of the access log, written when a session ends.
+type Record struct {
+	SessionID       string    `json:"session_id"`
+	Protocol        string    `json:"protocol"`
+	ClientAddr      string    `json:"client_addr"`
+	Identity        string    `json:"identity"`
+	StartedAt       time.Time `json:"started_at"`
+	EndedAt         time.Time `json:"ended_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	AvgReceiveRate  float64   `json:"avg_receive_rate_bytes_per_second"`
+	AvgSendRate     float64   `json:"avg_send_rate_bytes_per_second"`
+	Reason          string    `json:"reason"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type Config struct {
+	// Path of the active log file. Rotated files get a timestamp suffix.
+	Path string
+	// MaxSizeMB is the size at which the file is rotated.
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files to keep, zero keeps all of them.
+	MaxBackups int
+}
+
+// Logger writes JSON Lines records to a size-rotated file. A nil *Logger discards records.
+type Logger struct {
+	cfg  Config
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// New opens the access log. It returns nil when no path is configured.
+func New(cfg Config) (*Logger, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("create access log directory: %w", err)
+	}
+
+	l := &Logger{cfg: cfg}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// SessionFinished is a session.FinishFunc that writes a record for the finished session.
+func (l *Logger) SessionFinished(info session.Info, endedAt time.Time, reason error) {
+	if l == nil {
+		return
+	}
+
+	record := Record{
+		SessionID:       info.ID,
+		Protocol:        info.Protocol,
+		ClientAddr:      info.RemoteAddr,
+		Identity:        info.Identity,
+		StartedAt:       info.StartedAt,
+		EndedAt:         endedAt,
+		DurationSeconds: endedAt.Sub(info.StartedAt).Seconds(),
+		BytesReceived:   info.BytesReceived,
+		BytesSent:       info.BytesSent,
+		Reason:          Reason(reason),
+	}
+
+	if record.DurationSeconds > 0 {
+		record.AvgReceiveRate = float64(record.BytesReceived) / record.DurationSeconds
+		record.AvgSendRate = float64(record.BytesSent) / record.DurationSeconds
+	}
+
+	if record.Reason == ReasonError {
+		record.Error = reason.Error()
+	}
+
+	_ = l.Write(record)
+}
+
+// Reason maps the error that ended a session to a termination reason.
+func Reason(err error) string {
+	switch {
+	case err == nil:
+		return ReasonCompleted
+	case errors.Is(err, session.ErrKilled):
+		return ReasonKilled
+	case errors.Is(err, context.Canceled):
+		return ReasonShutdown
+	default:
+		return ReasonError
+	}
+}
+
+func (l *Logger) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	maxSize := int64(l.cfg.MaxSizeMB) << 20
+	if maxSize > 0 && l.size+int64(len(line)) > maxSize && l.size > 0 {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat access log: %w", err)
+	}
+
+	l.file, l.size = file, stat.Size()
+	return nil
+}
+
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("close access log: %w", err)
+	}
+
+	ext := filepath.Ext(l.cfg.Path)
+	base := strings.TrimSuffix(l.cfg.Path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().UTC().Format("20060102T150405.000"), ext)
+	if err := os.Rename(l.cfg.Path, rotated); err != nil {
+		return fmt.Errorf("rotate access log: %w", err)
+	}
+
+	l.prune(base, ext)
+
+	return l.open()
+}
+
+// prune removes the oldest rotated files beyond MaxBackups.
+func (l *Logger) prune(base, ext string) {
+	if l.cfg.MaxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil || len(matches) <= l.cfg.MaxBackups {
+		return
+	}
+
+	// Timestamp suffixes sort chronologically
+	sort.Strings(matches)
+	for _, name := range matches[:len(matches)-l.cfg.MaxBackups] {
+		_ = os.Remove(name)
+	}
+}
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/yvv4git/speed-test/internal/session"
+)
+
+// Mode is the way a server treats the data it receives.
+type Mode string
+
+const (
+	ModeEcho   Mode = "echo"   // send every received chunk back
+	ModeSink   Mode = "sink"   // discard received data
+	ModeSource Mode = "source" // discard received data and stream data to the client
+)
+
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(value); mode {
+	case ModeEcho, ModeSink, ModeSource:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown handler mode %q", value)
+	}
+}
+
+// ModeController is implemented by servers whose handler mode can be switched at runtime.
+type ModeController interface {
+	Mode() Mode
+	SetMode(mode Mode)
+}
+
+type Params struct {
+	Token    string
+	Sessions *session.Registry
+	Modes    ModeController
+	Logger   *slog.Logger
+}
+
+type api struct {
+	sessions *session.Registry
+	modes    ModeController
+	logger   *slog.Logger
+}
+
+// Register mounts the admin API under /api on mux. Every request must carry
+// "Authorization: Bearer <token>".
+func Register(mux *http.ServeMux, params Params) {
+	a := &api{
+		sessions: params.Sessions,
+		modes:    params.Modes,
+		logger:   params.Logger,
+	}
+
+	protect := func(h http.HandlerFunc) http.Handler {
+		return requireToken(params.Token, h)
+	}
+
+	mux.Handle("GET /api/sessions", protect(a.listSessions))
+	mux.Handle("GET /api/sessions/{id}", protect(a.getSession))
+	mux.Handle("DELETE /api/sessions/{id}", protect(a.killSession))
+	mux.Handle("GET /api/mode", protect(a.getMode))
+	mux.Handle("PUT /api/mode", protect(a.setMode))
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) listSessions(w http.ResponseWriter, _ *http.Request) {
+	sessions := a.sessions.List()
+
+	infos := make([]session.Info, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.Info(false))
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *api) getSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.sessions.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sess.Info(true))
+}
+
+func (a *api) killSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !a.sessions.Kill(id) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	a.logger.Info("Session killed via admin API", "session_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type modeBody struct {
+	Mode Mode `json:"mode"`
+}
+
+func (a *api) getMode(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, modeBody{Mode: a.modes.Mode()})
+}
+
+func (a *api) setMode(w http.ResponseWriter, r *http.Request) {
+	var body modeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	mode, err := ParseMode(string(body.Mode))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.modes.SetMode(mode)
+	a.logger.Info("Handler mode switched via admin API", "mode", mode)
+
+	writeJSON(w, http.StatusOK, modeBody{Mode: mode})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
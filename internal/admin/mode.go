@@ -0,0 +1,46 @@
+package admin
+
+import "sync"
+
+// ModeSwitch holds the current handler mode and notifies waiters when it changes.
+// The zero value is not usable; create one with NewModeSwitch.
+type ModeSwitch struct {
+	mu      sync.RWMutex
+	mode    Mode
+	changed chan struct{}
+}
+
+func NewModeSwitch(mode Mode) *ModeSwitch {
+	return &ModeSwitch{
+		mode:    mode,
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *ModeSwitch) Mode() Mode {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.mode
+}
+
+func (m *ModeSwitch) SetMode(mode Mode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mode == m.mode {
+		return
+	}
+
+	m.mode = mode
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed on the next mode switch.
+func (m *ModeSwitch) Changed() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.changed
+}
@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Mode selects how a client proves its identity at the start of a session.
+type Mode string
+
+const (
+	ModeNone  Mode = "none"
+	ModeToken Mode = "token"
+	ModeHMAC  Mode = "hmac"
+)
+
+// Anonymous is the identity of sessions on servers without authentication.
+const Anonymous = "anonymous"
+
+// hello opens every handshake. It is sent by the client, so that the server
+// side learns about new QUIC streams, which stay invisible until data arrives.
+var hello = []byte("STAUTH1\n")
+
+const (
+	nonceSize     = 32
+	maxPayloadLen = 1024
+
+	statusOK     byte = 0
+	statusDenied byte = 1
+)
+
+var (
+	ErrUnknownMode   = errors.New("unknown auth mode")
+	ErrNoKeys        = errors.New("auth enabled without keys")
+	ErrAccessDenied  = errors.New("access denied")
+	ErrModeMismatch  = errors.New("auth mode mismatch")
+	ErrPayloadTooBig = errors.New("auth payload too big")
+	ErrBadHello      = errors.New("unexpected auth hello")
+)
+
+// Authenticator is the server side of the handshake. Keys maps an identity
+// (a team or user name reported in metrics) to its bearer token or HMAC secret.
+type Authenticator struct {
+	mode Mode
+	keys map[string]string
+	// names keeps a stable lookup order so that timing does not depend on map iteration.
+	names []string
+}
+
+func NewAuthenticator(mode Mode, keys map[string]string) (*Authenticator, error) {
+	switch mode {
+	case "", ModeNone:
+		return &Authenticator{mode: ModeNone}, nil
+	case ModeToken, ModeHMAC:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMode, mode)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &Authenticator{
+		mode:  mode,
+		keys:  keys,
+		names: names,
+	}, nil
+}
+
+func (a *Authenticator) Enabled() bool {
+	return a != nil && a.mode != ModeNone
+}
+
+func (a *Authenticator) Mode() Mode {
+	return a.mode
+}
+
+// Authenticate runs the server side of the handshake over rw and returns the identity
+// the client proved. After the client hello the server sends a random nonce, the client
+// answers with its mode and either the token itself or HMAC-SHA256(secret, nonce),
+// and the server replies with a single status byte.
+func (a *Authenticator) Authenticate(rw io.ReadWriter) (string, error) {
+	if !a.Enabled() {
+		return Anonymous, nil
+	}
+
+	greeting := make([]byte, len(hello))
+	if _, err := io.ReadFull(rw, greeting); err != nil {
+		return "", fmt.Errorf("read hello: %w", err)
+	}
+
+	if !bytes.Equal(greeting, hello) {
+		return "", ErrBadHello
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+
+	if _, err := rw.Write(nonce); err != nil {
+		return "", fmt.Errorf("send nonce: %w", err)
+	}
+
+	mode, payload, err := readResponse(rw)
+	if err != nil {
+		return "", err
+	}
+
+	identity, ok := "", false
+	if mode == a.mode {
+		identity, ok = a.verify(nonce, payload)
+	}
+
+	status := statusOK
+	if !ok {
+		status = statusDenied
+	}
+
+	if _, err = rw.Write([]byte{status}); err != nil {
+		return "", fmt.Errorf("send status: %w", err)
+	}
+
+	if mode != a.mode {
+		return "", fmt.Errorf("%w: server %q, client %q", ErrModeMismatch, a.mode, mode)
+	}
+
+	if !ok {
+		return "", ErrAccessDenied
+	}
+
+	return identity, nil
+}
+
+// VerifyToken returns the identity whose token matches. It is meant for protocols that
+// carry a bearer token instead of running the handshake, so it only works in token mode.
+func (a *Authenticator) VerifyToken(token string) (string, bool) {
+	if !a.Enabled() || a.mode != ModeToken {
+		return "", false
+	}
+
+	return a.verify(nil, []byte(token))
+}
+
+// Query parameters of signed URLs.
+const (
+	paramIdentity  = "identity"
+	paramExpires   = "expires"
+	paramSignature = "signature"
+)
+
+// SignURL lets identity use u until expires. The signature covers the path and every
+// query parameter, so none of them can be changed, but not the host, which proxies
+// may rewrite.
+func SignURL(u *url.URL, identity, secret string, expires time.Time) {
+	query := u.Query()
+	query.Del(paramSignature)
+	query.Set(paramIdentity, identity)
+	query.Set(paramExpires, strconv.FormatInt(expires.Unix(), 10))
+	u.RawQuery = query.Encode()
+
+	query.Set(paramSignature, base64.RawURLEncoding.EncodeToString(sign(secret, signedContent(u.Path, query))))
+	u.RawQuery = query.Encode()
+}
+
+// VerifyURL returns the identity of a URL signed with SignURL that has not expired by
+// now. It only works in HMAC mode.
+func (a *Authenticator) VerifyURL(u *url.URL, now time.Time) (string, bool) {
+	if !a.Enabled() || a.mode != ModeHMAC {
+		return "", false
+	}
+
+	query := u.Query()
+	identity := query.Get(paramIdentity)
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get(paramSignature))
+	if err != nil {
+		return "", false
+	}
+
+	secret, ok := a.keys[identity]
+	if !ok {
+		return "", false
+	}
+
+	if !hmac.Equal(signature, sign(secret, signedContent(u.Path, query))) {
+		return "", false
+	}
+
+	return identity, true
+}
+
+// signedContent is what a URL signature covers: the path and the sorted query without
+// the signature itself.
+func signedContent(path string, query url.Values) []byte {
+	unsigned := make(url.Values, len(query))
+	for key, values := range query {
+		if key != paramSignature {
+			unsigned[key] = values
+		}
+	}
+
+	return []byte(path + "?" + unsigned.Encode())
+}
+
+func (a *Authenticator) verify(nonce, payload []byte) (string, bool) {
+	identity, ok := "", false
+	for _, name := range a.names {
+		var expected []byte
+		switch a.mode {
+		case ModeToken:
+			expected = []byte(a.keys[name])
+		case ModeHMAC:
+			expected = sign(a.keys[name], nonce)
+		}
+
+		// No early exit: every key is compared, whatever matches.
+		if subtle.ConstantTimeCompare(expected, payload) == 1 && !ok {
+			identity, ok = name, true
+		}
+	}
+
+	return identity, ok
+}
+
+// Handshake runs the client side of the handshake over rw.
+func Handshake(rw io.ReadWriter, mode Mode, key string) error {
+	if _, err := rw.Write(hello); err != nil {
+		return fmt.Errorf("send hello: %w", err)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rw, nonce); err != nil {
+		return fmt.Errorf("read nonce: %w", err)
+	}
+
+	var payload []byte
+	switch mode {
+	case ModeToken:
+		payload = []byte(key)
+	case ModeHMAC:
+		payload = sign(key, nonce)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownMode, mode)
+	}
+
+	if len(payload) > maxPayloadLen {
+		return ErrPayloadTooBig
+	}
+
+	msg := make([]byte, 0, 1+2+len(payload)+len(mode))
+	msg = append(msg, byte(len(mode)))
+	msg = append(msg, mode...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(payload)))
+	msg = append(msg, payload...)
+	if _, err := rw.Write(msg); err != nil {
+		return fmt.Errorf("send credentials: %w", err)
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(rw, status); err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+
+	if status[0] != statusOK {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+func readResponse(r io.Reader) (Mode, []byte, error) {
+	modeLen := make([]byte, 1)
+	if _, err := io.ReadFull(r, modeLen); err != nil {
+		return "", nil, fmt.Errorf("read mode: %w", err)
+	}
+
+	mode := make([]byte, modeLen[0])
+	if _, err := io.ReadFull(r, mode); err != nil {
+		return "", nil, fmt.Errorf("read mode: %w", err)
+	}
+
+	payloadLen := make([]byte, 2)
+	if _, err := io.ReadFull(r, payloadLen); err != nil {
+		return "", nil, fmt.Errorf("read payload length: %w", err)
+	}
+
+	n := binary.BigEndian.Uint16(payloadLen)
+	if n > maxPayloadLen {
+		return "", nil, ErrPayloadTooBig
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, fmt.Errorf("read payload: %w", err)
+	}
+
+	return Mode(mode), payload, nil
+}
+
+func sign(secret string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
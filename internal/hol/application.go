@@ -0,0 +1,48 @@
+package hol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/joho/godotenv"
+)
+
+type Application struct {
+	logger *slog.Logger
+}
+
+func NewApplication(log *slog.Logger) *Application {
+	return &Application{
+		logger: log,
+	}
+}
+
+func (a *Application) Start(ctx context.Context) error {
+	if err := godotenv.Load(); err != nil {
+		a.logger.Debug("load .env file", "error", err)
+	}
+
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	benchmark := NewBenchmark(Params{
+		Logger: a.logger,
+		Cfg:    cfg,
+	})
+
+	if err := benchmark.Start(ctx); err != nil {
+		return fmt.Errorf("benchmark failed: %w", err)
+	}
+
+	a.logger.Info("Application stopped gracefully")
+	return nil
+}
@@ -0,0 +1,297 @@
+package hol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/results"
+)
+
+// Transport names accepted by HOL_TRANSPORTS. Both run over the same lossy path with
+// quic-go's loss recovery, they differ only in how the flows are mapped to streams.
+const (
+	// TransportQUICSingle sends every flow on one stream, like a TCP connection would
+	TransportQUICSingle = "quic-single"
+	// TransportQUIC sends every flow on its own stream
+	TransportQUIC = "quic"
+)
+
+type Config struct {
+	Flows       int           `env:"HOL_FLOWS" envDefault:"4"`
+	Messages    int           `env:"HOL_MESSAGES" envDefault:"500"`
+	MessageSize int           `env:"HOL_MESSAGE_SIZE" envDefault:"1000"`
+	Interval    time.Duration `env:"HOL_INTERVAL" envDefault:"10ms"`
+	Transports  []string      `env:"HOL_TRANSPORTS" envSeparator:"," envDefault:"quic-single,quic"`
+
+	// Delay is added to every packet in each direction, the round trip is twice as long
+	Delay time.Duration `env:"HOL_DELAY" envDefault:"10ms"`
+	// Loss is the fraction of client packets that are lost
+	Loss float64 `env:"HOL_LOSS" envDefault:"0.01"`
+	// Seed makes the loss pattern repeatable: the same packet numbers are lost in every run
+	Seed uint64 `env:"HOL_SEED" envDefault:"1"`
+
+	StallThreshold time.Duration `env:"HOL_STALL_THRESHOLD" envDefault:"15ms"`
+	Timeout        time.Duration `env:"HOL_TIMEOUT" envDefault:"60s"`
+}
+
+// headerSize is the size of the message header: flow, sequence number, send time and payload length.
+const headerSize = 2 + 4 + 8 + 4
+
+type message struct {
+	flow   uint16
+	seq    uint32
+	sentAt int64
+}
+
+// writeMessage writes m padded to len(buf) bytes.
+func writeMessage(w io.Writer, buf []byte, m message) error {
+	binary.BigEndian.PutUint16(buf[0:], m.flow)
+	binary.BigEndian.PutUint32(buf[2:], m.seq)
+	binary.BigEndian.PutUint64(buf[6:], uint64(m.sentAt))
+	binary.BigEndian.PutUint32(buf[14:], uint32(len(buf)-headerSize))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader, buf []byte) (message, error) {
+	if _, err := io.ReadFull(r, buf[:headerSize]); err != nil {
+		return message{}, err
+	}
+
+	m := message{
+		flow:   binary.BigEndian.Uint16(buf[0:]),
+		seq:    binary.BigEndian.Uint32(buf[2:]),
+		sentAt: int64(binary.BigEndian.Uint64(buf[6:])),
+	}
+
+	size := int(binary.BigEndian.Uint32(buf[14:]))
+	if size > len(buf) {
+		return message{}, fmt.Errorf("message payload of %d bytes exceeds %d", size, len(buf))
+	}
+
+	_, err := io.ReadFull(r, buf[:size])
+	return m, err
+}
+
+// recorder collects the one-way latency of every message per flow.
+type recorder struct {
+	mu        sync.Mutex
+	latencies [][]time.Duration
+	remaining int
+	done      chan struct{}
+}
+
+func newRecorder(flows, messages int) *recorder {
+	latencies := make([][]time.Duration, flows)
+	for i := range latencies {
+		latencies[i] = make([]time.Duration, 0, messages)
+	}
+
+	return &recorder{
+		latencies: latencies,
+		remaining: flows * messages,
+		done:      make(chan struct{}),
+	}
+}
+
+func (r *recorder) add(m message, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if int(m.flow) >= len(r.latencies) || r.remaining == 0 {
+		return
+	}
+
+	r.latencies[m.flow] = append(r.latencies[m.flow], at.Sub(time.Unix(0, m.sentAt)))
+	r.remaining--
+	if r.remaining == 0 {
+		close(r.done)
+	}
+}
+
+// wait returns once every message has arrived.
+func (r *recorder) wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return fmt.Errorf("%d messages did not arrive: %w", r.remaining, ctx.Err())
+	}
+}
+
+// result is what one transport run produced.
+type result struct {
+	transport string
+	latencies [][]time.Duration
+	// lost and total count the QUIC packets on the lossy direction
+	lost  uint64
+	total uint64
+}
+
+type Params struct {
+	Logger *slog.Logger
+	Cfg    Config
+}
+
+// Benchmark sends several independent, paced message flows over a QUIC connection,
+// once on a single stream and once on a stream per flow, with the same loss pattern,
+// and compares the per-flow latency tails. On a single ordered stream, as on a TCP
+// connection, a lost packet holds back every flow behind it; with a stream per flow
+// only the stream it belonged to waits. Kernel TCP is not compared: loopback TCP
+// cannot be made to lose packets without root privileges, and a simulated TCP would
+// not be measured like for like.
+type Benchmark struct {
+	logger *slog.Logger
+	cfg    Config
+}
+
+func NewBenchmark(params Params) *Benchmark {
+	return &Benchmark{
+		logger: params.Logger,
+		cfg:    params.Cfg,
+	}
+}
+
+func (b *Benchmark) Start(ctx context.Context) error {
+	if b.cfg.Flows <= 0 || b.cfg.Flows > 1<<16 || b.cfg.Messages <= 0 {
+		return errors.New("number of flows and messages must be positive")
+	}
+
+	if b.cfg.MessageSize < headerSize {
+		return fmt.Errorf("message size must be at least %d bytes", headerSize)
+	}
+
+	if b.cfg.Loss < 0 || b.cfg.Loss >= 1 {
+		return errors.New("loss must be in [0, 1)")
+	}
+
+	b.logger.Info("Running head-of-line blocking benchmark",
+		"flows", b.cfg.Flows,
+		"messages", b.cfg.Messages,
+		"message_size", b.cfg.MessageSize,
+		"interval", b.cfg.Interval,
+		"delay", b.cfg.Delay,
+		"loss", b.cfg.Loss,
+		"seed", b.cfg.Seed,
+	)
+
+	for _, transport := range b.cfg.Transports {
+		var run func(context.Context) (*result, error)
+		switch transport {
+		case TransportQUICSingle:
+			run = func(ctx context.Context) (*result, error) { return b.runQUIC(ctx, true) }
+		case TransportQUIC:
+			run = func(ctx context.Context) (*result, error) { return b.runQUIC(ctx, false) }
+		default:
+			return fmt.Errorf("unknown transport %q", transport)
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, b.cfg.Timeout)
+		res, err := run(runCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %w", transport, err)
+		}
+
+		b.logResult(res)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// runFlows paces the messages of every flow. Flows start staggered over one interval
+// so that their messages do not leave in bursts.
+func (b *Benchmark) runFlows(ctx context.Context, send func(flow int, buf []byte, m message) error) error {
+	errs := make([]error, b.cfg.Flows)
+
+	var wg sync.WaitGroup
+	for flow := range b.cfg.Flows {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, b.cfg.MessageSize)
+
+			select {
+			case <-time.After(b.cfg.Interval * time.Duration(flow) / time.Duration(b.cfg.Flows)):
+			case <-ctx.Done():
+				return
+			}
+
+			ticker := time.NewTicker(b.cfg.Interval)
+			defer ticker.Stop()
+
+			for seq := range b.cfg.Messages {
+				m := message{flow: uint16(flow), seq: uint32(seq), sentAt: time.Now().UnixNano()}
+				if err := send(flow, buf, m); err != nil {
+					errs[flow] = fmt.Errorf("flow %d: %w", flow, err)
+					return
+				}
+
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (b *Benchmark) logResult(res *result) {
+	var (
+		all            []time.Duration
+		stalledFlows   int
+		stalledTotal   int
+		maxFlowStalled int
+	)
+	for flow, latencies := range res.latencies {
+		stalled := 0
+		for _, latency := range latencies {
+			if latency > b.cfg.StallThreshold {
+				stalled++
+			}
+		}
+
+		if stalled > 0 {
+			stalledFlows++
+		}
+		stalledTotal += stalled
+		maxFlowStalled = max(maxFlowStalled, stalled)
+		all = append(all, latencies...)
+
+		b.logger.Info("Flow latency",
+			"transport", res.transport,
+			"flow", flow,
+			"latency", results.NewDistribution(latencies),
+			"stalled", stalled,
+		)
+	}
+
+	b.logger.Info("Head-of-line blocking results",
+		"transport", res.transport,
+		"lost", res.lost,
+		"packets", res.total,
+		"latency", results.NewDistribution(all),
+		"stall_threshold", b.cfg.StallThreshold,
+		"stalled_messages", stalledTotal,
+		"stalled_flows", stalledFlows,
+		"max_stalled_per_flow", maxFlowStalled,
+	)
+}
@@ -0,0 +1,136 @@
+package hol
+
+import (
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// delayLine runs functions in the order they were scheduled, each not before its due time.
+type delayLine struct {
+	queue chan delayed
+	done  chan struct{}
+	once  sync.Once
+}
+
+type delayed struct {
+	at time.Time
+	fn func()
+}
+
+func newDelayLine() *delayLine {
+	d := &delayLine{
+		queue: make(chan delayed, 4096),
+		done:  make(chan struct{}),
+	}
+	go d.run()
+
+	return d
+}
+
+func (d *delayLine) run() {
+	for {
+		select {
+		case item := <-d.queue:
+			if wait := time.Until(item.at); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-d.done:
+					return
+				}
+			}
+			item.fn()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *delayLine) schedule(at time.Time, fn func()) {
+	select {
+	case d.queue <- delayed{at: at, fn: fn}:
+	case <-d.done:
+	}
+}
+
+func (d *delayLine) close() {
+	d.once.Do(func() { close(d.done) })
+}
+
+// lossModel decides which packets are lost. It is seeded, so the n-th packet is lost
+// or delivered the same way in every run.
+type lossModel struct {
+	mu   sync.Mutex
+	rng  *rand.Rand
+	rate float64
+
+	lost  atomic.Uint64
+	total atomic.Uint64
+}
+
+func newLossModel(rate float64, seed uint64) *lossModel {
+	return &lossModel{
+		rng:  rand.New(rand.NewPCG(seed, seed)),
+		rate: rate,
+	}
+}
+
+func (l *lossModel) lose() bool {
+	l.total.Add(1)
+	if l.rate == 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	lost := l.rng.Float64() < l.rate
+	l.mu.Unlock()
+
+	if lost {
+		l.lost.Add(1)
+	}
+
+	return lost
+}
+
+// lossyConn is the net.PacketConn handed to quic.Transport. It delays every packet it
+// sends and, when it has a loss model, drops some of them.
+type lossyConn struct {
+	net.PacketConn
+	delay time.Duration
+	loss  *lossModel
+	line  *delayLine
+}
+
+func newLossyConn(conn net.PacketConn, delay time.Duration, loss *lossModel) *lossyConn {
+	return &lossyConn{
+		PacketConn: conn,
+		delay:      delay,
+		loss:       loss,
+		line:       newDelayLine(),
+	}
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.loss != nil && c.loss.lose() {
+		return len(p), nil
+	}
+
+	if c.delay == 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	packet := slices.Clone(p)
+	c.line.schedule(time.Now().Add(c.delay), func() {
+		_, _ = c.PacketConn.WriteTo(packet, addr)
+	})
+
+	return len(p), nil
+}
+
+func (c *lossyConn) Close() error {
+	c.line.close()
+	return c.PacketConn.Close()
+}
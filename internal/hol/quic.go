@@ -0,0 +1,136 @@
+package hol
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yvv4git/speed-test/internal/tlsconf"
+)
+
+const alpn = "speedtest-hol"
+
+// runQUIC sends every flow on its own stream of one QUIC connection, or all flows on
+// a single stream when shared is set. The client's packets go through a lossyConn, the
+// server's are only delayed.
+func (b *Benchmark) runQUIC(ctx context.Context, shared bool) (*result, error) {
+	cert, err := tlsconf.LoadServerCertificate(tlsconf.ServerParams{Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate: %w", err)
+	}
+
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	serverUDP, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return nil, fmt.Errorf("open server socket: %w", err)
+	}
+	serverConn := newLossyConn(serverUDP, b.cfg.Delay, nil)
+	defer serverConn.Close()
+
+	serverTransport := &quic.Transport{Conn: serverConn}
+	defer serverTransport.Close()
+
+	listener, err := serverTransport.Listen(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{alpn},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("start listener: %w", err)
+	}
+	defer listener.Close()
+
+	clientUDP, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return nil, fmt.Errorf("open client socket: %w", err)
+	}
+	loss := newLossModel(b.cfg.Loss, b.cfg.Seed)
+	clientConn := newLossyConn(clientUDP, b.cfg.Delay, loss)
+	defer clientConn.Close()
+
+	clientTransport := &quic.Transport{Conn: clientConn}
+	defer clientTransport.Close()
+
+	rec := newRecorder(b.cfg.Flows, b.cfg.Messages)
+
+	go func() {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			return
+		}
+
+		for {
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+
+			go func() {
+				buf := make([]byte, b.cfg.MessageSize)
+				for {
+					m, err := readMessage(stream, buf)
+					if err != nil {
+						return
+					}
+					rec.add(m, time.Now())
+				}
+			}()
+		}
+	}()
+
+	// Both ends run in this process, the certificate was generated above
+	conn, err := clientTransport.Dial(ctx, serverUDP.LocalAddr(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpn},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	transport := TransportQUIC
+	if shared {
+		transport = TransportQUICSingle
+	}
+
+	streams := make([]quic.Stream, b.cfg.Flows)
+	for i := range streams {
+		if shared && i > 0 {
+			streams[i] = streams[0]
+			continue
+		}
+
+		if streams[i], err = conn.OpenStreamSync(ctx); err != nil {
+			return nil, fmt.Errorf("open stream: %w", err)
+		}
+	}
+
+	// Messages of flows sharing a stream must not interleave
+	var mu sync.Mutex
+	err = b.runFlows(ctx, func(flow int, buf []byte, m message) error {
+		if shared {
+			mu.Lock()
+			defer mu.Unlock()
+		}
+
+		return writeMessage(streams[flow], buf, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = rec.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return &result{
+		transport: transport,
+		latencies: rec.latencies,
+		lost:      loss.lost.Load(),
+		total:     loss.total.Load(),
+	}, nil
+}
@@ -0,0 +1,177 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+)
+
+// Packets sent to the group start with a magic and the run, a random number the
+// sender picks for every test, so receivers can tell consecutive tests apart:
+// data(4) | run(8) | probe header | padding, finish(4) | run(8) | sent(8).
+// Receivers answer a finish with report(4) | JSON, sent to the sender's address.
+var (
+	dataMagic   = []byte("STMD")
+	finishMagic = []byte("STMF")
+	reportMagic = []byte("STMR")
+)
+
+// DataHeaderSize is the smallest data packet.
+const DataHeaderSize = 4 + 8 + probe.HeaderSize
+
+const finishSize = 4 + 8 + 8
+
+var ErrInvalidMessage = errors.New("invalid multicast message")
+
+// MarshalData writes a data packet header into the beginning of buf, which must hold
+// at least DataHeaderSize bytes.
+func MarshalData(buf []byte, run uint64, p probe.Packet) {
+	copy(buf, dataMagic)
+	binary.BigEndian.PutUint64(buf[4:], run)
+	p.Marshal(buf[12:])
+}
+
+// UnmarshalData reports false when buf is not a data packet.
+func UnmarshalData(buf []byte) (uint64, probe.Packet, bool) {
+	if len(buf) < DataHeaderSize || string(buf[:4]) != string(dataMagic) {
+		return 0, probe.Packet{}, false
+	}
+
+	p, err := probe.Unmarshal(buf[12:])
+	return binary.BigEndian.Uint64(buf[4:]), p, err == nil
+}
+
+func MarshalFinish(run, sent uint64) []byte {
+	buf := make([]byte, finishSize)
+	copy(buf, finishMagic)
+	binary.BigEndian.PutUint64(buf[4:], run)
+	binary.BigEndian.PutUint64(buf[12:], sent)
+
+	return buf
+}
+
+// UnmarshalFinish reports false when buf is not a finish message.
+func UnmarshalFinish(buf []byte) (run, sent uint64, ok bool) {
+	if len(buf) != finishSize || string(buf[:4]) != string(finishMagic) {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint64(buf[4:]), binary.BigEndian.Uint64(buf[12:]), true
+}
+
+// Report is what one receiver got of a run.
+type Report struct {
+	Receiver string      `json:"receiver"`
+	Run      uint64      `json:"run"`
+	Seconds  float64     `json:"seconds"` // from the first to the last packet
+	Stats    probe.Stats `json:"stats"`
+	// Gaps is the number of runs of consecutive lost packets.
+	Gaps       uint64 `json:"gaps"`
+	LongestGap uint64 `json:"longest_gap"`
+}
+
+// Mbps is the receive rate between the first and the last packet.
+func (r Report) Mbps() float64 {
+	if r.Seconds <= 0 {
+		return 0
+	}
+
+	return float64(r.Stats.Bytes) * 8 / r.Seconds / 1e6
+}
+
+func MarshalReport(r Report) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, reportMagic...), data...), nil
+}
+
+func UnmarshalReport(buf []byte) (Report, error) {
+	if len(buf) < len(reportMagic) || string(buf[:4]) != string(reportMagic) {
+		return Report{}, ErrInvalidMessage
+	}
+
+	var r Report
+	if err := json.Unmarshal(buf[4:], &r); err != nil {
+		return Report{}, err
+	}
+
+	return r, nil
+}
+
+// Summary aggregates the reports of all receivers of a run.
+type Summary struct {
+	Receivers    int
+	Received     uint64
+	Lost         uint64
+	MinLossRatio float64
+	AvgLossRatio float64
+	MaxLossRatio float64
+	Gaps         uint64
+	LongestGap   uint64
+	MinMbps      float64
+	MaxMbps      float64
+	// Worst is the receiver with the highest loss.
+	Worst string
+}
+
+func Aggregate(reports []Report) Summary {
+	var s Summary
+	for i, r := range reports {
+		s.Receivers++
+		s.Received += r.Stats.Received
+		s.Lost += r.Stats.Lost
+		s.AvgLossRatio += r.Stats.LossRatio
+		s.Gaps += r.Gaps
+		s.LongestGap = max(s.LongestGap, r.LongestGap)
+
+		if i == 0 || r.Stats.LossRatio < s.MinLossRatio {
+			s.MinLossRatio = r.Stats.LossRatio
+		}
+
+		if i == 0 || r.Stats.LossRatio > s.MaxLossRatio {
+			s.MaxLossRatio, s.Worst = r.Stats.LossRatio, r.Receiver
+		}
+
+		if i == 0 || r.Mbps() < s.MinMbps {
+			s.MinMbps = r.Mbps()
+		}
+		s.MaxMbps = max(s.MaxMbps, r.Mbps())
+	}
+
+	if s.Receivers > 0 {
+		s.AvgLossRatio /= float64(s.Receivers)
+	}
+
+	return s
+}
+
+// Group resolves the multicast group address.
+func Group(host string, port uint16) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", addr.IP)
+	}
+
+	return addr, nil
+}
+
+// Interface looks up the network interface called name. An empty name leaves the
+// choice to the routing table and returns nil.
+func Interface(name string) (*net.Interface, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	return net.InterfaceByName(name)
+}
@@ -0,0 +1,90 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/multicast"
+)
+
+type Application struct {
+	logger *slog.Logger
+}
+
+func NewApplication(log *slog.Logger) *Application {
+	return &Application{
+		logger: log,
+	}
+}
+
+func (a *Application) Start(ctx context.Context) error {
+	if err := godotenv.Load(); err != nil {
+		a.logger.Debug("load .env file", "error", err)
+	}
+
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	if cfg.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("get hostname: %w", err)
+		}
+		cfg.Name = hostname
+	}
+
+	a.logger.Info("Loaded configuration", "group", cfg.Group, "port", cfg.Port, "interface", cfg.Interface, "name", cfg.Name)
+
+	group, err := multicast.Group(cfg.Group, cfg.Port)
+	if err != nil {
+		return fmt.Errorf("resolve group: %w", err)
+	}
+
+	ifi, err := multicast.Interface(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("find interface: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return fmt.Errorf("join multicast group: %w", err)
+	}
+
+	// A small socket buffer drops packets in bursts, which would show up as network loss
+	if err = conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+		a.logger.Warn("Failed to set socket read buffer", "size", cfg.ReadBuffer, "error", err)
+	}
+
+	a.logger.Info("Joined multicast group", "group", group.String())
+
+	rcv := NewReceiver(Params{
+		Logger: a.logger,
+		Cfg:    cfg,
+		Conn:   conn,
+	})
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		if err := rcv.Start(ctx); err != nil {
+			a.logger.Error("Receiver failed", "error", err)
+			cancel()
+		}
+	}()
+
+	<-ctx.Done()
+
+	rcv.Stop()
+	a.logger.Info("Application shutdown complete")
+	return nil
+}
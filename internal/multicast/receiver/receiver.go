@@ -0,0 +1,288 @@
+package receiver
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/multicast"
+	"github.com/yvv4git/speed-test/internal/probe"
+)
+
+type Receiver struct {
+	cfg    Config
+	conn   *net.UDPConn
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	streams map[streamKey]*stream
+}
+
+type Config struct {
+	Group      string `env:"MULTICAST_RECEIVER_GROUP" envDefault:"239.255.0.1"`
+	Port       uint16 `env:"MULTICAST_RECEIVER_PORT" envDefault:"5001"`
+	Interface  string `env:"MULTICAST_RECEIVER_INTERFACE" envDefault:""`
+	Name       string `env:"MULTICAST_RECEIVER_NAME" envDefault:""`
+	ReadBuffer int    `env:"MULTICAST_RECEIVER_READ_BUFFER" envDefault:"4194304"`
+
+	Interval      time.Duration `env:"MULTICAST_RECEIVER_INTERVAL" envDefault:"1s"`
+	StreamTimeout time.Duration `env:"MULTICAST_RECEIVER_STREAM_TIMEOUT" envDefault:"10s"`
+}
+
+type Params struct {
+	Cfg    Config
+	Logger *slog.Logger
+	Conn   *net.UDPConn
+}
+
+func NewReceiver(params Params) *Receiver {
+	return &Receiver{
+		cfg:     params.Cfg,
+		logger:  params.Logger,
+		conn:    params.Conn,
+		streams: make(map[streamKey]*stream),
+	}
+}
+
+// streamKey tells the runs of different senders apart, whatever run IDs they pick.
+type streamKey struct {
+	source string
+	run    uint64
+}
+
+// reportGap is the least time between two reports for the same run. The sender repeats
+// its finish while reports come in, a flood of copies must not draw a report each.
+const reportGap = 100 * time.Millisecond
+
+// stream is one run of a sender.
+type stream struct {
+	run      uint64
+	source   *net.UDPAddr
+	receiver *probe.Receiver
+	first    time.Time
+	last     time.Time
+	lastSeen time.Time
+
+	// interval is the number of intervals logged, stats the receiver stats at the latest one
+	interval int
+	stats    probe.Stats
+	statsAt  time.Time
+
+	// report is set once the sender finished the run, later packets are ignored
+	report     *multicast.Report
+	reportedAt time.Time
+}
+
+func (r *Receiver) Start(ctx context.Context) error {
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	r.wg.Add(1)
+	go r.logIntervals()
+
+	return r.readPackets() // Blocking mode
+}
+
+func (r *Receiver) readPackets() error {
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.ctx.Done():
+				r.logger.Info("Multicast receiver stopped reading packets")
+				return nil
+			default:
+				r.logger.Error("Failed to read multicast packet", "error", err)
+				continue
+			}
+		}
+
+		now := time.Now()
+		if run, sent, ok := multicast.UnmarshalFinish(buf[:n]); ok {
+			r.finish(addr, run, sent, now)
+			continue
+		}
+
+		run, packet, ok := multicast.UnmarshalData(buf[:n])
+		if !ok {
+			continue
+		}
+
+		s := r.stream(addr, run, now)
+		if s == nil {
+			continue
+		}
+
+		s.receiver.Add(packet.Seq, n, now.Sub(time.Unix(0, packet.SentAt)))
+	}
+}
+
+// stream returns the stream of run from addr, starting a new one for unknown runs.
+// Packets arriving after the sender finished belong to no stream, stream returns nil.
+func (r *Receiver) stream(addr *net.UDPAddr, run uint64, now time.Time) *stream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := streamKey{source: addr.String(), run: run}
+	if s, ok := r.streams[key]; ok {
+		if s.report != nil {
+			return nil
+		}
+
+		s.last, s.lastSeen = now, now
+		return s
+	}
+
+	s := &stream{
+		run:      run,
+		source:   addr,
+		receiver: probe.NewReceiver(),
+		first:    now,
+		last:     now,
+		lastSeen: now,
+		statsAt:  now,
+	}
+	r.streams[key] = s
+
+	r.logger.Info("New multicast stream", "run", run, "source", addr.String())
+	return s
+}
+
+// finish answers the sender's finish message with the report of the run. The sender
+// repeats the message until it has heard from its receivers, so copies are answered
+// too, at most one every reportGap. Finishes for runs that sent this receiver no data
+// are ignored: a receiver that got no data packets at all does not report.
+func (r *Receiver) finish(addr *net.UDPAddr, run, sent uint64, now time.Time) {
+	r.mu.Lock()
+	s, ok := r.streams[streamKey{source: addr.String(), run: run}]
+	if !ok || (s.report != nil && now.Sub(s.reportedAt) < reportGap) {
+		r.mu.Unlock()
+		return
+	}
+	s.lastSeen = now
+	s.reportedAt = now
+
+	first := s.report == nil
+	if first {
+		// The sender's count is not trusted beyond what the receiver can account for
+		sent = min(sent, s.receiver.End()+probe.Window)
+
+		stats := s.receiver.Stats(sent)
+		gaps, longest := s.receiver.Gaps(sent)
+		s.report = &multicast.Report{
+			Receiver:   r.cfg.Name,
+			Run:        run,
+			Seconds:    s.last.Sub(s.first).Seconds(),
+			Stats:      stats,
+			Gaps:       gaps,
+			LongestGap: longest,
+		}
+	}
+	report := *s.report
+	r.mu.Unlock()
+
+	data, err := multicast.MarshalReport(report)
+	if err != nil {
+		r.logger.Error("Failed to encode report", "error", err)
+		return
+	}
+
+	// The sender listens for reports on the socket it sends from
+	if _, err = r.conn.WriteToUDP(data, addr); err != nil {
+		r.logger.Error("Failed to send report", "sender", addr.String(), "error", err)
+	}
+
+	if first {
+		r.logger.Info("Multicast stream finished",
+			"run", run,
+			"source", addr.String(),
+			"sent", sent,
+			"received", report.Stats.Received,
+			"receive_rate_mbps", report.Mbps(),
+			"lost", report.Stats.Lost,
+			"loss_ratio", report.Stats.LossRatio,
+			"gaps", report.Gaps,
+			"longest_gap", report.LongestGap,
+			"reordered", report.Stats.Reordered,
+			"duplicates", report.Stats.Duplicates,
+			"jitter_ms", report.Stats.JitterMs,
+		)
+	}
+}
+
+// logIntervals logs the stats of the last interval of every active stream and drops
+// streams that went quiet.
+func (r *Receiver) logIntervals() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.logInterval(now)
+		}
+	}
+}
+
+func (r *Receiver) logInterval(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, s := range r.streams {
+		run := key.run
+		if now.Sub(s.lastSeen) > r.cfg.StreamTimeout {
+			delete(r.streams, key)
+			if s.report == nil {
+				r.logger.Warn("Multicast stream timed out before the sender finished", "run", run, "source", s.source.String())
+			}
+			continue
+		}
+
+		if s.report != nil {
+			continue
+		}
+
+		stats := s.receiver.Stats(0)
+		interval := stats.Since(s.stats)
+		seconds := now.Sub(s.statsAt).Seconds()
+		s.interval++
+
+		r.logger.Info("Interval results",
+			"run", run,
+			"interval", s.interval,
+			"start_s", s.statsAt.Sub(s.first).Seconds(),
+			"end_s", now.Sub(s.first).Seconds(),
+			"received", interval.Received,
+			"receive_rate_mbps", float64(interval.Bytes)*8/seconds/1e6,
+			"lost", interval.Lost,
+			"loss_ratio", interval.LossRatio,
+			"jitter_ms", interval.JitterMs,
+		)
+
+		s.stats, s.statsAt = stats, now
+	}
+}
+
+func (r *Receiver) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	if r.conn != nil {
+		if err := r.conn.Close(); err != nil {
+			r.logger.Error("Failed to close multicast socket", "error", err)
+		}
+	}
+
+	r.wg.Wait()
+	r.logger.Info("Multicast receiver stopped")
+}
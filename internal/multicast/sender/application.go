@@ -0,0 +1,87 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/multicast"
+	"golang.org/x/net/ipv4"
+)
+
+type Application struct {
+	logger *slog.Logger
+}
+
+func NewApplication(log *slog.Logger) *Application {
+	return &Application{
+		logger: log,
+	}
+}
+
+func (a *Application) Start(ctx context.Context) error {
+	if err := godotenv.Load(); err != nil {
+		a.logger.Debug("load .env file", "error", err)
+	}
+
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	a.logger.Info("Starting multicast sender", "group", cfg.Group, "port", cfg.Port, "interface", cfg.Interface, "ttl", cfg.TTL)
+
+	group, err := multicast.Group(cfg.Group, cfg.Port)
+	if err != nil {
+		return fmt.Errorf("resolve group: %w", err)
+	}
+
+	ifi, err := multicast.Interface(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("find interface: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	// The receivers send their reports back to this socket
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return fmt.Errorf("open socket: %w", err)
+	}
+
+	sender := NewSender(Params{
+		Logger: a.logger,
+		Cfg:    cfg,
+		Conn:   conn,
+		Group:  group,
+	})
+	defer sender.Close()
+
+	pc := ipv4.NewPacketConn(conn)
+	if err = pc.SetMulticastTTL(cfg.TTL); err != nil {
+		return fmt.Errorf("set multicast TTL: %w", err)
+	}
+
+	if err = pc.SetMulticastLoopback(cfg.Loopback); err != nil {
+		return fmt.Errorf("set multicast loopback: %w", err)
+	}
+
+	if ifi != nil {
+		if err = pc.SetMulticastInterface(ifi); err != nil {
+			return fmt.Errorf("set multicast interface: %w", err)
+		}
+	}
+
+	if err = sender.Start(ctx); err != nil {
+		return fmt.Errorf("start sender: %w", err)
+	}
+
+	a.logger.Info("Application stopped gracefully")
+	return nil
+}
@@ -0,0 +1,285 @@
+package sender
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/multicast"
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/results"
+)
+
+type Sender struct {
+	logger *slog.Logger
+	cfg    Config
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+}
+
+type Config struct {
+	Group     string `env:"MULTICAST_SENDER_GROUP" envDefault:"239.255.0.1"`
+	Port      uint16 `env:"MULTICAST_SENDER_PORT" envDefault:"5001"`
+	Interface string `env:"MULTICAST_SENDER_INTERFACE" envDefault:""`
+	TTL       int    `env:"MULTICAST_SENDER_TTL" envDefault:"1"`
+	Loopback  bool   `env:"MULTICAST_SENDER_LOOPBACK" envDefault:"true"`
+
+	RateMbps     float64       `env:"MULTICAST_SENDER_RATE_MBPS" envDefault:"10"`
+	DatagramSize uint16        `env:"MULTICAST_SENDER_DATAGRAM_SIZE" envDefault:"1200"`
+	Duration     time.Duration `env:"MULTICAST_SENDER_DURATION" envDefault:"10s"`
+	Drain        time.Duration `env:"MULTICAST_SENDER_DRAIN" envDefault:"500ms"`
+
+	// Receivers is the number of reports to wait for, zero waits for the whole timeout
+	Receivers     int           `env:"MULTICAST_SENDER_RECEIVERS" envDefault:"0"`
+	ReportTimeout time.Duration `env:"MULTICAST_SENDER_REPORT_TIMEOUT" envDefault:"3s"`
+}
+
+type Params struct {
+	Logger *slog.Logger
+	Cfg    Config
+	Conn   *net.UDPConn
+	Group  *net.UDPAddr
+}
+
+func NewSender(params Params) *Sender {
+	return &Sender{
+		logger: params.Logger,
+		cfg:    params.Cfg,
+		conn:   params.Conn,
+		group:  params.Group,
+	}
+}
+
+// finishRetry is how often the finish message is repeated while reports come in.
+const finishRetry = 200 * time.Millisecond
+
+// Start sends sequence-numbered, timestamped datagrams to the group at the target rate
+// for the configured duration, then collects the reports of the receivers and logs
+// them one by one and aggregated.
+func (s *Sender) Start(ctx context.Context) error {
+	if s.conn == nil {
+		return errors.New("connection is not established")
+	}
+
+	if s.cfg.DatagramSize < multicast.DataHeaderSize {
+		return errors.New("datagram size is smaller than the data header")
+	}
+
+	if s.cfg.RateMbps <= 0 {
+		return errors.New("rate must be positive")
+	}
+
+	var runBytes [8]byte
+	if _, err := rand.Read(runBytes[:]); err != nil {
+		return err
+	}
+	run := binary.BigEndian.Uint64(runBytes[:])
+
+	pps := s.cfg.RateMbps * 1e6 / 8 / float64(s.cfg.DatagramSize)
+	s.logger.Info("Starting multicast test", "run", run, "group", s.group.String(), "rate_mbps", s.cfg.RateMbps,
+		"datagram_size", s.cfg.DatagramSize, "rate_pps", pps, "duration", s.cfg.Duration)
+
+	sendCtx := ctx
+	if s.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, s.cfg.Duration)
+		defer cancel()
+	}
+
+	started := time.Now()
+	sent, sendErr := s.send(sendCtx, run, time.Duration(float64(time.Second)/pps))
+	duration := time.Since(started)
+	if sendErr != nil {
+		s.logger.Error("Failed to send datagram", "error", sendErr)
+	}
+
+	s.logger.Info("Sender results",
+		"duration", duration,
+		"sent", sent,
+		"bytes_sent", sent*uint64(s.cfg.DatagramSize),
+		"send_rate_mbps", results.Mbps(sent*uint64(s.cfg.DatagramSize), duration),
+	)
+
+	// Datagrams still in flight arrive before the receivers close the run, an interrupted
+	// test skips the wait
+	drain := time.NewTimer(s.cfg.Drain)
+	select {
+	case <-drain.C:
+	case <-ctx.Done():
+		drain.Stop()
+	}
+
+	reports, err := s.collectReports(run, sent)
+	if err != nil {
+		return err
+	}
+
+	if len(reports) == 0 {
+		s.logger.Warn("No receiver reported, check the TTL and that the receivers joined the group")
+		return sendErr
+	}
+
+	if s.cfg.Receivers > 0 && len(reports) < s.cfg.Receivers {
+		s.logger.Warn("Not all receivers reported", "expected", s.cfg.Receivers, "reported", len(reports))
+	}
+
+	for _, r := range reports {
+		s.logger.Info("Receiver results",
+			"receiver", r.Receiver,
+			"received", r.Stats.Received,
+			"receive_rate_mbps", r.Mbps(),
+			"lost", r.Stats.Lost,
+			"loss_ratio", r.Stats.LossRatio,
+			"gaps", r.Gaps,
+			"longest_gap", r.LongestGap,
+			"reordered", r.Stats.Reordered,
+			"duplicates", r.Stats.Duplicates,
+			"jitter_ms", r.Stats.JitterMs,
+		)
+	}
+
+	summary := multicast.Aggregate(reports)
+	s.logger.Info("Aggregate results",
+		"receivers", summary.Receivers,
+		"sent", sent,
+		"received", summary.Received,
+		"lost", summary.Lost,
+		"min_loss_ratio", summary.MinLossRatio,
+		"avg_loss_ratio", summary.AvgLossRatio,
+		"max_loss_ratio", summary.MaxLossRatio,
+		"worst_receiver", summary.Worst,
+		"gaps", summary.Gaps,
+		"longest_gap", summary.LongestGap,
+		"min_receive_rate_mbps", summary.MinMbps,
+		"max_receive_rate_mbps", summary.MaxMbps,
+	)
+
+	return sendErr
+}
+
+func (s *Sender) send(ctx context.Context, run uint64, interval time.Duration) (uint64, error) {
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+
+	buf := make([]byte, s.cfg.DatagramSize)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+
+	started := time.Now()
+	var seq uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return seq, nil
+
+		case now := <-ticker.C:
+			// Send everything that is due, the ticker is coarser than the interval at high rates
+			due := uint64(now.Sub(started)/interval) + 1
+			for ; seq < due; seq++ {
+				multicast.MarshalData(buf, run, probe.Packet{Seq: seq, SentAt: time.Now().UnixNano()})
+				if _, err := s.conn.WriteToUDP(buf, s.group); err != nil {
+					return seq, err
+				}
+			}
+		}
+	}
+}
+
+// collectReports repeats the finish message to the group until every expected receiver
+// reported or the timeout expires. A receiver may answer several copies, and is
+// counted once per name and address.
+func (s *Sender) collectReports(run, sent uint64) ([]multicast.Report, error) {
+	type reply struct {
+		addr   string
+		report multicast.Report
+	}
+
+	replies := make(chan reply)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := s.conn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					return
+				}
+				continue
+			}
+
+			report, err := multicast.UnmarshalReport(buf[:n])
+			if err != nil || report.Run != run {
+				continue
+			}
+
+			replies <- reply{addr: addr.String(), report: report}
+		}
+	}()
+
+	defer func() {
+		// Unblock the reader
+		_ = s.conn.SetReadDeadline(time.Now())
+		for {
+			select {
+			case <-replies:
+			case <-readDone:
+				return
+			}
+		}
+	}()
+
+	timeout := time.After(s.cfg.ReportTimeout)
+	retry := time.NewTicker(finishRetry)
+	defer retry.Stop()
+
+	seen := make(map[string]bool)
+	var reports []multicast.Report
+
+	message := multicast.MarshalFinish(run, sent)
+	for {
+		if _, err := s.conn.WriteToUDP(message, s.group); err != nil {
+			return nil, err
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case r := <-replies:
+				key := r.report.Receiver + "@" + r.addr
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				reports = append(reports, r.report)
+
+				if s.cfg.Receivers > 0 && len(reports) >= s.cfg.Receivers {
+					return reports, nil
+				}
+			case <-timeout:
+				return reports, nil
+			case <-retry.C:
+				waiting = false
+			}
+		}
+	}
+}
+
+func (s *Sender) Close() error {
+	if s.conn != nil {
+		err := s.conn.Close()
+		if err != nil {
+			return err
+		}
+
+		s.logger.Info("Connection closed")
+	}
+
+	return nil
+}
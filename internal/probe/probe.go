@@ -0,0 +1,269 @@
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Every probe packet starts with a fixed header, the rest is padding up to the
+// configured size: magic(4) | seq(8) | sent at(8) | reflected at(8), all big endian.
+// Timestamps are Unix nanoseconds of the clock that wrote them.
+const HeaderSize = 28
+
+var magic = []byte("STPB")
+
+var ErrInvalidPacket = errors.New("invalid probe packet")
+
+// Packet is the header of a probe packet.
+type Packet struct {
+	Seq uint64
+	// SentAt is set by the sender.
+	SentAt int64
+	// ReflectedAt is set by a reflector when it receives the packet, zero otherwise.
+	ReflectedAt int64
+}
+
+// Marshal writes the header into the beginning of buf, which must hold at least HeaderSize bytes.
+func (p Packet) Marshal(buf []byte) {
+	copy(buf, magic)
+	binary.BigEndian.PutUint64(buf[4:], p.Seq)
+	binary.BigEndian.PutUint64(buf[12:], uint64(p.SentAt))
+	binary.BigEndian.PutUint64(buf[20:], uint64(p.ReflectedAt))
+}
+
+// Unmarshal parses the header of a probe packet.
+func Unmarshal(buf []byte) (Packet, error) {
+	if len(buf) < HeaderSize || string(buf[:4]) != string(magic) {
+		return Packet{}, ErrInvalidPacket
+	}
+
+	return Packet{
+		Seq:         binary.BigEndian.Uint64(buf[4:]),
+		SentAt:      int64(binary.BigEndian.Uint64(buf[12:])),
+		ReflectedAt: int64(binary.BigEndian.Uint64(buf[20:])),
+	}, nil
+}
+
+// Reflect stamps the receive time into a received packet in place, so that it can
+// be sent back as is.
+func Reflect(buf []byte, at time.Time) {
+	binary.BigEndian.PutUint64(buf[20:], uint64(at.UnixNano()))
+}
+
+// Jitter is the interarrival jitter estimator of RFC 3550, section 6.4.1. It only
+// uses transit time differences, so a constant clock offset between the hosts cancels out.
+type Jitter struct {
+	lastTransit int64
+	jitter      float64
+	started     bool
+}
+
+// Add feeds the transit time (arrival minus send timestamp) of the next packet in arrival order.
+func (j *Jitter) Add(transit time.Duration) {
+	t := int64(transit)
+	if j.started {
+		d := math.Abs(float64(t - j.lastTransit))
+		j.jitter += (d - j.jitter) / 16
+	}
+
+	j.lastTransit, j.started = t, true
+}
+
+func (j *Jitter) Value() time.Duration {
+	return time.Duration(j.jitter)
+}
+
+// Stats summarizes a probe packet flow.
+type Stats struct {
+	Sent       uint64  `json:"sent,omitempty"`
+	Received   uint64  `json:"received"`
+	Bytes      uint64  `json:"bytes"`
+	Lost       uint64  `json:"lost"`
+	LossRatio  float64 `json:"loss_ratio"`
+	Reordered  uint64  `json:"reordered"`
+	Duplicates uint64  `json:"duplicates"`
+	// Late packets arrived more than Window sequence numbers behind the newest one,
+	// they count as lost.
+	Late uint64 `json:"late,omitempty"`
+	// Invalid packets jumped more than Window sequence numbers ahead and were ignored.
+	Invalid  uint64  `json:"invalid,omitempty"`
+	JitterMs float64 `json:"jitter_ms"`
+}
+
+// Window is the number of sequence numbers behind the newest packet a Receiver
+// remembers. It bounds the memory and work per flow whatever sequence numbers the
+// peer sends.
+const Window = 1 << 16
+
+// Receiver tracks sequence numbers and transit times of arriving packets. It is
+// safe for concurrent use.
+type Receiver struct {
+	mu sync.Mutex
+	// seen is a ring bitset of the sequence numbers [end-Window, end), indexed by
+	// seq % Window
+	seen       [Window / 64]uint64
+	end        uint64 // highest sequence number seen plus one
+	received   uint64
+	bytes      uint64
+	duplicates uint64
+	reordered  uint64
+	late       uint64
+	invalid    uint64
+	jitter     Jitter
+}
+
+func NewReceiver() *Receiver {
+	return &Receiver{}
+}
+
+// Add records the arrival of packet seq of size bytes. It reports false for duplicates
+// and packets outside the window, which are not used for jitter.
+func (r *Receiver) Add(seq uint64, size int, transit time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case seq >= r.end && seq-r.end >= Window:
+		r.invalid++
+		return false
+	case seq >= r.end:
+		r.advance(seq + 1)
+	case r.end-seq > Window:
+		r.late++
+		return false
+	case r.has(seq):
+		r.duplicates++
+		return false
+	default:
+		r.reordered++
+	}
+
+	r.seen[seq%Window/64] |= 1 << (seq % 64)
+
+	r.received++
+	r.bytes += uint64(size)
+	r.jitter.Add(transit)
+
+	return true
+}
+
+// advance moves the window up to end, forgetting the sequence numbers that drop out.
+func (r *Receiver) advance(end uint64) {
+	if end-r.end >= Window {
+		r.seen = [Window / 64]uint64{}
+	} else {
+		for seq := r.end; seq < end; seq++ {
+			r.seen[seq%Window/64] &^= 1 << (seq % 64)
+		}
+	}
+
+	r.end = end
+}
+
+func (r *Receiver) has(seq uint64) bool {
+	return r.seen[seq%Window/64]&(1<<(seq%64)) != 0
+}
+
+// End returns the highest sequence number seen plus one, zero before the first packet.
+func (r *Receiver) End() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.end
+}
+
+// Stats returns the flow summary. sent is the number of packets the peer sent; when
+// it is unknown (zero), the highest sequence number seen stands in for it.
+func (r *Receiver) Stats(sent uint64) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expected := sent
+	if expected == 0 {
+		expected = r.end
+	}
+
+	stats := Stats{
+		Sent:       sent,
+		Received:   r.received,
+		Bytes:      r.bytes,
+		Reordered:  r.reordered,
+		Duplicates: r.duplicates,
+		Late:       r.late,
+		Invalid:    r.invalid,
+		JitterMs:   float64(r.jitter.Value()) / float64(time.Millisecond),
+	}
+
+	if expected > r.received {
+		stats.Lost = expected - r.received
+	}
+
+	if expected > 0 {
+		stats.LossRatio = float64(stats.Lost) / float64(expected)
+	}
+
+	return stats
+}
+
+// Since returns the stats of the packets that arrived after prev, both results of
+// Stats(0). Packets are expected up to the highest sequence number seen, so a late
+// packet filling an earlier gap does not count as a loss in its own interval.
+func (s Stats) Since(prev Stats) Stats {
+	expected := (s.Received + s.Lost) - min(prev.Received+prev.Lost, s.Received+s.Lost)
+	received := s.Received - prev.Received
+
+	interval := Stats{
+		Received:   received,
+		Bytes:      s.Bytes - prev.Bytes,
+		Reordered:  s.Reordered - prev.Reordered,
+		Duplicates: s.Duplicates - prev.Duplicates,
+		Late:       s.Late - prev.Late,
+		Invalid:    s.Invalid - prev.Invalid,
+		JitterMs:   s.JitterMs,
+	}
+
+	if expected > received {
+		interval.Lost = expected - received
+	}
+
+	if expected > 0 {
+		interval.LossRatio = float64(interval.Lost) / float64(expected)
+	}
+
+	return interval
+}
+
+// Gaps counts the runs of missing sequence numbers below sent and returns the length
+// of the longest one. Only the window is inspected, everything after the highest
+// sequence number seen is one run, so the work is bounded whatever sent is.
+func (r *Receiver) Gaps(sent uint64) (gaps, longest uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var run uint64
+	for seq := r.end - min(r.end, Window); seq < min(sent, r.end); seq++ {
+		if r.has(seq) {
+			run = 0
+			continue
+		}
+
+		if run == 0 {
+			gaps++
+		}
+		run++
+		longest = max(longest, run)
+	}
+
+	if sent > r.end {
+		if run == 0 {
+			gaps++
+		}
+		run += sent - r.end
+		longest = max(longest, run)
+	}
+
+	return gaps, longest
+}
@@ -0,0 +1,159 @@
+package probe
+
+import (
+	"testing"
+	"time"
+)
+
+// seqs returns the sequence numbers [from, to).
+func seqs(from, to uint64) []uint64 {
+	var s []uint64
+	for seq := from; seq < to; seq++ {
+		s = append(s, seq)
+	}
+	return s
+}
+
+func TestReceiver(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrived []uint64
+		sent    uint64
+		want    Stats
+		gaps    uint64
+		longest uint64
+	}{
+		{
+			name:    "in order",
+			arrived: seqs(0, 10),
+			sent:    10,
+			want:    Stats{Received: 10},
+		},
+		{
+			name:    "losses",
+			arrived: []uint64{0, 1, 2, 5, 6, 8, 9},
+			sent:    10,
+			want:    Stats{Received: 7, Lost: 3},
+			gaps:    2,
+			longest: 2,
+		},
+		{
+			name:    "lost at the end",
+			arrived: seqs(0, 5),
+			sent:    10,
+			want:    Stats{Received: 5, Lost: 5},
+			gaps:    1,
+			longest: 5,
+		},
+		{
+			name:    "gap reaching the end",
+			arrived: []uint64{0, 1, 2, 3},
+			sent:    8,
+			want:    Stats{Received: 4, Lost: 4},
+			gaps:    1,
+			longest: 4,
+		},
+		{
+			name:    "reordered",
+			arrived: []uint64{0, 2, 1, 4, 3},
+			sent:    5,
+			want:    Stats{Received: 5, Reordered: 2},
+		},
+		{
+			name:    "duplicates",
+			arrived: []uint64{0, 1, 1, 2, 0},
+			sent:    3,
+			want:    Stats{Received: 3, Duplicates: 2},
+		},
+		{
+			name:    "unknown sent",
+			arrived: []uint64{0, 3},
+			want:    Stats{Received: 2, Lost: 2},
+			gaps:    0, // Gaps only looks below sent
+		},
+		{
+			// Packet 0 has left the window once Window arrived, it is late, not a duplicate
+			name:    "late",
+			arrived: []uint64{0, Window, 0},
+			sent:    Window + 1,
+			want:    Stats{Received: 2, Lost: Window - 1, Late: 1},
+			gaps:    1,
+			longest: Window - 1,
+		},
+		{
+			// Gaps only inspects the window, packet 0 has left it
+			name:    "oldest in window",
+			arrived: []uint64{0, Window, 1},
+			sent:    Window + 1,
+			want:    Stats{Received: 3, Lost: Window - 2, Reordered: 1},
+			gaps:    1,
+			longest: Window - 2,
+		},
+		{
+			name:    "first packet beyond the window",
+			arrived: []uint64{Window, 0},
+			sent:    1,
+			want:    Stats{Received: 1, Invalid: 1},
+		},
+		{
+			name:    "jump beyond the window",
+			arrived: []uint64{0, Window + 1, 1},
+			sent:    2,
+			want:    Stats{Received: 2, Invalid: 1},
+		},
+		{
+			// The work is bounded by the window, not by the sent count
+			name:    "huge sent count",
+			arrived: seqs(0, 10),
+			sent:    1 << 40,
+			want:    Stats{Received: 10, Lost: 1<<40 - 10},
+			gaps:    1,
+			longest: 1<<40 - 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceiver()
+			for _, seq := range tt.arrived {
+				r.Add(seq, 100, time.Millisecond)
+			}
+
+			got := r.Stats(tt.sent)
+			want := tt.want
+			want.Sent = tt.sent
+			want.Bytes = 100 * want.Received
+			if expected := max(tt.sent, r.End()); expected > 0 {
+				want.LossRatio = float64(want.Lost) / float64(expected)
+			}
+
+			if got != want {
+				t.Errorf("Stats() = %+v, want %+v", got, want)
+			}
+
+			gaps, longest := r.Gaps(tt.sent)
+			if gaps != tt.gaps || longest != tt.longest {
+				t.Errorf("Gaps() = %d, %d, want %d, %d", gaps, longest, tt.gaps, tt.longest)
+			}
+		})
+	}
+}
+
+func TestStatsSince(t *testing.T) {
+	r := NewReceiver()
+	for _, seq := range []uint64{0, 1, 3} {
+		r.Add(seq, 100, 0)
+	}
+	first := r.Stats(0)
+
+	// The late packet 2 fills the gap of the first interval
+	for _, seq := range []uint64{2, 4, 6} {
+		r.Add(seq, 100, 0)
+	}
+	second := r.Stats(0).Since(first)
+
+	if first.Lost != 1 || second.Received != 3 || second.Lost != 0 || second.Reordered != 1 {
+		t.Fatalf("first interval lost %d, second received %d, lost %d, reordered %d, want 1, 3, 0, 1",
+			first.Lost, second.Received, second.Lost, second.Reordered)
+	}
+}
@@ -0,0 +1,359 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2HeaderLen = 16
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	ErrNoTrustedUpstreams = errors.New("proxy protocol enabled without trusted upstreams")
+	ErrInvalidHeader      = errors.New("invalid proxy protocol header")
+	ErrMissingHeader      = errors.New("missing proxy protocol header")
+)
+
+// Listener wraps a net.Listener and replaces the remote address of connections
+// coming from trusted upstreams with the address announced in their PROXY protocol header.
+type Listener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+}
+
+// NewListener wraps ln. Every entry of trusted is either a single IP address or a CIDR.
+func NewListener(ln net.Listener, trusted []string, headerTimeout time.Duration) (*Listener, error) {
+	if len(trusted) == 0 {
+		return nil, ErrNoTrustedUpstreams
+	}
+
+	nets, err := ParseTrusted(trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{
+		Listener:      ln,
+		trusted:       nets,
+		headerTimeout: headerTimeout,
+	}, nil
+}
+
+// ParseTrusted converts a list of IP addresses and CIDRs to networks.
+func ParseTrusted(trusted []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(trusted))
+	for _, entry := range trusted {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("parse trusted upstream %q: invalid IP address", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("parse trusted upstream %q: %w", entry, err)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &Conn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conn is a connection from a trusted upstream. The PROXY protocol header is parsed
+// lazily on the first Read or RemoteAddr call, so Accept never blocks on a slow peer.
+// A connection without a valid header is closed, it must not pass for one coming
+// from the proxy itself.
+type Conn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	headerErr  error
+
+	// The caller's read deadline is kept aside while the header timeout runs, so that
+	// it is neither cut short nor lost
+	deadlineMu     sync.Mutex
+	readDeadline   time.Time
+	headerDeadline time.Time
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.deadline())
+}
+
+// deadline returns the earlier of the caller's read deadline and the header deadline.
+// c.deadlineMu must be held.
+func (c *Conn) deadline() time.Time {
+	if c.headerDeadline.IsZero() || (!c.readDeadline.IsZero() && c.readDeadline.Before(c.headerDeadline)) {
+		return c.readDeadline
+	}
+
+	return c.headerDeadline
+}
+
+// ProxyAddr returns the address of the upstream proxy the connection came through.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.headerTimeout > 0 {
+		c.deadlineMu.Lock()
+		c.headerDeadline = time.Now().Add(c.headerTimeout)
+		err := c.Conn.SetReadDeadline(c.deadline())
+		c.deadlineMu.Unlock()
+		if err != nil {
+			c.headerErr = err
+			return
+		}
+
+		defer func() {
+			c.deadlineMu.Lock()
+			defer c.deadlineMu.Unlock()
+
+			c.headerDeadline = time.Time{}
+			_ = c.Conn.SetReadDeadline(c.readDeadline)
+		}()
+	}
+
+	c.remoteAddr, c.headerErr = ReadHeader(c.reader)
+	if c.headerErr != nil {
+		c.Conn.Close()
+	}
+}
+
+// ReadHeader consumes a v1 or v2 PROXY protocol header from r and returns the source
+// address it carries. The version is told by the first byte, so a peer that sends
+// less than a full signature is never waited for. A missing header is an error, LOCAL
+// and UNKNOWN headers yield a nil address.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	var prefix []byte
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix = []byte(v1Prefix)
+	case v2Signature[0]:
+		prefix = v2Signature
+	default:
+		return nil, ErrMissingHeader
+	}
+
+	// A proxy sends the whole header at once. Only a peer whose first byte matches a
+	// signature is waited on for the rest of it, anything else was rejected above
+	sig, err := r.Peek(len(prefix))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrMissingHeader
+		}
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if !bytes.Equal(sig, prefix) {
+		return nil, ErrMissingHeader
+	}
+
+	if prefix[0] == v1Prefix[0] {
+		return readV1(r)
+	}
+
+	return readV2(r)
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read v1 header: %w", err)
+		}
+
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol %q", ErrInvalidHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("%w: source address %q", ErrInvalidHeader, fields[2])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: source port %q", ErrInvalidHeader, fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read v2 header: %w", err)
+	}
+
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read v2 addresses: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, verCmd>>4)
+	}
+
+	switch verCmd & 0x0F {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, verCmd&0x0F)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET: src(4) dst(4) sport(2) dport(2)
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport(2) dport(2)
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+}
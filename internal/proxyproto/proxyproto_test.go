@@ -0,0 +1,148 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header builds a v2 header with the given version and command byte, family byte
+// and address block.
+func v2Header(verCmd, family byte, addresses []byte) string {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+
+	return string(append(header, addresses...))
+}
+
+func ipv4Block() []byte {
+	block := []byte{192, 0, 2, 1, 198, 51, 100, 1}
+	block = binary.BigEndian.AppendUint16(block, 56324)
+	return binary.BigEndian.AppendUint16(block, 443)
+}
+
+func ipv6Block() []byte {
+	block := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	block = binary.BigEndian.AppendUint16(block, 56324)
+	return binary.BigEndian.AppendUint16(block, 443)
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string // source address, empty for none
+		wantErr error
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ffff:: ffff:: 1 2\r\n"},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1", wantErr: io.EOF},
+		{name: "v1 truncated prefix", input: "PRO", wantErr: ErrMissingHeader},
+		{name: "v1 without CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443" + strings.Repeat(" ", 100), wantErr: ErrInvalidHeader},
+		{name: "v1 protocol", input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantErr: ErrInvalidHeader},
+		{name: "v1 missing field", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: ErrInvalidHeader},
+		{name: "v1 address", input: "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", wantErr: ErrInvalidHeader},
+		{name: "v1 port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", wantErr: ErrInvalidHeader},
+		{name: "v1 lower case", input: "proxy TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantErr: ErrMissingHeader},
+		{name: "v2 IPv4", input: v2Header(0x21, 0x11, ipv4Block()), want: "192.0.2.1:56324"},
+		{name: "v2 IPv6", input: v2Header(0x21, 0x21, ipv6Block()), want: "[2001:db8::1]:56324"},
+		{name: "v2 IPv4 with TLVs", input: v2Header(0x21, 0x11, append(ipv4Block(), 0x04, 0x00, 0x01, 0xFF)), want: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", input: v2Header(0x20, 0x00, nil)},
+		{name: "v2 UNSPEC", input: v2Header(0x21, 0x00, nil)},
+		{name: "v2 truncated header", input: v2Header(0x21, 0x11, ipv4Block())[:14], wantErr: io.ErrUnexpectedEOF},
+		{name: "v2 truncated addresses", input: v2Header(0x21, 0x11, ipv4Block())[:20], wantErr: io.ErrUnexpectedEOF},
+		{name: "v2 version", input: v2Header(0x11, 0x11, ipv4Block()), wantErr: ErrInvalidHeader},
+		{name: "v2 command", input: v2Header(0x22, 0x11, ipv4Block()), wantErr: ErrInvalidHeader},
+		{name: "v2 short IPv4 block", input: v2Header(0x21, 0x11, ipv4Block()[:8]), wantErr: ErrInvalidHeader},
+		{name: "v2 short IPv6 block", input: v2Header(0x21, 0x21, ipv4Block()), wantErr: ErrInvalidHeader},
+		{name: "v2 signature", input: "\r\n\r\nQUIT", wantErr: ErrMissingHeader},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", wantErr: ErrMissingHeader},
+		{name: "empty", input: "", wantErr: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "payload"))
+			if tt.wantErr != nil {
+				// Truncated input must not read into what follows
+				r = bufio.NewReader(strings.NewReader(tt.input))
+			}
+
+			addr, err := ReadHeader(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ReadHeader() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ReadHeader() error = %v", err)
+			}
+
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Fatalf("ReadHeader() = %q, want %q", got, tt.want)
+			}
+
+			// The header is consumed, nothing more
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("data after the header = %q, want payload", rest)
+			}
+		})
+	}
+}
+
+func TestConnKeepsReadDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	listener, err := NewListener(ln, []string{"127.0.0.1"}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("new listener: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	// Set before the header is read, it must still apply afterwards
+	if err = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Fatalf("remote address = %q, want 192.0.2.1:56324", got)
+	}
+}
@@ -0,0 +1,339 @@
+package qlogs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+const (
+	traceExt      = ".sqlog"
+	compressedExt = ".sqlog.gz"
+	// recordSeparator starts every JSON-SEQ record; the qlog writer emits it as a write of its own.
+	recordSeparator = 0x1e
+)
+
+// Config controls where qlog traces go. It is embedded into the client and server
+// configs with an env prefix, e.g. QUIC_SERVER_QLOG_DIR.
+type Config struct {
+	Dir            string `env:"DIR"`
+	MaxFileSizeMB  int    `env:"MAX_FILE_SIZE_MB" envDefault:"100"`
+	MaxTotalSizeMB int    `env:"MAX_TOTAL_SIZE_MB" envDefault:"1024"`
+	Compress       bool   `env:"COMPRESS" envDefault:"true"`
+}
+
+// Writer writes one qlog trace per connection into a directory. Traces start out named
+// by the original destination connection ID and are renamed once the session ID is known.
+// Finished traces are gzipped and the oldest ones are removed when the directory grows
+// beyond its size limit.
+type Writer struct {
+	cfg    Config
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	traces map[quic.ConnectionTracingID]*traceFile
+	// closed is set once Close started, traces finished later are left as they are
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New returns nil when cfg.Dir is empty. All methods of a nil Writer are no-ops.
+func New(cfg Config, logger *slog.Logger) (*Writer, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create qlog directory: %w", err)
+	}
+
+	return &Writer{
+		cfg:    cfg,
+		logger: logger,
+		traces: make(map[quic.ConnectionTracingID]*traceFile),
+	}, nil
+}
+
+// Tracer has the signature of quic.Config.Tracer.
+func (w *Writer) Tracer(ctx context.Context, p logging.Perspective, odcid quic.ConnectionID) *logging.ConnectionTracer {
+	if w == nil {
+		return nil
+	}
+
+	label := "server"
+	if p == logging.PerspectiveClient {
+		label = "client"
+	}
+
+	path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%s_%s%s", odcid, label, traceExt))
+	f, err := os.Create(path)
+	if err != nil {
+		w.logger.Error("Failed to create qlog file", "path", path, "error", err)
+		return nil
+	}
+
+	trace := &traceFile{
+		writer: w,
+		file:   f,
+		path:   path,
+		label:  label,
+		limit:  int64(w.cfg.MaxFileSizeMB) << 20,
+	}
+	trace.buf = bufio.NewWriter(f)
+
+	if id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID); ok {
+		trace.id = id
+		w.mu.Lock()
+		w.traces[id] = trace
+		w.mu.Unlock()
+	}
+
+	return qlog.NewConnectionTracer(trace, p, odcid)
+}
+
+// Name renames the trace of conn, usually to the session ID.
+func (w *Writer) Name(conn quic.Connection, name string) {
+	if w == nil {
+		return
+	}
+
+	id, ok := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	trace, ok := w.traces[id]
+	if !ok {
+		return
+	}
+
+	// The client names its traces after what the server reports, so the name must not
+	// leave the directory
+	if !validName(name) {
+		w.logger.Warn("Invalid qlog trace name", "name", name)
+		return
+	}
+
+	path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%s_%s%s", name, trace.label, traceExt))
+	if err := os.Rename(trace.path, path); err != nil {
+		w.logger.Warn("Failed to rename qlog file", "path", trace.path, "error", err)
+		return
+	}
+
+	trace.path = path
+}
+
+// validName reports whether name only holds letters, digits, '_' and '-'.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close waits for pending compressions. Traces that finish afterwards are neither
+// compressed nor pruned.
+func (w *Writer) Close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// finish is called when a trace is complete.
+func (w *Writer) finish(trace *traceFile) {
+	w.mu.Lock()
+	delete(w.traces, trace.id)
+	path := trace.path
+	closed := w.closed
+	// Added under the lock, so Close cannot be waiting already
+	if !closed {
+		w.wg.Add(1)
+	}
+	w.mu.Unlock()
+
+	if trace.truncated {
+		w.logger.Warn("qlog trace truncated at size limit", "path", path, "max_file_size_mb", w.cfg.MaxFileSizeMB)
+	}
+
+	if closed {
+		return
+	}
+
+	go func() {
+		defer w.wg.Done()
+
+		if w.cfg.Compress {
+			if err := compress(path); err != nil {
+				w.logger.Error("Failed to compress qlog file", "path", path, "error", err)
+			}
+		}
+
+		if err := w.prune(); err != nil {
+			w.logger.Error("Failed to prune qlog directory", "dir", w.cfg.Dir, "error", err)
+		}
+	}()
+}
+
+// prune removes the oldest finished traces until the directory fits into MaxTotalSizeMB.
+func (w *Writer) prune() error {
+	if w.cfg.MaxTotalSizeMB <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	active := make(map[string]bool, len(w.traces))
+	for _, trace := range w.traces {
+		active[trace.path] = true
+	}
+	w.mu.Unlock()
+
+	type finished struct {
+		path string
+		size int64
+		mod  int64
+	}
+
+	var (
+		files []finished
+		total int64
+	)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, traceExt) && !strings.HasSuffix(name, compressedExt) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(w.cfg.Dir, name)
+		total += info.Size()
+		if !active[path] {
+			files = append(files, finished{path: path, size: info.Size(), mod: info.ModTime().UnixNano()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mod < files[j].mod
+	})
+
+	limit := int64(w.cfg.MaxTotalSizeMB) << 20
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		total -= f.size
+	}
+
+	return nil
+}
+
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(strings.TrimSuffix(path, traceExt) + compressedExt)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err = zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// traceFile is the io.WriteCloser handed to the qlog tracer. Once the size limit is
+// reached it drops every following record, so the file ends on a complete record.
+type traceFile struct {
+	writer *Writer
+	id     quic.ConnectionTracingID
+	file   *os.File
+	buf    *bufio.Writer
+	path   string
+	label  string
+
+	limit     int64
+	written   int64
+	truncated bool
+}
+
+func (t *traceFile) Write(p []byte) (int, error) {
+	if t.limit > 0 && !t.truncated && len(p) > 0 && p[0] == recordSeparator && t.written >= t.limit {
+		t.truncated = true
+	}
+
+	if t.truncated {
+		return len(p), nil
+	}
+
+	n, err := t.buf.Write(p)
+	t.written += int64(n)
+	return n, err
+}
+
+func (t *traceFile) Close() error {
+	err := t.buf.Flush()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	t.writer.finish(t)
+	return err
+}
@@ -2,17 +2,20 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/yvv4git/speed-test/internal/qlogs"
+	"github.com/yvv4git/speed-test/internal/quicconf"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/tlsconf"
 )
 
 type Application struct {
@@ -37,36 +40,144 @@ func (a *Application) Start(ctx context.Context) error {
 
 	a.logger.Info("Starting QUIC client", slog.String("Host", cfg.ServerHost), slog.Int("Port", int(cfg.ServerPort)))
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"quic-echo"},
+	tlsConfig, err := tlsconf.NewClientConfig(tlsconf.ClientParams{
+		CAFile:     cfg.TLSCAFile,
+		Pins:       cfg.TLSPins,
+		ServerName: cfg.TLSServerName,
+		Insecure:   cfg.TLSInsecure,
+	})
+	if err != nil {
+		return fmt.Errorf("create TLS config: %w", err)
 	}
+	tlsConfig.NextProtos = []string{"quic-echo"}
 
-	quicConfig := &quic.Config{
-		HandshakeIdleTimeout:  30 * time.Second, // Увеличьте таймаут рукопожатия
-		MaxIdleTimeout:        60 * time.Second, // Увеличьте таймаут бездействия
-		MaxIncomingStreams:    100,              // Максимальное количество входящих потоков
-		MaxIncomingUniStreams: 100,              // Максимальное количество входящих однонаправленных потоков
-		KeepAlivePeriod:       10 * time.Second, // Период отправки keep-alive пакетов
-		EnableDatagrams:       true,             // Включить поддержку датаграмм
+	if cfg.TLSInsecure {
+		a.logger.Warn("TLS verification is disabled, the connection can be intercepted")
 	}
 
-	addr := net.JoinHostPort(cfg.ServerHost, fmt.Sprintf("%d", cfg.ServerPort))
-	conn, err := quic.DialAddr(ctx, addr, tlsConfig, quicConfig)
+	quicConfig, err := cfg.Transport.QUICConfig()
 	if err != nil {
-		return fmt.Errorf("connect to server: %w", err)
+		return fmt.Errorf("parse config: %w", err)
 	}
 
-	client := NewClient(Params{
-		Logger: a.logger,
-		Cfg:    cfg,
-		Conn:   conn,
-	})
-	defer client.Close()
+	if cfg.Migrates() && !cfg.MigrateServerSupported {
+		return fmt.Errorf("parse config: %w: set QUIC_CLIENT_MIGRATE_SERVER_SUPPORTED once the server follows client address changes, "+
+			"the speed-test QUIC server does not", ErrMigrationUnsupported)
+	}
+
+	a.logger.Info("QUIC transport parameters", "transport", cfg.Transport.Effective(0))
+
+	qlogWriter, err := qlogs.New(cfg.Qlog, a.logger)
+	if err != nil {
+		return fmt.Errorf("open qlog directory: %w", err)
+	}
+	defer qlogWriter.Close()
+
+	if qlogWriter != nil {
+		a.logger.Info("qlog tracing enabled", "dir", cfg.Qlog.Dir)
+	}
+
+	addr := net.JoinHostPort(cfg.ServerHost, fmt.Sprintf("%d", cfg.ServerPort))
 
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
+	if cfg.Test == TestHandshake {
+		quicConfig.Tracer = qlogWriter.Tracer
+
+		benchmark := NewBenchmark(BenchmarkParams{
+			Logger:     a.logger,
+			Cfg:        cfg,
+			Addr:       addr,
+			TLSConfig:  tlsConfig,
+			QUICConfig: quicConfig,
+		})
+
+		if err := benchmark.Start(ctx); err != nil {
+			return fmt.Errorf("handshake benchmark failed: %w", err)
+		}
+
+		a.logger.Info("Application stopped gracefully")
+		return nil
+	}
+
+	stats := quicstats.NewCollector()
+	quicConfig.Tracer = quicconf.Tracers(
+		func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+			return stats.Tracer()
+		},
+		qlogWriter.Tracer,
+	)
+
+	if cfg.Test == TestHTTP3 {
+		client := NewHTTP3Client(HTTP3Params{
+			Logger:     a.logger,
+			Cfg:        cfg,
+			Addr:       addr,
+			TLSConfig:  tlsConfig,
+			QUICConfig: quicConfig,
+			Stats:      stats,
+		})
+		defer client.Close()
+
+		if err := client.Start(ctx); err != nil {
+			return fmt.Errorf("HTTP/3 test failed: %w", err)
+		}
+
+		a.logger.Info("Application stopped gracefully")
+		return nil
+	}
+
+	var (
+		conn     quic.Connection
+		migrator *Migrator
+	)
+	if cfg.Migrates() {
+		// A transport over a socket that can be swapped lets the connection move to a new
+		// client address.
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return fmt.Errorf("resolve server address: %w", err)
+		}
+
+		rebinding, err := newRebindingConn()
+		if err != nil {
+			return fmt.Errorf("open UDP socket: %w", err)
+		}
+		defer rebinding.Close()
+
+		transport := &quic.Transport{Conn: rebinding}
+		defer transport.Close()
+
+		conn, err = transport.Dial(ctx, udpAddr, tlsConfig, quicConfig)
+		if err != nil {
+			return fmt.Errorf("connect to server: %w", err)
+		}
+
+		migrator = NewMigrator(MigratorParams{
+			Logger: a.logger,
+			Cfg:    cfg,
+			Conn:   rebinding,
+		})
+		a.logger.Info("Connection migration enabled",
+			"every", cfg.MigrateEvery, "on_signal", cfg.MigrateOnSignal, "keep_old", cfg.MigrateKeepOld)
+	} else {
+		conn, err = quic.DialAddr(ctx, addr, tlsConfig, quicConfig)
+		if err != nil {
+			return fmt.Errorf("connect to server: %w", err)
+		}
+	}
+
+	client := NewClient(Params{
+		Logger:   a.logger,
+		Cfg:      cfg,
+		Conn:     conn,
+		Stats:    stats,
+		Qlogs:    qlogWriter,
+		Migrator: migrator,
+	})
+	defer client.Close()
+
 	if err := client.Start(ctx); err != nil {
 		return fmt.Errorf("client failed: %w", err)
 	}
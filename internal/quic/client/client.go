@@ -4,34 +4,105 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/qlogs"
+	"github.com/yvv4git/speed-test/internal/quicconf"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/results"
 )
 
 type Client struct {
 	logger *slog.Logger
 	cfg    Config
 	Conn   quic.Connection // Используем quic.Connection вместо net.Conn
+	stats  *quicstats.Collector
+	qlogs  *qlogs.Writer
+	// migrator switches the UDP socket during the test, it may be nil
+	migrator *Migrator
 }
 
 type Config struct {
-	ServerHost string `env:"QUIC_CLIENT_SERVER_HOST" envDefault:"127.0.0.1"`
-	ServerPort uint16 `env:"QUIC_CLIENT_SERVER_PORT" envDefault:"1543"`
-	BufSize    uint16 `env:"QUIC_CLIENT_BUF_SIZE" envDefault:"1024"`
+	ServerHost string    `env:"QUIC_CLIENT_SERVER_HOST" envDefault:"127.0.0.1"`
+	ServerPort uint16    `env:"QUIC_CLIENT_SERVER_PORT" envDefault:"1543"`
+	BufSize    uint16    `env:"QUIC_CLIENT_BUF_SIZE" envDefault:"1024"`
+	AuthMode   auth.Mode `env:"QUIC_CLIENT_AUTH_MODE" envDefault:"none"`
+	AuthKey    string    `env:"QUIC_CLIENT_AUTH_KEY"`
+
+	Test           TestMode      `env:"QUIC_CLIENT_TEST" envDefault:"stream"`
+	Streams        uint16        `env:"QUIC_CLIENT_STREAMS" envDefault:"1"`
+	Duration       time.Duration `env:"QUIC_CLIENT_DURATION" envDefault:"0s"`
+	ResultsTimeout time.Duration `env:"QUIC_CLIENT_RESULTS_TIMEOUT" envDefault:"10s"`
+
+	DatagramRate  uint          `env:"QUIC_CLIENT_DATAGRAM_RATE" envDefault:"1000"`
+	DatagramSize  uint16        `env:"QUIC_CLIENT_DATAGRAM_SIZE" envDefault:"1000"`
+	DatagramDrain time.Duration `env:"QUIC_CLIENT_DATAGRAM_DRAIN" envDefault:"1s"`
+
+	Handshakes        uint     `env:"QUIC_CLIENT_HANDSHAKES" envDefault:"50"`
+	HandshakeVariants []string `env:"QUIC_CLIENT_HANDSHAKE_VARIANTS" envSeparator:"," envDefault:"full,resumed,0rtt"`
+
+	HTTP3Pings         int    `env:"QUIC_CLIENT_HTTP3_PINGS" envDefault:"10"`
+	HTTP3DownloadBytes uint64 `env:"QUIC_CLIENT_HTTP3_DOWNLOAD_BYTES" envDefault:"104857600"`
+	HTTP3UploadBytes   uint64 `env:"QUIC_CLIENT_HTTP3_UPLOAD_BYTES" envDefault:"104857600"`
+
+	MigrateEvery    time.Duration `env:"QUIC_CLIENT_MIGRATE_EVERY" envDefault:"0s"`
+	MigrateOnSignal bool          `env:"QUIC_CLIENT_MIGRATE_ON_SIGNAL" envDefault:"false"`
+	MigrateKeepOld  time.Duration `env:"QUIC_CLIENT_MIGRATE_KEEP_OLD" envDefault:"0s"`
+	// MigrateServerSupported confirms that the server follows client address changes,
+	// migration tests are refused without it
+	MigrateServerSupported bool `env:"QUIC_CLIENT_MIGRATE_SERVER_SUPPORTED" envDefault:"false"`
+
+	TLSCAFile     string   `env:"QUIC_CLIENT_TLS_CA"`
+	TLSPins       []string `env:"QUIC_CLIENT_TLS_PINS" envSeparator:","`
+	TLSServerName string   `env:"QUIC_CLIENT_TLS_SERVER_NAME"`
+	TLSInsecure   bool     `env:"QUIC_CLIENT_TLS_INSECURE" envDefault:"false"`
+
+	Transport quicconf.Config `envPrefix:"QUIC_CLIENT_"`
+	Qlog      qlogs.Config    `envPrefix:"QUIC_CLIENT_QLOG_"`
 }
 
+// TestMode selects what the client measures.
+type TestMode string
+
+const (
+	TestStream   TestMode = "stream"   // reliable throughput over streams
+	TestDatagram TestMode = "datagram" // unreliable datagrams: loss, reordering and jitter
+	// TestHandshake makes many short connections, it is run by Benchmark instead of Client
+	TestHandshake TestMode = "handshake"
+	// TestHTTP3 talks to the server's HTTP/3 endpoints, it is run by HTTP3Client instead of Client
+	TestHTTP3 TestMode = "http3"
+)
+
 type Params struct {
 	Logger *slog.Logger
 	Cfg    Config
 	Conn   quic.Connection
+	// Stats collects the transport statistics of Conn, it may be nil
+	Stats *quicstats.Collector
+	// Qlogs is the qlog writer Conn was dialed with, it may be nil
+	Qlogs *qlogs.Writer
+	// Migrator moves Conn to new UDP sockets during the test, it may be nil
+	Migrator *Migrator
+}
+
+// Migrates reports whether the config asks for connection migration.
+func (cfg Config) Migrates() bool {
+	return cfg.MigrateEvery > 0 || cfg.MigrateOnSignal
 }
 
 func NewClient(params Params) *Client {
 	return &Client{
-		logger: params.Logger,
-		cfg:    params.Cfg,
-		Conn:   params.Conn,
+		logger:   params.Logger,
+		cfg:      params.Cfg,
+		Conn:     params.Conn,
+		stats:    params.Stats,
+		qlogs:    params.Qlogs,
+		migrator: params.Migrator,
 	}
 }
 
@@ -40,43 +111,233 @@ func (c *Client) Start(ctx context.Context) error {
 		return errors.New("connection is not established")
 	}
 
-	stream, err := c.Conn.OpenStreamSync(ctx)
-	if err != nil {
-		c.logger.Error("Failed to open stream", "error", err)
+	if err := c.authenticate(ctx); err != nil {
+		c.logger.Error("Failed to authenticate", "error", err)
 		return err
 	}
-	defer stream.Close()
 
-	buf := make([]byte, c.cfg.BufSize)
+	if c.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Duration)
+		defer cancel()
+	}
+
+	if c.migrator != nil {
+		migrateCtx, stopMigrating := context.WithCancel(ctx)
+		defer stopMigrating()
+		go c.migrator.Run(migrateCtx)
+	}
+
+	switch c.cfg.Test {
+	case TestStream:
+	case TestDatagram:
+		return c.runDatagrams(ctx)
+	default:
+		return fmt.Errorf("unknown test mode %q", c.cfg.Test)
+	}
+
+	if c.cfg.Streams <= 1 {
+		stream, err := c.Conn.OpenStreamSync(ctx)
+		if err != nil {
+			c.logger.Error("Failed to open stream", "error", err)
+			return err
+		}
+
+		summary, report, err := c.runStream(ctx, stream)
+		results.LogComparison(c.logger, summary, report)
+		c.logTransport(report)
+		c.logMigration([]results.Summary{summary}, []*results.Report{report})
+
+		return err
+	}
+
+	return c.runStreams(ctx, int(c.cfg.Streams))
+}
+
+// runStreams runs count bidirectional streams side by side on the connection, each
+// with its own traffic and server report, and prints the per-stream and combined results.
+func (c *Client) runStreams(ctx context.Context, count int) error {
+	c.logger.Info("Opening streams", "count", count)
+
+	summaries := make([]results.Summary, count)
+	reports := make([]*results.Report, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			stream, err := c.Conn.OpenStreamSync(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("open stream %d: %w", i, err)
+				return
+			}
+
+			summaries[i], reports[i], errs[i] = c.runStream(ctx, stream)
+		}()
+	}
+	wg.Wait()
+
+	for i := range count {
+		results.LogComparison(c.logger.With("stream", i), summaries[i], reports[i])
+	}
+
+	results.LogAggregate(c.logger, "stream", summaries)
+	c.logTransport(reports[0])
+	c.logMigration(summaries, reports)
+
+	return errors.Join(errs...)
+}
+
+type readResult struct {
+	received uint64
+	report   *results.Report
+	err      error
+}
+
+// runStream sends data on the stream until ctx is done. It then closes the sending
+// side and drains the remaining responses together with the server's results.
+func (c *Client) runStream(ctx context.Context, stream quic.Stream) (results.Summary, *results.Report, error) {
+	started := time.Now()
+
+	readCh := make(chan readResult, 1)
+	go func() {
+		received, report, err := results.ReadTrailer(stream, int(c.cfg.BufSize))
+		readCh <- readResult{received: received, report: report, err: err}
+	}()
+
+	sent, sendErr := c.send(ctx, stream)
+	if sendErr != nil {
+		c.logger.Error("Failed to send random bytes", "error", sendErr)
+	}
+
+	// Close only the sending direction, the server answers with its results
+	if err := stream.Close(); err != nil {
+		c.logger.Warn("Failed to close sending side", "error", err)
+	}
+
+	var res readResult
+	select {
+	case res = <-readCh:
+	case <-time.After(c.cfg.ResultsTimeout):
+		c.logger.Warn("Timed out waiting for server results")
+		stream.CancelRead(0)
+		res = <-readCh
+	}
+
+	if res.err != nil && sendErr == nil {
+		c.logger.Error("Failed to read response", "error", res.err)
+	}
+
+	summary := results.Summary{
+		Duration:      time.Since(started),
+		BytesSent:     sent,
+		BytesReceived: res.received,
+	}
+
+	return summary, res.report, sendErr
+}
+
+func (c *Client) send(ctx context.Context, stream quic.Stream) (uint64, error) {
+	// A write blocked by flow control, e.g. while the path is stalled, is released when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = stream.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	var sent uint64
 	for {
 		select {
 		case <-ctx.Done():
 			c.logger.Info("Client stopping due to context cancellation")
-			return nil
+			return sent, nil
 
 		default:
 			randomBytes := make([]byte, c.cfg.BufSize)
 			_, err := rand.Read(randomBytes)
 			if err != nil {
-				c.logger.Error("Failed to generate random bytes", "error", err)
-				return err
+				return sent, err
 			}
 
-			_, err = stream.Write(randomBytes)
-			if err != nil {
-				c.logger.Error("Failed to send random bytes", "error", err)
-				return err
+			n, err := stream.Write(randomBytes)
+			sent += uint64(n)
+			if err != nil && ctx.Err() != nil {
+				c.logger.Info("Client stopping due to context cancellation")
+				return sent, nil
 			}
-
-			_, err = stream.Read(buf)
 			if err != nil {
-				c.logger.Error("Failed to read response", "error", err)
-				return err
+				return sent, err
 			}
 		}
 	}
 }
 
+// logTransport prints the effective transport parameters of both sides, which
+// bound the throughput on high-BDP links, and the connection statistics each side saw.
+func (c *Client) logTransport(report *results.Report) {
+	// Name the trace like the server does, so both sides of a run are easy to match
+	if report != nil && report.SessionID != "" {
+		c.qlogs.Name(c.Conn, report.SessionID)
+	}
+
+	c.logger.Info("Client transport parameters", "transport", c.cfg.Transport.Effective(c.Conn.ConnectionState().Version))
+
+	if report != nil && report.QUIC != nil {
+		c.logger.Info("Server transport parameters", "transport", report.QUIC)
+	}
+
+	if c.stats != nil {
+		c.logger.Info("Client connection statistics", "quic", c.stats.Stats())
+	}
+
+	if report != nil && report.QUICStats != nil {
+		c.logger.Info("Server connection statistics", "quic", *report.QUICStats)
+	}
+}
+
+// logMigration prints the outcome of the migration test. Bytes the server reports as
+// received count as delivered; without a report the echoed bytes are used instead.
+func (c *Client) logMigration(summaries []results.Summary, reports []*results.Report) {
+	if c.migrator == nil {
+		return
+	}
+
+	var sent, delivered uint64
+	for i, summary := range summaries {
+		sent += summary.BytesSent
+		if reports[i] != nil {
+			delivered += reports[i].BytesReceived
+		} else {
+			delivered += summary.BytesReceived
+		}
+	}
+
+	c.migrator.Log(c.Conn.Context().Err() == nil, sent, delivered)
+}
+
+// authenticate runs the handshake on a dedicated stream, which must be the first
+// stream of the connection.
+func (c *Client) authenticate(ctx context.Context) error {
+	if c.cfg.AuthMode == auth.ModeNone {
+		return nil
+	}
+
+	stream, err := c.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err = auth.Handshake(stream, c.cfg.AuthMode, c.cfg.AuthKey); err != nil {
+		return err
+	}
+
+	c.logger.Info("Authenticated", "mode", c.cfg.AuthMode)
+	return nil
+}
+
 func (c *Client) Close() error {
 	if c.Conn != nil {
 		err := c.Conn.CloseWithError(0, "client closing")
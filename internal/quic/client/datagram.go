@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/results"
+)
+
+// roundTrips collects what the client learns from reflected datagrams.
+type roundTrips struct {
+	mu         sync.Mutex
+	receiver   *probe.Receiver
+	upstream   probe.Jitter
+	downstream probe.Jitter
+	rttMin     time.Duration
+	rttMax     time.Duration
+	rttSum     time.Duration
+}
+
+func (r *roundTrips) add(packet probe.Packet, size int, now time.Time) {
+	sentAt, reflectedAt := time.Unix(0, packet.SentAt), time.Unix(0, packet.ReflectedAt)
+	rtt := now.Sub(sentAt)
+
+	// Loss and ordering are counted over the round trip
+	if !r.receiver.Add(packet.Seq, size, rtt) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Each one-way transit includes the clock offset between the hosts, which
+	// the jitter estimator cancels out
+	r.upstream.Add(reflectedAt.Sub(sentAt))
+	r.downstream.Add(now.Sub(reflectedAt))
+
+	if r.rttMin == 0 || rtt < r.rttMin {
+		r.rttMin = rtt
+	}
+	r.rttMax = max(r.rttMax, rtt)
+	r.rttSum += rtt
+}
+
+// runDatagrams sends sequence-numbered, timestamped datagrams at the configured rate
+// until ctx is done, collects the datagrams the server reflects and prints the
+// delivery, loss, reordering, duplication and jitter of both directions.
+func (c *Client) runDatagrams(ctx context.Context) error {
+	if !c.Conn.ConnectionState().SupportsDatagrams {
+		return errors.New("datagrams are not supported by the server")
+	}
+
+	if c.cfg.DatagramSize < probe.HeaderSize {
+		return fmt.Errorf("datagram size must be at least %d bytes", probe.HeaderSize)
+	}
+
+	if c.cfg.DatagramRate == 0 {
+		return errors.New("datagram rate must be positive")
+	}
+
+	c.logger.Info("Starting datagram test", "rate_pps", c.cfg.DatagramRate, "size", c.cfg.DatagramSize)
+
+	trips := &roundTrips{receiver: probe.NewReceiver()}
+
+	recvCtx, stopRecv := context.WithCancel(context.Background())
+	defer stopRecv()
+
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		for {
+			data, err := c.Conn.ReceiveDatagram(recvCtx)
+			if err != nil {
+				return
+			}
+
+			now := time.Now()
+			if packet, err := probe.Unmarshal(data); err == nil {
+				trips.add(packet, len(data), now)
+			}
+		}
+	}()
+
+	started := time.Now()
+	sent, sendErr := c.sendDatagrams(ctx)
+	duration := time.Since(started)
+	if sendErr != nil {
+		c.logger.Error("Failed to send datagram", "error", sendErr)
+	}
+
+	// Datagrams still in flight count as delivered if they arrive within the drain period,
+	// an interrupted test reports right away
+	drain := time.NewTimer(c.cfg.DatagramDrain)
+	select {
+	case <-drain.C:
+	case <-ctx.Done():
+		drain.Stop()
+	}
+	stopRecv()
+	<-recvDone
+
+	reflected := trips.receiver.Stats(sent)
+	size := uint64(c.cfg.DatagramSize)
+
+	attrs := []any{
+		"duration", duration,
+		"target_rate_pps", c.cfg.DatagramRate,
+		"sent", sent,
+		"send_rate_pps", float64(sent) / duration.Seconds(),
+		"send_rate_mbps", results.Mbps(sent*size, duration),
+		"reflected", reflected.Received,
+		"round_trip_loss", reflected.Lost,
+		"round_trip_loss_ratio", reflected.LossRatio,
+		"reordered", reflected.Reordered,
+		"duplicates", reflected.Duplicates,
+		"delivery_rate_mbps", results.Mbps(reflected.Bytes, duration),
+	}
+
+	if reflected.Received > 0 {
+		attrs = append(attrs,
+			"rtt_min", trips.rttMin,
+			"rtt_avg", trips.rttSum/time.Duration(reflected.Received),
+			"rtt_max", trips.rttMax,
+			"upstream_jitter", trips.upstream.Value(),
+			"downstream_jitter", trips.downstream.Value(),
+		)
+	} else {
+		c.logger.Warn("No datagrams were reflected, the server only reflects in echo mode")
+	}
+
+	c.logger.Info("Datagram results", attrs...)
+
+	report, err := c.requestResults()
+	if err != nil {
+		c.logger.Warn("Failed to read server results", "error", err)
+	} else if report != nil && report.Datagrams != nil {
+		upload := report.Datagrams
+		upload.Lost = sent - min(sent, upload.Received)
+		upload.LossRatio = float64(upload.Lost) / float64(max(sent, 1))
+
+		c.logger.Info("Server datagram results",
+			"session_id", report.SessionID,
+			"received", upload.Received,
+			"upload_loss", upload.Lost,
+			"upload_loss_ratio", upload.LossRatio,
+			"reordered", upload.Reordered,
+			"duplicates", upload.Duplicates,
+			"upstream_jitter_ms", upload.JitterMs,
+			"delivery_rate_mbps", results.Mbps(upload.Bytes, duration),
+		)
+	}
+
+	c.logTransport(report)
+
+	return sendErr
+}
+
+// sendDatagrams paces datagrams to the configured rate and returns how many were sent.
+func (c *Client) sendDatagrams(ctx context.Context) (uint64, error) {
+	interval := time.Second / time.Duration(c.cfg.DatagramRate)
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+
+	buf := make([]byte, c.cfg.DatagramSize)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+
+	started := time.Now()
+	var seq uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return seq, nil
+
+		case now := <-ticker.C:
+			// Send everything that is due, the ticker is coarser than the interval at high rates
+			due := uint64(now.Sub(started)/interval) + 1
+			for ; seq < due; seq++ {
+				probe.Packet{Seq: seq, SentAt: time.Now().UnixNano()}.Marshal(buf)
+				if err := c.Conn.SendDatagram(buf); err != nil {
+					return seq, err
+				}
+			}
+		}
+	}
+}
+
+// requestResults opens an empty stream, which makes the server answer with its report.
+func (c *Client) requestResults() (*results.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ResultsTimeout)
+	defer cancel()
+
+	stream, err := c.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = stream.Close(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		stream.CancelRead(0)
+	}()
+
+	_, report, err := results.ReadTrailer(stream, int(c.cfg.BufSize))
+	return report, err
+}
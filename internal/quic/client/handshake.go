@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/results"
+)
+
+// HandshakeVariant is one way of establishing a connection in the handshake benchmark.
+type HandshakeVariant string
+
+const (
+	VariantFull    HandshakeVariant = "full"    // full 1-RTT handshake, no session cache
+	VariantResumed HandshakeVariant = "resumed" // TLS session resumption from a session cache
+	Variant0RTT    HandshakeVariant = "0rtt"    // resumption with the request sent as 0-RTT early data
+)
+
+// requestSize is the size of the request whose response marks the first byte.
+const requestSize = 32
+
+type BenchmarkParams struct {
+	Logger     *slog.Logger
+	Cfg        Config
+	Addr       string
+	TLSConfig  *tls.Config
+	QUICConfig *quic.Config
+}
+
+// Benchmark makes many short sequential connections and measures how long it takes
+// to establish them and to get the first response byte.
+type Benchmark struct {
+	logger     *slog.Logger
+	cfg        Config
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+}
+
+func NewBenchmark(params BenchmarkParams) *Benchmark {
+	return &Benchmark{
+		logger:     params.Logger,
+		cfg:        params.Cfg,
+		addr:       params.Addr,
+		tlsConfig:  params.TLSConfig,
+		quicConfig: params.QUICConfig,
+	}
+}
+
+type handshakeSample struct {
+	handshake time.Duration
+	ttfb      time.Duration
+	resumed   bool
+	used0RTT  bool
+}
+
+func (b *Benchmark) Start(ctx context.Context) error {
+	if b.cfg.Handshakes == 0 {
+		return errors.New("number of handshakes must be positive")
+	}
+
+	var ttfbFull time.Duration
+	for _, name := range b.cfg.HandshakeVariants {
+		variant := HandshakeVariant(name)
+		switch variant {
+		case VariantFull, VariantResumed, Variant0RTT:
+		default:
+			return fmt.Errorf("unknown handshake variant %q", name)
+		}
+
+		samples, failures, err := b.runVariant(ctx, variant)
+		if err != nil {
+			return err
+		}
+
+		handshakes := make([]time.Duration, 0, len(samples))
+		ttfbs := make([]time.Duration, 0, len(samples))
+		var resumed, used0RTT int
+		for _, s := range samples {
+			handshakes = append(handshakes, s.handshake)
+			ttfbs = append(ttfbs, s.ttfb)
+			if s.resumed {
+				resumed++
+			}
+			if s.used0RTT {
+				used0RTT++
+			}
+		}
+
+		ttfb := results.NewDistribution(ttfbs)
+		attrs := []any{
+			"variant", variant,
+			"connections", len(samples),
+			"failures", failures,
+			"resumed", resumed,
+			"used_0rtt", used0RTT,
+			"handshake", results.NewDistribution(handshakes),
+			"ttfb", ttfb,
+		}
+
+		if variant == VariantFull {
+			ttfbFull = ttfb.P50
+		} else if ttfbFull > 0 {
+			attrs = append(attrs, "ttfb_p50_vs_full", ttfb.P50-ttfbFull)
+		}
+
+		b.logger.Info("Handshake benchmark results", attrs...)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	if b.cfg.AuthMode != auth.ModeNone {
+		b.logger.Warn("Authentication adds a round trip before the request, which hides most of the 0-RTT gain")
+	}
+
+	return nil
+}
+
+// runVariant makes the configured number of connections of one variant. Variants that
+// resume a session start with an unmeasured connection that fills the session cache.
+func (b *Benchmark) runVariant(ctx context.Context, variant HandshakeVariant) ([]handshakeSample, int, error) {
+	tlsConfig := b.tlsConfig.Clone()
+	tlsConfig.ClientSessionCache = nil
+	if variant != VariantFull {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+		if _, err := b.connect(ctx, VariantFull, tlsConfig); err != nil {
+			return nil, 0, fmt.Errorf("prime session cache: %w", err)
+		}
+	}
+
+	b.logger.Info("Running handshake benchmark", "variant", variant, "connections", b.cfg.Handshakes)
+
+	samples := make([]handshakeSample, 0, b.cfg.Handshakes)
+	var failures int
+	for range b.cfg.Handshakes {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sample, err := b.connect(ctx, variant, tlsConfig)
+		if err != nil {
+			failures++
+			b.logger.Warn("Connection failed", "variant", variant, "error", err)
+			continue
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, failures, nil
+}
+
+// connect opens one connection, sends a small request on a stream and waits for the
+// first byte of the response. With 0-RTT the request leaves together with the first flight.
+func (b *Benchmark) connect(ctx context.Context, variant HandshakeVariant, tlsConfig *tls.Config) (handshakeSample, error) {
+	var (
+		sample  handshakeSample
+		conn    quic.Connection
+		err     error
+		started = time.Now()
+	)
+
+	handshakeDone := make(chan time.Duration, 1)
+	if variant == Variant0RTT {
+		var early quic.EarlyConnection
+		early, err = quic.DialAddrEarly(ctx, b.addr, tlsConfig, b.quicConfig)
+		if err == nil {
+			conn = early
+			go func() {
+				select {
+				case <-early.HandshakeComplete():
+					handshakeDone <- time.Since(started)
+				case <-early.Context().Done():
+					handshakeDone <- 0
+				}
+			}()
+		}
+	} else {
+		conn, err = quic.DialAddr(ctx, b.addr, tlsConfig, b.quicConfig)
+		handshakeDone <- time.Since(started)
+	}
+	if err != nil {
+		return sample, fmt.Errorf("connect to server: %w", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	if b.cfg.AuthMode != auth.ModeNone {
+		authStream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return sample, err
+		}
+
+		err = auth.Handshake(authStream, b.cfg.AuthMode, b.cfg.AuthKey)
+		authStream.Close()
+		if err != nil {
+			return sample, fmt.Errorf("authenticate: %w", err)
+		}
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return sample, err
+	}
+
+	if _, err = stream.Write(make([]byte, requestSize)); err != nil {
+		return sample, fmt.Errorf("send request: %w", err)
+	}
+
+	// The server answers with an echo or, in sink mode, with its results once the stream is closed
+	if err = stream.Close(); err != nil {
+		return sample, err
+	}
+
+	if _, err = io.ReadFull(stream, make([]byte, 1)); err != nil {
+		return sample, fmt.Errorf("read response: %w", err)
+	}
+	sample.ttfb = time.Since(started)
+
+	if _, err = io.Copy(io.Discard, stream); err != nil {
+		return sample, fmt.Errorf("read response: %w", err)
+	}
+
+	sample.handshake = <-handshakeDone
+	state := conn.ConnectionState()
+	sample.resumed = state.TLS.DidResume
+	sample.used0RTT = state.Used0RTT
+
+	return sample, nil
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/results"
+)
+
+type HTTP3Params struct {
+	Logger     *slog.Logger
+	Cfg        Config
+	Addr       string
+	TLSConfig  *tls.Config
+	QUICConfig *quic.Config
+	// Stats collects the transport statistics of the connection, it may be nil
+	Stats *quicstats.Collector
+}
+
+// HTTP3Client measures request latency, download and upload over HTTP/3, the way a
+// browser talks to the server, against the endpoints the server exposes with QUIC_SERVER_HTTP3.
+type HTTP3Client struct {
+	logger    *slog.Logger
+	cfg       Config
+	baseURL   string
+	stats     *quicstats.Collector
+	transport *http3.Transport
+	client    *http.Client
+}
+
+func NewHTTP3Client(params HTTP3Params) *HTTP3Client {
+	tlsConfig := params.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+
+	// The HTTP/3 transport dials with exactly one QUIC version, the preferred one
+	quicConfig := params.QUICConfig.Clone()
+	if len(quicConfig.Versions) > 1 {
+		quicConfig.Versions = quicConfig.Versions[:1]
+	}
+
+	transport := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      quicConfig,
+	}
+
+	return &HTTP3Client{
+		logger:    params.Logger,
+		cfg:       params.Cfg,
+		baseURL:   "https://" + params.Addr,
+		stats:     params.Stats,
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+	}
+}
+
+func (c *HTTP3Client) Start(ctx context.Context) error {
+	if c.cfg.AuthMode == auth.ModeHMAC {
+		return fmt.Errorf("HTTP/3 supports only %q authentication", auth.ModeToken)
+	}
+
+	if err := c.ping(ctx); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+
+	if err := c.download(ctx); err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+
+	if err := c.upload(ctx); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+
+	if c.stats != nil {
+		c.logger.Info("Client connection statistics", "quic", c.stats.Stats())
+	}
+
+	return nil
+}
+
+// ping measures the request round trip. The first request also establishes the
+// connection, its latency is reported separately.
+func (c *HTTP3Client) ping(ctx context.Context) error {
+	var (
+		first   time.Duration
+		samples = make([]time.Duration, 0, c.cfg.HTTP3Pings)
+	)
+	for i := range c.cfg.HTTP3Pings + 1 {
+		if ctx.Err() != nil {
+			break
+		}
+
+		started := time.Now()
+		resp, err := c.do(ctx, http.MethodGet, "/ping", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if i == 0 {
+			first = time.Since(started)
+			continue
+		}
+		samples = append(samples, time.Since(started))
+	}
+
+	c.logger.Info("HTTP/3 ping results", "first_request", first, "latency", results.NewDistribution(samples))
+	return nil
+}
+
+func (c *HTTP3Client) download(ctx context.Context) error {
+	before := c.wireStats()
+	started := time.Now()
+
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/download?bytes=%d", c.cfg.HTTP3DownloadBytes), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	received, err := io.Copy(io.Discard, resp.Body)
+	duration := time.Since(started)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	after := c.wireStats()
+	c.logger.Info("HTTP/3 download results",
+		"session_id", resp.Header.Get("X-Session-Id"),
+		"duration", duration,
+		"bytes_requested", c.cfg.HTTP3DownloadBytes,
+		"bytes_received", received,
+		"rate_mbps", results.Mbps(uint64(received), duration),
+		"wire_bytes", after.BytesReceived-before.BytesReceived,
+		"overhead_ratio", overhead(after.BytesReceived-before.BytesReceived, uint64(received)),
+	)
+
+	return nil
+}
+
+func (c *HTTP3Client) upload(ctx context.Context) error {
+	body := &uploadBody{ctx: ctx, remaining: c.cfg.HTTP3UploadBytes, chunk: make([]byte, 64<<10)}
+	if _, err := rand.Read(body.chunk); err != nil {
+		return err
+	}
+
+	before := c.wireStats()
+	started := time.Now()
+
+	resp, err := c.do(ctx, http.MethodPost, "/upload", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report results.Report
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("read server results: %w", err)
+	}
+	duration := time.Since(started)
+
+	after := c.wireStats()
+	c.logger.Info("HTTP/3 upload results",
+		"session_id", report.SessionID,
+		"duration", duration,
+		"bytes_sent", body.sent.Load(),
+		"bytes_received_by_server", report.BytesReceived,
+		"rate_mbps", results.Mbps(report.BytesReceived, duration),
+		"wire_bytes", after.BytesSent-before.BytesSent,
+		"overhead_ratio", overhead(after.BytesSent-before.BytesSent, report.BytesReceived),
+	)
+
+	if sent := body.sent.Load(); report.BytesReceived != sent {
+		c.logger.Warn("Byte count mismatch", "direction", "upload", "sent", sent, "received", report.BytesReceived)
+	}
+
+	return nil
+}
+
+func (c *HTTP3Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cfg.AuthMode == auth.ModeToken {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.AuthKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// wireStats returns the bytes of all QUIC packets so far, including headers and HTTP/3 framing.
+func (c *HTTP3Client) wireStats() quicstats.Stats {
+	if c.stats == nil {
+		return quicstats.Stats{}
+	}
+
+	return c.stats.Stats()
+}
+
+// overhead is the ratio of bytes on the wire to payload bytes, zero when unknown.
+func overhead(wire, payload uint64) float64 {
+	if wire == 0 || payload == 0 {
+		return 0
+	}
+
+	return float64(wire) / float64(payload)
+}
+
+func (c *HTTP3Client) Close() error {
+	return c.transport.Close()
+}
+
+// uploadBody produces the upload payload until its size is reached or ctx is done.
+type uploadBody struct {
+	ctx       context.Context
+	remaining uint64
+	chunk     []byte
+	// sent is read once the server answered, the body is read by the transport's goroutine
+	sent atomic.Uint64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 || b.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.chunk[:min(uint64(len(b.chunk)), b.remaining)])
+	b.remaining -= uint64(n)
+	b.sent.Add(uint64(n))
+
+	return n, nil
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// ErrMigrationUnsupported is returned when a migration test is configured without
+// confirming that the server supports connection migration.
+var ErrMigrationUnsupported = errors.New("connection migration needs a server that supports it")
+
+// migrationSupportNote is logged when a connection did not survive a migration. quic-go
+// v0.48, which the speed-test QUIC server is built on, keeps sending to the address a
+// connection started from, so against that server every migration stalls or closes the
+// connection. Only a server that follows client address changes shows how the network
+// handles them.
+const migrationSupportNote = "The speed-test QUIC server does not follow client address changes (quic-go v0.48), " +
+	"run the migration test against a server that supports connection migration"
+
+// migrationEvent describes one switch of the client's UDP socket.
+type migrationEvent struct {
+	at        time.Time
+	oldAddr   string
+	newAddr   string
+	stall     time.Duration
+	recovered bool
+}
+
+type MigratorParams struct {
+	Logger *slog.Logger
+	Cfg    Config
+	Conn   *rebindingConn
+}
+
+// Migrator moves a running connection to a new UDP socket on a schedule or when the
+// process receives SIGUSR1, and measures how long the server takes to follow.
+type Migrator struct {
+	logger *slog.Logger
+	cfg    Config
+	conn   *rebindingConn
+
+	mu     sync.Mutex
+	events []*migrationEvent
+}
+
+func NewMigrator(params MigratorParams) *Migrator {
+	return &Migrator{
+		logger: params.Logger,
+		cfg:    params.Cfg,
+		conn:   params.Conn,
+	}
+}
+
+// Run triggers migrations until ctx is done.
+func (m *Migrator) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if m.cfg.MigrateEvery > 0 {
+		ticker := time.NewTicker(m.cfg.MigrateEvery)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	signals := make(chan os.Signal, 1)
+	if m.cfg.MigrateOnSignal && len(migrateSignals) > 0 {
+		signal.Notify(signals, migrateSignals...)
+		defer signal.Stop(signals)
+		m.logger.Info("Send SIGUSR1 to migrate the connection", "pid", os.Getpid())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-signals:
+		}
+
+		m.migrate(ctx)
+	}
+}
+
+func (m *Migrator) migrate(ctx context.Context) {
+	started := time.Now()
+	oldAddr, newAddr, firstPacket, err := m.conn.Rebind(m.cfg.MigrateKeepOld)
+	if err != nil {
+		m.logger.Error("Failed to switch UDP socket", "error", err)
+		return
+	}
+
+	m.logger.Info("Switched UDP socket", "old_addr", oldAddr, "new_addr", newAddr)
+
+	event := &migrationEvent{at: started, oldAddr: oldAddr.String(), newAddr: newAddr.String()}
+	m.mu.Lock()
+	m.events = append(m.events, event)
+	m.mu.Unlock()
+
+	go func() {
+		select {
+		case at := <-firstPacket:
+			m.mu.Lock()
+			event.stall, event.recovered = at.Sub(started), true
+			m.mu.Unlock()
+			m.logger.Info("Server reached the new address", "new_addr", newAddr, "stall", at.Sub(started))
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// Log prints every migration and the outcome of the test. open tells whether the
+// connection is still open, sent and delivered are the bytes the client sent and the
+// bytes that reached the server (or came back). The connection survived if it is open
+// and the server followed it to the last socket.
+func (m *Migrator) Log(open bool, sent, delivered uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	survived := open
+	if len(m.events) > 0 {
+		survived = survived && m.events[len(m.events)-1].recovered
+	}
+
+	for i, event := range m.events {
+		attrs := []any{
+			"migration", i,
+			"at", event.at.Format(time.RFC3339Nano),
+			"old_addr", event.oldAddr,
+			"new_addr", event.newAddr,
+			"recovered", event.recovered,
+		}
+		if event.recovered {
+			attrs = append(attrs, "stall", event.stall)
+		}
+		m.logger.Info("Migration results", attrs...)
+	}
+
+	m.logger.Info("Migration test results",
+		"migrations", len(m.events),
+		"connection_open", open,
+		"connection_survived", survived,
+		"bytes_sent", sent,
+		"bytes_delivered", delivered,
+		"bytes_lost", sent-min(sent, delivered),
+	)
+
+	if !survived {
+		m.logger.Warn("The server did not follow the connection to the new socket", "note", migrationSupportNote)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package client
+
+import "os"
+
+// migrateSignals is empty where SIGUSR1 does not exist, only scheduled migrations work.
+var migrateSignals []os.Signal
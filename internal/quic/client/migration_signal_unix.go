@@ -0,0 +1,11 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// migrateSignals trigger a migration when QUIC_CLIENT_MIGRATE_ON_SIGNAL is set.
+var migrateSignals = []os.Signal{syscall.SIGUSR1}
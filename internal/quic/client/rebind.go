@@ -0,0 +1,201 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// oldSocketLinger is how long a replaced socket stays open at least. It covers more than
+// one probe timeout, so a packet quic-go is sending while the socket is swapped does not
+// hit a closed socket, which would end the connection.
+const oldSocketLinger = time.Second
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// rebindingConn is a net.PacketConn whose UDP socket can be replaced while a QUIC
+// connection runs on top of it. The server then sees the client's packets arrive
+// from a new address, just like after a NAT rebinding or a Wi-Fi to LTE handover.
+type rebindingConn struct {
+	mu       sync.Mutex
+	current  *net.UDPConn
+	deadline time.Time
+	// deadlineChanged wakes up blocked readers when the read deadline moves
+	deadlineChanged chan struct{}
+
+	packets chan datagram
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newRebindingConn() (*rebindingConn, error) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rebindingConn{
+		current:         udpConn,
+		deadlineChanged: make(chan struct{}),
+		packets:         make(chan datagram, 256),
+		closed:          make(chan struct{}),
+	}
+	go c.readLoop(udpConn, nil)
+
+	return c, nil
+}
+
+// Rebind switches sending to a fresh socket on a new local port. The old socket keeps
+// receiving for keepOld (zero stops it right away, the harshest case) and is closed
+// once oldSocketLinger has passed as well. The returned channel yields the time the
+// first packet arrives on the new socket.
+func (c *rebindingConn) Rebind(keepOld time.Duration) (net.Addr, net.Addr, <-chan time.Time, error) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	firstPacket := make(chan time.Time, 1)
+	go c.readLoop(udpConn, firstPacket)
+
+	c.mu.Lock()
+	old := c.current
+	c.current = udpConn
+	c.mu.Unlock()
+
+	// The read loop of the old socket ends at the deadline
+	_ = old.SetReadDeadline(time.Now().Add(keepOld))
+	time.AfterFunc(max(keepOld, oldSocketLinger), func() { _ = old.Close() })
+
+	return old.LocalAddr(), udpConn.LocalAddr(), firstPacket, nil
+}
+
+func (c *rebindingConn) readLoop(udpConn *net.UDPConn, firstPacket chan<- time.Time) {
+	for {
+		buf := make([]byte, 2048)
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if firstPacket != nil {
+			firstPacket <- time.Now()
+			firstPacket = nil
+		}
+
+		select {
+		case c.packets <- datagram{data: buf[:n], addr: addr}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *rebindingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, retry, err := c.readOnce(p)
+		if !retry {
+			return n, addr, err
+		}
+	}
+}
+
+// readOnce waits for a packet until the read deadline. It asks for a retry when the
+// deadline was changed in the meantime.
+func (c *rebindingConn) readOnce(p []byte) (int, net.Addr, bool, error) {
+	c.mu.Lock()
+	deadline, changed := c.deadline, c.deadlineChanged
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, false, os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.packets:
+		return copy(p, pkt.data), pkt.addr, false, nil
+	case <-c.closed:
+		return 0, nil, false, net.ErrClosed
+	case <-timeout:
+		return 0, nil, false, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, nil, true, nil
+	}
+}
+
+func (c *rebindingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	udpConn := c.current
+	c.mu.Unlock()
+
+	n, err := udpConn.WriteTo(p, addr)
+	if !errors.Is(err, net.ErrClosed) {
+		return n, err
+	}
+
+	// The socket was replaced and closed after it was picked, send on its successor
+	c.mu.Lock()
+	current := c.current
+	c.mu.Unlock()
+
+	if current == udpConn {
+		return n, err
+	}
+
+	return current.WriteTo(p, addr)
+}
+
+func (c *rebindingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.current.Close()
+}
+
+func (c *rebindingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.current.LocalAddr()
+}
+
+func (c *rebindingConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rebindingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+
+	return nil
+}
+
+func (c *rebindingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.current.SetWriteDeadline(t)
+}
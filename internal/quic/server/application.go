@@ -2,23 +2,25 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"log/slog"
-	"math/big"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yvv4git/speed-test/internal/accesslog"
+	"github.com/yvv4git/speed-test/internal/admin"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/qlogs"
+	"github.com/yvv4git/speed-test/internal/quicconf"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/tlsconf"
 )
 
 type Application struct {
@@ -41,36 +43,86 @@ func (a *Application) Start(ctx context.Context) error {
 		return fmt.Errorf("parse config: %w", err)
 	}
 
-	a.logger.Info("Loaded configuration", "host", cfg.Host, "port", cfg.Port)
+	a.logger.Info("Loaded configuration", "host", cfg.Host, "port", cfg.Port, "mode", cfg.Mode)
 
-	tlsConfig, err := generateTLSConfig()
+	if _, err := admin.ParseMode(string(cfg.Mode)); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	authenticator, err := auth.NewAuthenticator(cfg.AuthMode, cfg.AuthKeys)
+	if err != nil {
+		return fmt.Errorf("create authenticator: %w", err)
+	}
+
+	// HTTP/3 requests carry a bearer token, there is no stream to run the HMAC challenge on
+	if cfg.HTTP3 && authenticator.Mode() == auth.ModeHMAC {
+		return fmt.Errorf("parse config: HTTP/3 supports only %q authentication", auth.ModeToken)
+	}
+
+	tlsConfig, err := a.loadTLSConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("load TLS config: %w", err)
+	}
+
+	quicConfig, err := cfg.Transport.QUICConfig()
+	if err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	a.logger.Info("QUIC transport parameters", "transport", cfg.Transport.Effective(0))
+
+	qlogWriter, err := qlogs.New(cfg.Qlog, a.logger)
 	if err != nil {
-		return fmt.Errorf("generate TLS config: %w", err)
+		return fmt.Errorf("open qlog directory: %w", err)
 	}
+	defer qlogWriter.Close()
 
-	quicConfig := &quic.Config{
-		HandshakeIdleTimeout:  30 * time.Second, // Увеличьте таймаут рукопожатия
-		MaxIdleTimeout:        60 * time.Second, // Увеличьте таймаут бездействия
-		MaxIncomingStreams:    100,              // Максимальное количество входящих потоков
-		MaxIncomingUniStreams: 100,              // Максимальное количество входящих однонаправленных потоков
-		KeepAlivePeriod:       10 * time.Second, // Период отправки keep-alive пакетов
-		EnableDatagrams:       true,             // Включить поддержку датаграмм
+	if qlogWriter != nil {
+		a.logger.Info("qlog tracing enabled", "dir", cfg.Qlog.Dir)
 	}
 
+	stats := quicstats.NewRegistry()
+	quicConfig.Tracer = quicconf.Tracers(stats.Tracer, qlogWriter.Tracer)
+
 	addr := net.JoinHostPort(cfg.Host, fmt.Sprintf("%d", cfg.Port))
-	listener, err := quic.ListenAddr(addr, tlsConfig, quicConfig)
+	// Connections are accepted before the handshake completes, so that 0-RTT data is served early;
+	// with authentication enabled credentials are only read once the handshake is complete
+	quicConfig.Allow0RTT = cfg.Allow0RTT
+	listener, err := quic.ListenAddrEarly(addr, tlsConfig, quicConfig)
 	if err != nil {
 		return fmt.Errorf("start QUIC listener: %w", err)
 	}
 
 	a.logger.Info("QUIC server started", "address", addr)
 
+	if cfg.HTTP3 {
+		a.logger.Info("HTTP/3 endpoints enabled", "address", addr, "endpoints", "/download, /upload, /ping")
+	}
+
 	srv := NewServer(Params{
 		Logger:   a.logger,
 		Cfg:      cfg,
+		Auth:     authenticator,
 		Listener: listener,
+		Stats:    stats,
+		Qlogs:    qlogWriter,
 	})
 
+	accessLog, err := accesslog.New(accesslog.Config{
+		Path:       cfg.AccessLogPath,
+		MaxSizeMB:  cfg.AccessLogMaxSizeMB,
+		MaxBackups: cfg.AccessLogMaxBackups,
+	})
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	defer accessLog.Close()
+
+	if accessLog != nil {
+		srv.Sessions().OnFinish(accessLog.SessionFinished)
+		a.logger.Info("Access log enabled", "path", cfg.AccessLogPath)
+	}
+
 	srv.SetHandler(func(data []byte, stream quic.Stream, remoteAddr string) []byte {
 		return data
 	})
@@ -86,7 +138,7 @@ func (a *Application) Start(ctx context.Context) error {
 	}()
 
 	go func() {
-		if err := startMetricsWebServer(cfg); err != nil {
+		if err := startMetricsWebServer(cfg, srv, a.logger); err != nil {
 			a.logger.Error("Failed to start metrics web server", "error", err)
 			cancel()
 		}
@@ -99,30 +151,34 @@ func (a *Application) Start(ctx context.Context) error {
 	return nil
 }
 
-func generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+func (a *Application) loadTLSConfig(cfg Config) (*tls.Config, error) {
+	cert, err := tlsconf.LoadServerCertificate(tlsconf.ServerParams{
+		CertFile: cfg.TLSCertFile,
+		KeyFile:  cfg.TLSKeyFile,
+		Generate: cfg.TLSGenerate,
+		Hosts:    cfg.TLSHosts,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+	if cfg.TLSCertFile == "" {
+		a.logger.Warn("Using an ephemeral self-signed certificate, clients can only pin it until restart")
 	}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	fingerprint, err := tlsconf.LeafFingerprint(cert)
 	if err != nil {
 		return nil, err
 	}
+	a.logger.Info("TLS certificate loaded", "cert_file", cfg.TLSCertFile, "spki_sha256", fingerprint)
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
+	nextProtos := []string{"quic-echo"}
+	if cfg.HTTP3 {
+		nextProtos = append(nextProtos, http3.NextProtoH3)
 	}
 
 	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"quic-echo"},
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   nextProtos,
 	}, nil
 }
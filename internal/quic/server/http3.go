@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/results"
+	"github.com/yvv4git/speed-test/internal/session"
+)
+
+// http3ChunkSize is the size of the writes of the download endpoint.
+const http3ChunkSize = 64 << 10
+
+// newHTTP3Server serves the HTTP/3 test endpoints:
+//
+//	GET  /download?bytes=N  responds with N random bytes
+//	POST /upload            discards the body and responds with the server's report
+//	GET  /ping              responds with an empty body, for request latency
+func (s *Server) newHTTP3Server() *http3.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /download", s.handleDownload)
+	mux.HandleFunc("POST /upload", s.handleUpload)
+	mux.HandleFunc("GET /ping", s.handlePing)
+
+	return &http3.Server{Handler: mux}
+}
+
+// handleHTTP3 serves a connection that negotiated HTTP/3. Every download and upload
+// request is a session of its own, authenticated by a bearer token.
+func (s *Server) handleHTTP3(conn quic.EarlyConnection) {
+	defer s.wg.Done()
+
+	s.logger.Info("New HTTP/3 connection", "remote_addr", conn.RemoteAddr().String())
+
+	// Requests carry bearer tokens, none is served from replayable 0-RTT data
+	if s.auth.Enabled() {
+		ctx, cancel := context.WithTimeout(s.ctx, s.cfg.AuthTimeout)
+		err := s.handshakeComplete(ctx, conn)
+		cancel()
+
+		if err != nil {
+			s.logger.Warn("HTTP/3 handshake not completed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			_ = conn.CloseWithError(errorCodeUnauthorized, "unauthorized")
+			return
+		}
+	}
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			_ = conn.CloseWithError(0, "server stopping")
+		case <-conn.Context().Done():
+		}
+	}()
+
+	if err := s.http3.ServeQUICConn(conn); err != nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.Remote {
+			return
+		}
+
+		s.logger.Debug("HTTP/3 connection closed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// authorizeHTTP3 returns the identity of the request, or false after answering 401.
+func (s *Server) authorizeHTTP3(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !s.auth.Enabled() {
+		return auth.Anonymous, true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	identity, ok := s.auth.VerifyToken(token)
+	if !found || !ok {
+		authAttempts.WithLabelValues("", "denied").Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	authAttempts.WithLabelValues(identity, "ok").Inc()
+	return identity, true
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseUint(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil {
+		http.Error(w, "bytes must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	identity, ok := s.authorizeHTTP3(w, r)
+	if !ok {
+		return
+	}
+
+	sess, ctx := s.sessions.Start(r.Context(), session.Params{
+		Protocol:   "http3",
+		RemoteAddr: r.RemoteAddr,
+		Identity:   identity,
+	})
+
+	chunk := make([]byte, http3ChunkSize)
+	if _, err = rand.Read(chunk); err != nil {
+		s.sessions.Finish(sess, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	w.Header().Set("X-Session-Id", sess.ID())
+
+	var reason error
+	for remaining := size; remaining > 0; {
+		if ctx.Err() != nil {
+			reason = context.Cause(ctx)
+			break
+		}
+
+		n, err := w.Write(chunk[:min(remaining, uint64(len(chunk)))])
+		bytesSent.WithLabelValues(identity).Add(float64(n))
+		sess.AddSent(n)
+		remaining -= uint64(n)
+		if err != nil {
+			reason = err
+			break
+		}
+	}
+
+	s.sessions.Finish(sess, reason)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorizeHTTP3(w, r)
+	if !ok {
+		return
+	}
+
+	sess, ctx := s.sessions.Start(r.Context(), session.Params{
+		Protocol:   "http3",
+		RemoteAddr: r.RemoteAddr,
+		Identity:   identity,
+	})
+
+	var (
+		received uint64
+		reason   error
+		buf      = make([]byte, http3ChunkSize)
+	)
+	for ctx.Err() == nil {
+		n, err := r.Body.Read(buf)
+		bytesReceived.WithLabelValues(identity).Add(float64(n))
+		sess.AddReceived(n)
+		received += uint64(n)
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			reason = err
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		reason = context.Cause(ctx)
+	}
+
+	if reason == nil {
+		report := results.NewReport(sess)
+		report.BytesReceived = received
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			reason = err
+		}
+	}
+
+	s.sessions.Finish(sess, reason)
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorizeHTTP3(w, r); !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,26 +1,158 @@
 package server
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yvv4git/speed-test/internal/admin"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/session"
 )
 
 var (
-	bytesReceived = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "tcp_server_bytes_received_total",
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_bytes_received_total",
 		Help: "Total number of bytes received from clients.",
-	})
+	}, []string{"identity"})
 
-	bytesSent = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "tcp_server_bytes_sent_total",
+	bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_bytes_sent_total",
 		Help: "Total number of bytes sent to clients.",
+	}, []string{"identity"})
+
+	datagramsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_datagrams_received_total",
+		Help: "Total number of datagrams received from clients.",
+	}, []string{"identity"})
+
+	datagramsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_datagrams_sent_total",
+		Help: "Total number of datagrams reflected to clients.",
+	}, []string{"identity"})
+
+	packetsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_packets_sent_total",
+		Help: "Total number of QUIC packets sent.",
+	}, []string{"identity"})
+
+	packetsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_packets_received_total",
+		Help: "Total number of QUIC packets received.",
+	}, []string{"identity"})
+
+	packetsLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_packets_lost_total",
+		Help: "Total number of QUIC packets declared lost.",
+	}, []string{"identity"})
+
+	packetsRetransmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_packets_retransmitted_total",
+		Help: "Total number of lost QUIC packets whose frames were retransmitted.",
+	}, []string{"identity"})
+
+	handshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "quic_server_handshake_duration_seconds",
+		Help:    "Duration of QUIC handshakes until confirmation.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
 	})
+
+	smoothedRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quic_server_smoothed_rtt_seconds",
+		Help: "Smoothed round-trip time of active QUIC connections.",
+	}, []string{"session_id", "identity"})
+
+	minRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quic_server_min_rtt_seconds",
+		Help: "Minimum round-trip time of active QUIC connections.",
+	}, []string{"session_id", "identity"})
+
+	latestRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quic_server_latest_rtt_seconds",
+		Help: "Latest round-trip time sample of active QUIC connections.",
+	}, []string{"session_id", "identity"})
+
+	congestionWindow = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quic_server_congestion_window_bytes",
+		Help: "Congestion window of active QUIC connections.",
+	}, []string{"session_id", "identity"})
+
+	bytesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quic_server_bytes_in_flight",
+		Help: "Unacknowledged bytes in flight of active QUIC connections.",
+	}, []string{"session_id", "identity"})
+
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quic_server_auth_attempts_total",
+		Help: "Total number of client authentication attempts.",
+	}, []string{"identity", "result"})
 )
 
-func startMetricsWebServer(cfg Config) error {
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(cfg.MetricsAddr, nil)
+func startMetricsWebServer(cfg Config, srv *Server, logger *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	if cfg.AdminToken != "" {
+		admin.Register(mux, admin.Params{
+			Token:    cfg.AdminToken,
+			Sessions: srv.Sessions(),
+			Modes:    srv,
+			Logger:   logger,
+		})
+	}
+
+	return http.ListenAndServe(cfg.MetricsAddr, mux)
+}
+
+// exportStats publishes the transport statistics of a connection once per sample
+// interval until ctx is done. The per-connection gauges are removed afterwards.
+func exportStats(ctx context.Context, interval time.Duration, sess *session.Session, collector *quicstats.Collector) {
+	labels := prometheus.Labels{"session_id": sess.ID(), "identity": sess.Identity()}
+	defer func() {
+		for _, gauge := range []*prometheus.GaugeVec{smoothedRTT, minRTT, latestRTT, congestionWindow, bytesInFlight} {
+			gauge.Delete(labels)
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last quicstats.Stats
+	publish := func() {
+		stats := collector.Stats()
+
+		if last.HandshakeMs == 0 && stats.HandshakeMs > 0 {
+			handshakeDuration.Observe(stats.HandshakeMs / 1000)
+		}
+
+		identity := sess.Identity()
+		packetsSent.WithLabelValues(identity).Add(float64(stats.PacketsSent - last.PacketsSent))
+		packetsReceived.WithLabelValues(identity).Add(float64(stats.PacketsReceived - last.PacketsReceived))
+		packetsLost.WithLabelValues(identity).Add(float64(stats.PacketsLost - last.PacketsLost))
+		packetsRetransmitted.WithLabelValues(identity).Add(float64(stats.PacketsRetransmitted - last.PacketsRetransmitted))
+
+		smoothedRTT.With(labels).Set(stats.SmoothedRTTMs / 1000)
+		minRTT.With(labels).Set(stats.MinRTTMs / 1000)
+		latestRTT.With(labels).Set(stats.LatestRTTMs / 1000)
+		congestionWindow.With(labels).Set(float64(stats.CongestionWindow))
+		bytesInFlight.With(labels).Set(float64(stats.BytesInFlight))
+
+		last = stats
+	}
+
+	publish()
+	for {
+		select {
+		case <-ctx.Done():
+			// Count what happened since the last tick
+			publish()
+			return
+		case <-ticker.C:
+			publish()
+		}
+	}
 }
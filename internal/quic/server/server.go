@@ -2,22 +2,50 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yvv4git/speed-test/internal/admin"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/qlogs"
+	"github.com/yvv4git/speed-test/internal/quicconf"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/results"
+	"github.com/yvv4git/speed-test/internal/session"
+)
+
+// Application error codes used to close sessions.
+const (
+	errorCodeUnauthorized quic.ApplicationErrorCode = 0x101
+	errorCodeKilled       quic.ApplicationErrorCode = 0x102
 )
 
 type HandlerFunc func(data []byte, stream quic.Stream, remoteAddr string) []byte
 
 type Server struct {
 	cfg      Config
-	listener *quic.Listener
+	listener *quic.EarlyListener
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 	logger   *slog.Logger
 	handler  HandlerFunc
+	auth     *auth.Authenticator
+	sessions *session.Registry
+	modes    *admin.ModeSwitch
+	stats    *quicstats.Registry
+	qlogs    *qlogs.Writer
+	// http3 serves connections that negotiate HTTP/3, nil when HTTP/3 is disabled
+	http3 *http3.Server
 }
 
 type Config struct {
@@ -25,31 +53,84 @@ type Config struct {
 	Port        uint16 `env:"QUIC_SERVER_PORT" envDefault:"1543"`
 	BufSize     uint16 `env:"QUIC_SERVER_BUF_SIZE" envDefault:"1024"`
 	MetricsAddr string `env:"QUIC_SERVER_METRICS_ADDR" envDefault:"0.0.0.0:8080"`
+
+	AuthMode    auth.Mode         `env:"QUIC_SERVER_AUTH_MODE" envDefault:"none"`
+	AuthKeys    map[string]string `env:"QUIC_SERVER_AUTH_KEYS" envSeparator:"," envKeyValSeparator:":"`
+	AuthTimeout time.Duration     `env:"QUIC_SERVER_AUTH_TIMEOUT" envDefault:"10s"`
+
+	Mode           admin.Mode    `env:"QUIC_SERVER_MODE" envDefault:"echo"`
+	AdminToken     string        `env:"QUIC_SERVER_ADMIN_TOKEN"`
+	SampleInterval time.Duration `env:"QUIC_SERVER_SAMPLE_INTERVAL" envDefault:"1s"`
+	Results        bool          `env:"QUIC_SERVER_RESULTS" envDefault:"true"`
+
+	TLSCertFile string   `env:"QUIC_SERVER_TLS_CERT"`
+	TLSKeyFile  string   `env:"QUIC_SERVER_TLS_KEY"`
+	TLSGenerate bool     `env:"QUIC_SERVER_TLS_GENERATE" envDefault:"true"`
+	TLSHosts    []string `env:"QUIC_SERVER_TLS_HOSTS" envSeparator:"," envDefault:"localhost,127.0.0.1"`
+
+	AccessLogPath       string `env:"QUIC_SERVER_ACCESS_LOG"`
+	AccessLogMaxSizeMB  int    `env:"QUIC_SERVER_ACCESS_LOG_MAX_SIZE_MB" envDefault:"100"`
+	AccessLogMaxBackups int    `env:"QUIC_SERVER_ACCESS_LOG_MAX_BACKUPS" envDefault:"5"`
+
+	Allow0RTT bool            `env:"QUIC_SERVER_ALLOW_0RTT" envDefault:"false"`
+	HTTP3     bool            `env:"QUIC_SERVER_HTTP3" envDefault:"false"`
+	Transport quicconf.Config `envPrefix:"QUIC_SERVER_"`
+	Qlog      qlogs.Config    `envPrefix:"QUIC_SERVER_QLOG_"`
 }
 
 type Params struct {
 	Cfg      Config
 	Logger   *slog.Logger
-	Listener *quic.Listener
+	Auth     *auth.Authenticator
+	Listener *quic.EarlyListener
+	// Stats must be the tracer registry of the listener's quic.Config, nil disables statistics
+	Stats *quicstats.Registry
+	// Qlogs must be the qlog writer of the listener's quic.Config, it may be nil
+	Qlogs *qlogs.Writer
 }
 
 func NewServer(params Params) *Server {
-	return &Server{
+	s := &Server{
 		cfg:      params.Cfg,
 		logger:   params.Logger,
+		auth:     params.Auth,
 		listener: params.Listener,
+		sessions: session.NewRegistry(),
+		modes:    admin.NewModeSwitch(params.Cfg.Mode),
+		stats:    params.Stats,
+		qlogs:    params.Qlogs,
+	}
+
+	if params.Cfg.HTTP3 {
+		s.http3 = s.newHTTP3Server()
 	}
+
+	return s
 }
 
 func (s *Server) SetHandler(handler HandlerFunc) {
 	s.handler = handler
 }
 
+func (s *Server) Sessions() *session.Registry {
+	return s.sessions
+}
+
+func (s *Server) Mode() admin.Mode {
+	return s.modes.Mode()
+}
+
+func (s *Server) SetMode(mode admin.Mode) {
+	s.modes.SetMode(mode)
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
 
 	s.logger.Info("QUIC server started", "address", s.listener.Addr())
 
+	go s.sessions.Run(s.ctx, s.cfg.SampleInterval)
+
 	return s.acceptConnections() // Blocking mode
 }
 
@@ -68,63 +149,336 @@ func (s *Server) acceptConnections() error {
 		}
 
 		s.wg.Add(1)
+		if s.http3 != nil && session.ConnectionState().TLS.NegotiatedProtocol == http3.NextProtoH3 {
+			go s.handleHTTP3(session)
+			continue
+		}
+
 		go s.handleSession(session)
 	}
 }
 
-func (s *Server) handleSession(session quic.Connection) {
+func (s *Server) handleSession(conn quic.EarlyConnection) {
 	defer s.wg.Done()
 
-	remoteAddr := session.RemoteAddr().String()
+	remoteAddr := conn.RemoteAddr().String()
 	s.logger.Info("New QUIC session", "remote_addr", remoteAddr)
 
+	identity, err := s.authenticate(conn)
+	if err != nil {
+		s.logger.Warn("Client authentication failed", "remote_addr", remoteAddr, "error", err)
+		_ = conn.CloseWithError(errorCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	sess, ctx := s.sessions.Start(s.ctx, session.Params{
+		Protocol:   "quic",
+		RemoteAddr: remoteAddr,
+		Identity:   identity,
+	})
+	s.qlogs.Name(conn, sess.ID())
+
+	reason := s.serve(ctx, conn, sess, remoteAddr)
+	s.sessions.Finish(sess, reason)
+}
+
+// serve accepts streams until the connection is closed or ctx is done. The returned
+// error is the termination reason, nil when the client closed the connection cleanly.
+func (s *Server) serve(ctx context.Context, conn quic.Connection, sess *session.Session, remoteAddr string) error {
+	go func() {
+		<-ctx.Done()
+		if errors.Is(context.Cause(ctx), session.ErrKilled) {
+			_ = conn.CloseWithError(errorCodeKilled, "session killed")
+		}
+	}()
+
+	state := &connState{
+		transport: s.cfg.Transport.Effective(conn.ConnectionState().Version),
+		datagrams: probe.NewReceiver(),
+		collector: s.stats.Lookup(conn),
+	}
+
+	if state.collector != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			exportStats(ctx, s.cfg.SampleInterval, sess, state.collector)
+		}()
+	}
+
+	if conn.ConnectionState().SupportsDatagrams {
+		s.wg.Add(1)
+		go s.serveDatagrams(ctx, conn, sess, state.datagrams)
+	}
+
+	// Stream handlers still count bytes after the connection is gone, wait for them
+	var streams sync.WaitGroup
+	defer streams.Wait()
+
 	for {
 		// Accepting a new thread within the session
-		stream, err := session.AcceptStream(s.ctx)
+		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				s.logger.Info("Session handling stopped", "session_id", sess.ID(), "reason", context.Cause(ctx))
+				return context.Cause(ctx)
+			}
+
+			var appErr *quic.ApplicationError
+			if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+				s.logger.Info("Session closed by client", "session_id", sess.ID())
+				return nil
+			}
+
 			s.logger.Error("Failed to accept QUIC stream", "error", err)
-			return
+			return err
 		}
 
 		s.wg.Add(1)
-		go s.handleStream(stream, remoteAddr)
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			s.handleStream(ctx, stream, sess, remoteAddr, state)
+		}()
 	}
 }
 
-func (s *Server) handleStream(stream quic.Stream, remoteAddr string) {
+// connState is shared by the streams of a connection.
+type connState struct {
+	transport *quicconf.Params
+	datagrams *probe.Receiver
+	collector *quicstats.Collector
+}
+
+func (s *Server) handleStream(ctx context.Context, stream quic.Stream, sess *session.Session, remoteAddr string, state *connState) {
 	defer s.wg.Done()
 	defer stream.Close()
 
+	// Per-stream counters for the results report; the session counts all streams
+	var counters streamCounters
+
+	sourceCtx, stopSource := context.WithCancel(ctx)
+	sourceDone := make(chan struct{})
+	defer stopSource()
+
+	s.wg.Add(1)
+	go func() {
+		defer close(sourceDone)
+		s.runSource(sourceCtx, stream, sess, &counters)
+	}()
+
 	buf := make([]byte, s.cfg.BufSize)
 
 	for {
 		select {
-		case <-s.ctx.Done():
-			s.logger.Info("Stream handling stopped due to server shutdown")
+		case <-ctx.Done():
+			s.logger.Info("Stream handling stopped", "session_id", sess.ID(), "reason", context.Cause(ctx))
 			return
 		default:
+			// A QUIC stream may return the last chunk together with io.EOF
 			n, err := stream.Read(buf)
+			if n > 0 {
+				bytesReceived.WithLabelValues(sess.Identity()).Add(float64(n)) // Increment bytes received counter
+				sess.AddReceived(n)
+				counters.received.Add(uint64(n))
+
+				if s.handler != nil && s.modes.Mode() == admin.ModeEcho {
+					response := s.handler(buf[:n], stream, remoteAddr)
+
+					written, errWrite := stream.Write(response)
+					if errWrite != nil {
+						s.logger.Error("Failed to send response to QUIC stream", "error", errWrite)
+						return
+					}
+
+					bytesSent.WithLabelValues(sess.Identity()).Add(float64(written)) // Increment bytes sent counter
+					sess.AddSent(written)
+					counters.sent.Add(uint64(written))
+				}
+			}
+
 			if err != nil {
+				if ctx.Err() != nil {
+					continue // The session was stopped, report it above
+				}
+
+				if errors.Is(err, io.EOF) {
+					// The client finished sending: stop streaming and report the server's view
+					stopSource()
+					<-sourceDone
+					s.sendResults(stream, sess, &counters, state)
+					return
+				}
+
 				s.logger.Error("Error reading from QUIC stream", "error", err)
 				return
 			}
+		}
+	}
+}
 
-			bytesReceived.Add(float64(n)) // Increment bytes received counter
+type streamCounters struct {
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
 
-			if s.handler != nil {
-				response := s.handler(buf[:n], stream, remoteAddr)
+// sendResults reports the stream's byte counters together with the session samples,
+// the transport parameters the server runs with and the datagrams received so far.
+func (s *Server) sendResults(stream quic.Stream, sess *session.Session, counters *streamCounters, state *connState) {
+	if !s.cfg.Results {
+		return
+	}
 
-				if _, err = stream.Write(response); err != nil {
-					s.logger.Error("Failed to send response to QUIC stream", "error", err)
-					return
-				}
+	report := results.NewReport(sess)
+	report.BytesReceived = counters.received.Load()
+	report.BytesSent = counters.sent.Load()
+	report.QUIC = state.transport
+
+	if stats := state.datagrams.Stats(0); stats.Received > 0 {
+		report.Datagrams = &stats
+	}
+
+	if state.collector != nil {
+		stats := state.collector.Stats()
+		report.QUICStats = &stats
+	}
+
+	if err := results.WriteTrailer(stream, report); err != nil {
+		s.logger.Error("Failed to send results to client", "session_id", sess.ID(), "error", err)
+		return
+	}
+
+	s.logger.Info("Results sent to client", "session_id", sess.ID(), "stream_id", stream.StreamID(),
+		"bytes_received", report.BytesReceived, "bytes_sent", report.BytesSent)
+}
+
+// serveDatagrams counts the probe datagrams of a connection. In echo mode every
+// datagram is sent back with the server's receive time stamped into it.
+func (s *Server) serveDatagrams(ctx context.Context, conn quic.Connection, sess *session.Session, receiver *probe.Receiver) {
+	defer s.wg.Done()
+
+	for {
+		data, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+
+		now := time.Now()
+		datagramsReceived.WithLabelValues(sess.Identity()).Inc()
+		bytesReceived.WithLabelValues(sess.Identity()).Add(float64(len(data)))
+		sess.AddReceived(len(data))
+
+		packet, err := probe.Unmarshal(data)
+		if err != nil {
+			continue
+		}
+		receiver.Add(packet.Seq, len(data), now.Sub(time.Unix(0, packet.SentAt)))
+
+		if s.modes.Mode() != admin.ModeEcho {
+			continue
+		}
+
+		probe.Reflect(data, now)
+		if err = conn.SendDatagram(data); err != nil {
+			s.logger.Debug("Failed to reflect datagram", "session_id", sess.ID(), "error", err)
+			continue
+		}
+
+		datagramsSent.WithLabelValues(sess.Identity()).Inc()
+		bytesSent.WithLabelValues(sess.Identity()).Add(float64(len(data)))
+		sess.AddSent(len(data))
+	}
+}
+
+// runSource streams data to the client while the server is in source mode.
+func (s *Server) runSource(ctx context.Context, stream quic.Stream, sess *session.Session, counters *streamCounters) {
+	defer s.wg.Done()
+
+	buf := make([]byte, s.cfg.BufSize)
+	if _, err := rand.Read(buf); err != nil {
+		s.logger.Error("Failed to generate random bytes", "error", err)
+		return
+	}
 
-				bytesSent.Add(float64(n)) // Increment bytes sent counter
+	for {
+		changed := s.modes.Changed()
+		if s.modes.Mode() != admin.ModeSource {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stream.Context().Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			n, err := stream.Write(buf)
+			if err != nil {
+				return // The reader reports stream errors
 			}
+
+			bytesSent.WithLabelValues(sess.Identity()).Add(float64(n)) // Increment bytes sent counter
+			sess.AddSent(n)
+			counters.sent.Add(uint64(n))
 		}
 	}
 }
 
+// authenticate runs the handshake on the first stream of the session. The stream
+// is used only for authentication and is closed afterwards.
+func (s *Server) authenticate(conn quic.EarlyConnection) (string, error) {
+	if !s.auth.Enabled() {
+		return auth.Anonymous, nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.AuthTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	if err = s.handshakeComplete(ctx, conn); err != nil {
+		return "", err
+	}
+
+	if err = stream.SetDeadline(time.Now().Add(s.cfg.AuthTimeout)); err != nil {
+		return "", err
+	}
+
+	identity, err := s.auth.Authenticate(stream)
+	if err != nil {
+		authAttempts.WithLabelValues("", "denied").Inc()
+		return "", err
+	}
+
+	authAttempts.WithLabelValues(identity, "ok").Inc()
+	s.logger.Info("Client authenticated", "remote_addr", conn.RemoteAddr().String(), "identity", identity)
+
+	return identity, nil
+}
+
+// handshakeComplete waits for the handshake of conn to complete. Credentials sent as
+// 0-RTT data could be replayed by anyone who captured them, they are only trusted once
+// the client proved it holds the handshake keys.
+func (s *Server) handshakeComplete(ctx context.Context, conn quic.EarlyConnection) error {
+	select {
+	case <-conn.HandshakeComplete():
+		return nil
+	case <-conn.Context().Done():
+		return context.Cause(conn.Context())
+	case <-ctx.Done():
+		return fmt.Errorf("wait for handshake: %w", ctx.Err())
+	}
+}
+
 func (s *Server) Stop() {
 	if s.cancel != nil {
 		s.cancel()
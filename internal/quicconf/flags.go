@@ -0,0 +1,59 @@
+package quicconf
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// flagSpecs maps command line flags to the env variables (without prefix) of Config.
+var flagSpecs = []struct {
+	name string
+	env  string
+	help string
+}{
+	{"quic-handshake-timeout", "HANDSHAKE_TIMEOUT", "QUIC handshake idle timeout (e.g. 30s)."},
+	{"quic-idle-timeout", "IDLE_TIMEOUT", "QUIC idle timeout (e.g. 60s)."},
+	{"quic-keep-alive", "KEEP_ALIVE", "QUIC keep-alive period, 0 disables keep-alives."},
+	{"quic-max-streams", "MAX_STREAMS", "Maximum number of incoming bidirectional streams."},
+	{"quic-max-uni-streams", "MAX_UNI_STREAMS", "Maximum number of incoming unidirectional streams."},
+	{"quic-initial-stream-window", "INITIAL_STREAM_WINDOW", "Initial stream receive window in bytes."},
+	{"quic-max-stream-window", "MAX_STREAM_WINDOW", "Maximum stream receive window in bytes."},
+	{"quic-initial-conn-window", "INITIAL_CONN_WINDOW", "Initial connection receive window in bytes."},
+	{"quic-max-conn-window", "MAX_CONN_WINDOW", "Maximum connection receive window in bytes."},
+	{"quic-disable-pmtud", "DISABLE_PMTUD", "Disable path MTU discovery (true or false)."},
+	{"quic-initial-packet-size", "INITIAL_PACKET_SIZE", "Initial packet size in bytes, used until path MTU discovery raises it."},
+	{"quic-versions", "VERSIONS", "Comma separated list of allowed QUIC versions (v1, v2)."},
+}
+
+// Flags holds the transport flags registered on a kingpin application.
+type Flags struct {
+	values map[string]*string
+}
+
+// RegisterFlags adds a flag for every transport parameter to app.
+func RegisterFlags(app *kingpin.Application) *Flags {
+	f := &Flags{values: make(map[string]*string, len(flagSpecs))}
+	for _, spec := range flagSpecs {
+		f.values[spec.env] = app.Flag(spec.name, spec.help).PlaceHolder("VALUE").String()
+	}
+
+	return f
+}
+
+// Apply exports the flags that were set as env variables with the given prefix,
+// so they take precedence over the environment and the .env file.
+func (f *Flags) Apply(prefix string) error {
+	for name, value := range f.values {
+		if *value == "" {
+			continue
+		}
+
+		if err := os.Setenv(prefix+name, *value); err != nil {
+			return fmt.Errorf("set %s%s: %w", prefix, name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package quicconf
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Config holds the QUIC transport parameters shared by the client and the server.
+// It is embedded into their configs with an env prefix, e.g. QUIC_SERVER_MAX_STREAM_WINDOW.
+// The window defaults are the quic-go defaults, spelled out so that results show real values.
+type Config struct {
+	HandshakeIdleTimeout time.Duration `env:"HANDSHAKE_TIMEOUT" envDefault:"30s"`
+	MaxIdleTimeout       time.Duration `env:"IDLE_TIMEOUT" envDefault:"60s"`
+	KeepAlivePeriod      time.Duration `env:"KEEP_ALIVE" envDefault:"10s"`
+
+	MaxIncomingStreams    int64 `env:"MAX_STREAMS" envDefault:"100"`
+	MaxIncomingUniStreams int64 `env:"MAX_UNI_STREAMS" envDefault:"100"`
+
+	InitialStreamReceiveWindow     uint64 `env:"INITIAL_STREAM_WINDOW" envDefault:"524288"`
+	MaxStreamReceiveWindow         uint64 `env:"MAX_STREAM_WINDOW" envDefault:"6291456"`
+	InitialConnectionReceiveWindow uint64 `env:"INITIAL_CONN_WINDOW" envDefault:"786432"`
+	MaxConnectionReceiveWindow     uint64 `env:"MAX_CONN_WINDOW" envDefault:"15728640"`
+
+	DisablePathMTUDiscovery bool     `env:"DISABLE_PMTUD" envDefault:"false"`
+	InitialPacketSize       uint16   `env:"INITIAL_PACKET_SIZE" envDefault:"1280"`
+	Versions                []string `env:"VERSIONS" envSeparator:"," envDefault:"v1,v2"`
+}
+
+// QUICConfig converts the parameters to a quic.Config. Datagrams are always enabled.
+func (c Config) QUICConfig() (*quic.Config, error) {
+	versions, err := ParseVersions(c.Versions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quic.Config{
+		Versions:                       versions,
+		HandshakeIdleTimeout:           c.HandshakeIdleTimeout,
+		MaxIdleTimeout:                 c.MaxIdleTimeout,
+		KeepAlivePeriod:                c.KeepAlivePeriod,
+		MaxIncomingStreams:             c.MaxIncomingStreams,
+		MaxIncomingUniStreams:          c.MaxIncomingUniStreams,
+		InitialStreamReceiveWindow:     c.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         c.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: c.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     c.MaxConnectionReceiveWindow,
+		DisablePathMTUDiscovery:        c.DisablePathMTUDiscovery,
+		InitialPacketSize:              c.InitialPacketSize,
+		EnableDatagrams:                true,
+	}, nil
+}
+
+// ParseVersions accepts "v1" and "v2" (or "1" and "2") as well as raw hex version numbers like "0x6b3343cf".
+func ParseVersions(values []string) ([]quic.Version, error) {
+	versions := make([]quic.Version, 0, len(values))
+	for _, value := range values {
+		switch v := strings.ToLower(strings.TrimSpace(value)); v {
+		case "":
+			continue
+		case "v1", "1":
+			versions = append(versions, quic.Version1)
+		case "v2", "2":
+			versions = append(versions, quic.Version2)
+		default:
+			var number uint32
+			if _, err := fmt.Sscanf(v, "0x%x", &number); err != nil {
+				return nil, fmt.Errorf("unknown QUIC version %q", value)
+			}
+			versions = append(versions, quic.Version(number))
+		}
+	}
+
+	return versions, nil
+}
+
+// Params are the effective transport parameters of a connection, as reported in results.
+type Params struct {
+	Version                        string  `json:"version,omitempty"`
+	HandshakeIdleTimeoutSeconds    float64 `json:"handshake_idle_timeout_seconds"`
+	MaxIdleTimeoutSeconds          float64 `json:"max_idle_timeout_seconds"`
+	KeepAlivePeriodSeconds         float64 `json:"keep_alive_period_seconds"`
+	MaxIncomingStreams             int64   `json:"max_incoming_streams"`
+	MaxIncomingUniStreams          int64   `json:"max_incoming_uni_streams"`
+	InitialStreamReceiveWindow     uint64  `json:"initial_stream_receive_window"`
+	MaxStreamReceiveWindow         uint64  `json:"max_stream_receive_window"`
+	InitialConnectionReceiveWindow uint64  `json:"initial_connection_receive_window"`
+	MaxConnectionReceiveWindow     uint64  `json:"max_connection_receive_window"`
+	DisablePathMTUDiscovery        bool    `json:"disable_path_mtu_discovery"`
+	InitialPacketSize              uint16  `json:"initial_packet_size"`
+	Versions                       string  `json:"versions"`
+}
+
+// Effective returns the parameters of a connection that negotiated version.
+// A zero version describes the configuration before any connection exists.
+func (c Config) Effective(version quic.Version) *Params {
+	params := &Params{
+		HandshakeIdleTimeoutSeconds:    c.HandshakeIdleTimeout.Seconds(),
+		MaxIdleTimeoutSeconds:          c.MaxIdleTimeout.Seconds(),
+		KeepAlivePeriodSeconds:         c.KeepAlivePeriod.Seconds(),
+		MaxIncomingStreams:             c.MaxIncomingStreams,
+		MaxIncomingUniStreams:          c.MaxIncomingUniStreams,
+		InitialStreamReceiveWindow:     c.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         c.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: c.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     c.MaxConnectionReceiveWindow,
+		DisablePathMTUDiscovery:        c.DisablePathMTUDiscovery,
+		InitialPacketSize:              c.InitialPacketSize,
+		Versions:                       strings.Join(c.Versions, ","),
+	}
+
+	if version != 0 {
+		params.Version = version.String()
+	}
+
+	return params
+}
+
+// LogValue groups the parameters under a single log attribute.
+func (p *Params) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("versions", p.Versions),
+		slog.Float64("handshake_idle_timeout_s", p.HandshakeIdleTimeoutSeconds),
+		slog.Float64("max_idle_timeout_s", p.MaxIdleTimeoutSeconds),
+		slog.Float64("keep_alive_s", p.KeepAlivePeriodSeconds),
+		slog.Int64("max_streams", p.MaxIncomingStreams),
+		slog.Int64("max_uni_streams", p.MaxIncomingUniStreams),
+		slog.Uint64("initial_stream_window", p.InitialStreamReceiveWindow),
+		slog.Uint64("max_stream_window", p.MaxStreamReceiveWindow),
+		slog.Uint64("initial_conn_window", p.InitialConnectionReceiveWindow),
+		slog.Uint64("max_conn_window", p.MaxConnectionReceiveWindow),
+		slog.Bool("disable_pmtud", p.DisablePathMTUDiscovery),
+		slog.Uint64("initial_packet_size", uint64(p.InitialPacketSize)),
+	}
+
+	if p.Version != "" {
+		attrs = append(attrs, slog.String("version", p.Version))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// TracerFunc has the signature of quic.Config.Tracer.
+type TracerFunc func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer
+
+// Tracers combines several tracer constructors into one, skipping those that return nil.
+func Tracers(fns ...TracerFunc) TracerFunc {
+	return func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+		tracers := make([]*logging.ConnectionTracer, 0, len(fns))
+		for _, fn := range fns {
+			if tracer := fn(ctx, p, connID); tracer != nil {
+				tracers = append(tracers, tracer)
+			}
+		}
+
+		return logging.NewMultiplexedConnectionTracer(tracers...)
+	}
+}
@@ -0,0 +1,264 @@
+package quicstats
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Stats is a snapshot of the transport state of one QUIC connection.
+type Stats struct {
+	HandshakeMs      float64 `json:"handshake_ms"`
+	SmoothedRTTMs    float64 `json:"smoothed_rtt_ms"`
+	MinRTTMs         float64 `json:"min_rtt_ms"`
+	LatestRTTMs      float64 `json:"latest_rtt_ms"`
+	RTTVarianceMs    float64 `json:"rtt_variance_ms"`
+	CongestionWindow uint64  `json:"congestion_window"`
+	BytesInFlight    uint64  `json:"bytes_in_flight"`
+	PacketsInFlight  int     `json:"packets_in_flight"`
+	MTU              uint64  `json:"mtu"`
+
+	PacketsSent     uint64 `json:"packets_sent"`
+	PacketsReceived uint64 `json:"packets_received"`
+	BytesSent       uint64 `json:"bytes_sent"`
+	BytesReceived   uint64 `json:"bytes_received"`
+	PacketsLost     uint64 `json:"packets_lost"`
+	// PacketsRetransmitted counts lost packets whose frames quic-go had to send again;
+	// lost packets carrying only ACKs are not retransmitted.
+	PacketsRetransmitted uint64 `json:"packets_retransmitted"`
+	PacketsDropped       uint64 `json:"packets_dropped"`
+	MaxPTOCount          uint32 `json:"max_pto_count"`
+}
+
+// LogValue groups the statistics under a single log attribute.
+func (s Stats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Float64("handshake_ms", s.HandshakeMs),
+		slog.Float64("smoothed_rtt_ms", s.SmoothedRTTMs),
+		slog.Float64("min_rtt_ms", s.MinRTTMs),
+		slog.Float64("latest_rtt_ms", s.LatestRTTMs),
+		slog.Float64("rtt_variance_ms", s.RTTVarianceMs),
+		slog.Uint64("cwnd", s.CongestionWindow),
+		slog.Uint64("bytes_in_flight", s.BytesInFlight),
+		slog.Uint64("mtu", s.MTU),
+		slog.Uint64("packets_sent", s.PacketsSent),
+		slog.Uint64("packets_received", s.PacketsReceived),
+		slog.Uint64("packets_lost", s.PacketsLost),
+		slog.Uint64("packets_retransmitted", s.PacketsRetransmitted),
+		slog.Uint64("packets_dropped", s.PacketsDropped),
+		slog.Uint64("max_pto_count", uint64(s.MaxPTOCount)),
+	)
+}
+
+type packetKey struct {
+	level  logging.EncryptionLevel
+	number logging.PacketNumber
+}
+
+// Collector gathers the Stats of a single connection from quic-go's tracer callbacks.
+// The callbacks run on the connection's goroutine, Stats may be called from any other.
+type Collector struct {
+	mu      sync.Mutex
+	started time.Time
+	stats   Stats
+	// ackEliciting holds the in-flight packets that carried retransmittable frames
+	ackEliciting map[packetKey]struct{}
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		started:      time.Now(),
+		ackEliciting: make(map[packetKey]struct{}),
+	}
+}
+
+// Stats returns a snapshot of the connection statistics.
+func (c *Collector) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// Tracer returns the quic-go tracer feeding the collector.
+func (c *Collector) Tracer() *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(hdr *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			c.sent(packetKey{level: encryptionLevel(logging.PacketTypeFromHeader(&hdr.Header)), number: hdr.PacketNumber}, size, frames)
+		},
+		SentShortHeaderPacket: func(hdr *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			c.sent(packetKey{level: logging.Encryption1RTT, number: hdr.PacketNumber}, size, frames)
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			c.received(size)
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			c.received(size)
+		},
+		DroppedPacket: func(logging.PacketType, logging.PacketNumber, logging.ByteCount, logging.PacketDropReason) {
+			c.mu.Lock()
+			c.stats.PacketsDropped++
+			c.mu.Unlock()
+		},
+		AcknowledgedPacket: func(level logging.EncryptionLevel, number logging.PacketNumber) {
+			c.mu.Lock()
+			delete(c.ackEliciting, packetKey{level: level, number: number})
+			c.mu.Unlock()
+		},
+		LostPacket: func(level logging.EncryptionLevel, number logging.PacketNumber, _ logging.PacketLossReason) {
+			c.lost(packetKey{level: level, number: number})
+		},
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.stats.SmoothedRTTMs = milliseconds(rtt.SmoothedRTT())
+			c.stats.MinRTTMs = milliseconds(rtt.MinRTT())
+			c.stats.LatestRTTMs = milliseconds(rtt.LatestRTT())
+			c.stats.RTTVarianceMs = milliseconds(rtt.MeanDeviation())
+			c.stats.CongestionWindow = uint64(cwnd)
+			c.stats.BytesInFlight = uint64(bytesInFlight)
+			c.stats.PacketsInFlight = packetsInFlight
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, _ bool) {
+			c.mu.Lock()
+			c.stats.MTU = uint64(mtu)
+			c.mu.Unlock()
+		},
+		UpdatedPTOCount: func(value uint32) {
+			c.mu.Lock()
+			c.stats.MaxPTOCount = max(c.stats.MaxPTOCount, value)
+			c.mu.Unlock()
+		},
+		DroppedEncryptionLevel: c.droppedLevel,
+	}
+}
+
+func (c *Collector) sent(key packetKey, size logging.ByteCount, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.PacketsSent++
+	c.stats.BytesSent += uint64(size)
+
+	for _, frame := range frames {
+		switch frame.(type) {
+		case *logging.AckFrame, *logging.ConnectionCloseFrame:
+		default:
+			c.ackEliciting[key] = struct{}{}
+			return
+		}
+	}
+}
+
+func (c *Collector) received(size logging.ByteCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.PacketsReceived++
+	c.stats.BytesReceived += uint64(size)
+}
+
+func (c *Collector) lost(key packetKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.PacketsLost++
+	if _, ok := c.ackEliciting[key]; ok {
+		c.stats.PacketsRetransmitted++
+	}
+	delete(c.ackEliciting, key)
+}
+
+// droppedLevel forgets the in-flight packets of a discarded packet number space, they
+// are neither acknowledged nor declared lost any more.
+func (c *Collector) droppedLevel(level logging.EncryptionLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.ackEliciting {
+		if key.level == level {
+			delete(c.ackEliciting, key)
+		}
+	}
+
+	// The handshake keys are dropped once the handshake is confirmed
+	if level == logging.EncryptionHandshake && c.stats.HandshakeMs == 0 {
+		c.stats.HandshakeMs = milliseconds(time.Since(c.started))
+	}
+}
+
+func encryptionLevel(packetType logging.PacketType) logging.EncryptionLevel {
+	switch packetType {
+	case logging.PacketTypeInitial:
+		return logging.EncryptionInitial
+	case logging.PacketTypeHandshake:
+		return logging.EncryptionHandshake
+	case logging.PacketType0RTT:
+		return logging.Encryption0RTT
+	default:
+		return logging.Encryption1RTT
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Registry hands out a Collector for every connection and finds it again from the
+// connection's context.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[quic.ConnectionTracingID]*Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[quic.ConnectionTracingID]*Collector),
+	}
+}
+
+// Tracer has the signature of quic.Config.Tracer. The collector is forgotten when the
+// connection closes, callers keep it for as long as they need it.
+func (r *Registry) Tracer(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	collector := NewCollector()
+	tracer := collector.Tracer()
+
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return tracer
+	}
+
+	r.mu.Lock()
+	r.collectors[id] = collector
+	r.mu.Unlock()
+
+	tracer.Close = func() {
+		r.mu.Lock()
+		delete(r.collectors, id)
+		r.mu.Unlock()
+	}
+
+	return tracer
+}
+
+// Lookup returns the collector of conn, or nil if the connection was not traced.
+func (r *Registry) Lookup(conn quic.Connection) *Collector {
+	if r == nil {
+		return nil
+	}
+
+	id, ok := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.collectors[id]
+}
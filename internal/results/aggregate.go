@@ -0,0 +1,72 @@
+package results
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Aggregate sums the summaries of flows that ran in parallel, such as the streams
+// of one QUIC connection or several TCP connections.
+func Aggregate(summaries []Summary) Summary {
+	var total Summary
+	for _, s := range summaries {
+		total.BytesSent += s.BytesSent
+		total.BytesReceived += s.BytesReceived
+		// The flows ran side by side, the slowest one bounds the test
+		if s.Duration > total.Duration {
+			total.Duration = s.Duration
+		}
+	}
+
+	return total
+}
+
+// LogAggregate prints the combined throughput of parallel flows together with the
+// spread between them. flow names the unit ("stream" or "connection").
+func LogAggregate(logger *slog.Logger, flow string, summaries []Summary) {
+	if len(summaries) == 0 {
+		return
+	}
+
+	total := Aggregate(summaries)
+
+	rates := make([]float64, 0, len(summaries))
+	for _, s := range summaries {
+		rates = append(rates, Mbps(s.BytesSent, s.Duration))
+	}
+
+	minRate, maxRate := rates[0], rates[0]
+	for _, rate := range rates[1:] {
+		minRate = min(minRate, rate)
+		maxRate = max(maxRate, rate)
+	}
+
+	logger.Info("Aggregate results",
+		"flow", flow,
+		"count", len(summaries),
+		"duration", total.Duration.Round(time.Millisecond),
+		"bytes_sent", total.BytesSent,
+		"bytes_received", total.BytesReceived,
+		"send_rate_mbps", Mbps(total.BytesSent, total.Duration),
+		"receive_rate_mbps", Mbps(total.BytesReceived, total.Duration),
+		"min_send_rate_mbps", minRate,
+		"max_send_rate_mbps", maxRate,
+		"fairness", JainIndex(rates),
+	)
+}
+
+// JainIndex returns Jain's fairness index of the values: 1 when all flows got the
+// same share, 1/n when a single flow got everything.
+func JainIndex(values []float64) float64 {
+	var sum, sumSquares float64
+	for _, v := range values {
+		sum += v
+		sumSquares += v * v
+	}
+
+	if sumSquares == 0 {
+		return 0
+	}
+
+	return sum * sum / (float64(len(values)) * sumSquares)
+}
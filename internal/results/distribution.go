@@ -0,0 +1,63 @@
+package results
+
+import (
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+)
+
+// Distribution summarizes a set of durations.
+type Distribution struct {
+	Count int
+	Min   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func NewDistribution(values []time.Duration) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	var sum time.Duration
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return Distribution{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Mean:  sum / time.Duration(len(sorted)),
+		P50:   percentile(sorted, 0.50),
+		P90:   percentile(sorted, 0.90),
+		P99:   percentile(sorted, 0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	rank = min(max(rank, 1), len(sorted))
+	return sorted[rank-1]
+}
+
+// LogValue groups the distribution under a single log attribute.
+func (d Distribution) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("count", d.Count),
+		slog.Duration("min", d.Min),
+		slog.Duration("mean", d.Mean),
+		slog.Duration("p50", d.P50),
+		slog.Duration("p90", d.P90),
+		slog.Duration("p99", d.P99),
+		slog.Duration("max", d.Max),
+	)
+}
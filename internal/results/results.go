@@ -0,0 +1,205 @@
+package results
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/quicconf"
+	"github.com/yvv4git/speed-test/internal/quicstats"
+	"github.com/yvv4git/speed-test/internal/session"
+)
+
+// The server appends its report to the data stream once the client has closed its
+// sending side. The trailer layout is: magic | JSON report | uint32 BE length of the JSON.
+// Reading it from the end keeps the data stream itself free of any framing.
+var trailerMagic = []byte("STRESULT")
+
+const (
+	maxReportSize  = 1 << 20
+	trailerLenSize = 4
+)
+
+var ErrReportTooBig = errors.New("results report too big")
+
+// Report is the server's view of a finished test.
+type Report struct {
+	SessionID       string           `json:"session_id"`
+	Protocol        string           `json:"protocol"`
+	StartedAt       time.Time        `json:"started_at"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	BytesReceived   uint64           `json:"bytes_received"`
+	BytesSent       uint64           `json:"bytes_sent"`
+	Samples         []session.Sample `json:"samples,omitempty"`
+	TCPInfo         *TCPInfo         `json:"tcp_info,omitempty"`
+	QUIC            *quicconf.Params `json:"quic,omitempty"`
+	Datagrams       *probe.Stats     `json:"datagrams,omitempty"`
+	QUICStats       *quicstats.Stats `json:"quic_stats,omitempty"`
+}
+
+// NewReport builds a report from the session counters. BytesReceived and BytesSent
+// may be overridden by callers that count per stream.
+func NewReport(sess *session.Session) Report {
+	info := sess.Info(true)
+
+	return Report{
+		SessionID:       info.ID,
+		Protocol:        info.Protocol,
+		StartedAt:       info.StartedAt,
+		DurationSeconds: info.DurationSeconds,
+		BytesReceived:   info.BytesReceived,
+		BytesSent:       info.BytesSent,
+		Samples:         info.Samples,
+	}
+}
+
+// WriteTrailer appends the report to w.
+func WriteTrailer(w io.Writer, report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+
+	if len(body) > maxReportSize {
+		return ErrReportTooBig
+	}
+
+	trailer := make([]byte, 0, len(trailerMagic)+len(body)+trailerLenSize)
+	trailer = append(trailer, trailerMagic...)
+	trailer = append(trailer, body...)
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(body)))
+
+	_, err = w.Write(trailer)
+	return err
+}
+
+// ReadTrailer reads r until EOF. It returns the number of data bytes preceding the
+// trailer and the decoded report, or a nil report if the stream carries no trailer.
+func ReadTrailer(r io.Reader, bufSize int) (uint64, *Report, error) {
+	const maxTail = maxReportSize + 16
+
+	var (
+		total uint64
+		tail  []byte
+	)
+
+	buf := make([]byte, bufSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			total += uint64(n)
+			tail = append(tail, buf[:n]...)
+			if len(tail) > 2*maxTail {
+				tail = append(tail[:0], tail[len(tail)-maxTail:]...)
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return total, nil, err
+		}
+	}
+
+	report, size := parseTrailer(tail)
+	if report == nil {
+		return total, nil, nil
+	}
+
+	return total - uint64(size), report, nil
+}
+
+func parseTrailer(tail []byte) (*Report, int) {
+	if len(tail) < len(trailerMagic)+trailerLenSize {
+		return nil, 0
+	}
+
+	bodyLen := int(binary.BigEndian.Uint32(tail[len(tail)-trailerLenSize:]))
+	size := len(trailerMagic) + bodyLen + trailerLenSize
+	if bodyLen > maxReportSize || size > len(tail) {
+		return nil, 0
+	}
+
+	trailer := tail[len(tail)-size:]
+	if !bytes.Equal(trailer[:len(trailerMagic)], trailerMagic) {
+		return nil, 0
+	}
+
+	var report Report
+	if err := json.Unmarshal(trailer[len(trailerMagic):len(trailerMagic)+bodyLen], &report); err != nil {
+		return nil, 0
+	}
+
+	return &report, size
+}
+
+// Summary is the client's view of a finished test.
+type Summary struct {
+	Duration      time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// LogComparison prints both sides of a test and warns about any difference
+// between what one side sent and what the other received.
+func LogComparison(logger *slog.Logger, local Summary, remote *Report) {
+	logger.Info("Client results",
+		"duration", local.Duration,
+		"bytes_sent", local.BytesSent,
+		"bytes_received", local.BytesReceived,
+		"send_rate_mbps", Mbps(local.BytesSent, local.Duration),
+		"receive_rate_mbps", Mbps(local.BytesReceived, local.Duration),
+	)
+
+	if remote == nil {
+		logger.Warn("Server did not return results")
+		return
+	}
+
+	serverDuration := time.Duration(remote.DurationSeconds * float64(time.Second))
+	attrs := []any{
+		"session_id", remote.SessionID,
+		"duration", serverDuration,
+		"bytes_received", remote.BytesReceived,
+		"bytes_sent", remote.BytesSent,
+		"receive_rate_mbps", Mbps(remote.BytesReceived, serverDuration),
+		"send_rate_mbps", Mbps(remote.BytesSent, serverDuration),
+		"samples", len(remote.Samples),
+	}
+	if remote.TCPInfo != nil {
+		attrs = append(attrs, "tcp_info", *remote.TCPInfo)
+	}
+	logger.Info("Server results", attrs...)
+
+	if local.BytesSent != remote.BytesReceived {
+		logger.Warn("Upload mismatch",
+			"client_sent", local.BytesSent,
+			"server_received", remote.BytesReceived,
+			"difference", int64(local.BytesSent)-int64(remote.BytesReceived),
+		)
+	}
+
+	if remote.BytesSent != local.BytesReceived {
+		logger.Warn("Download mismatch",
+			"server_sent", remote.BytesSent,
+			"client_received", local.BytesReceived,
+			"difference", int64(remote.BytesSent)-int64(local.BytesReceived),
+		)
+	}
+}
+
+// Mbps converts a byte count over a duration to megabits per second.
+func Mbps(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
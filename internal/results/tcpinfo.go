@@ -0,0 +1,20 @@
+package results
+
+// TCPInfo is the subset of the kernel TCP_INFO structure reported to clients.
+// Times are in microseconds.
+type TCPInfo struct {
+	RTT           uint32 `json:"rtt_us"`
+	RTTVar        uint32 `json:"rtt_var_us"`
+	MinRTT        uint32 `json:"min_rtt_us"`
+	SndMSS        uint32 `json:"snd_mss"`
+	RcvMSS        uint32 `json:"rcv_mss"`
+	SndCwnd       uint32 `json:"snd_cwnd"`
+	SndSsthresh   uint32 `json:"snd_ssthresh"`
+	PMTU          uint32 `json:"pmtu"`
+	Lost          uint32 `json:"lost"`
+	TotalRetrans  uint32 `json:"total_retrans"`
+	BytesAcked    uint64 `json:"bytes_acked"`
+	BytesReceived uint64 `json:"bytes_received"`
+	BytesRetrans  uint64 `json:"bytes_retrans"`
+	DeliveryRate  uint64 `json:"delivery_rate"`
+}
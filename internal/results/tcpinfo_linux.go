@@ -0,0 +1,48 @@
+//go:build linux
+
+package results
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadTCPInfo queries TCP_INFO for conn.
+func ReadTCPInfo(conn *net.TCPConn) (*TCPInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		info    *unix.TCPInfo
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+
+	return &TCPInfo{
+		RTT:           info.Rtt,
+		RTTVar:        info.Rttvar,
+		MinRTT:        info.Min_rtt,
+		SndMSS:        info.Snd_mss,
+		RcvMSS:        info.Rcv_mss,
+		SndCwnd:       info.Snd_cwnd,
+		SndSsthresh:   info.Snd_ssthresh,
+		PMTU:          info.Pmtu,
+		Lost:          info.Lost,
+		TotalRetrans:  info.Total_retrans,
+		BytesAcked:    info.Bytes_acked,
+		BytesReceived: info.Bytes_received,
+		BytesRetrans:  info.Bytes_retrans,
+		DeliveryRate:  info.Delivery_rate,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package results
+
+import (
+	"errors"
+	"net"
+)
+
+// ReadTCPInfo is only supported on Linux.
+func ReadTCPInfo(_ *net.TCPConn) (*TCPInfo, error) {
+	return nil, errors.ErrUnsupported
+}
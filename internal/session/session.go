@@ -0,0 +1,259 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSamples caps the interval history kept per session (one hour at the default interval).
+const maxSamples = 3600
+
+// Sample holds the bytes transferred during one sampling interval.
+type Sample struct {
+	At            time.Time `json:"at"`
+	BytesReceived uint64    `json:"bytes_received"`
+	BytesSent     uint64    `json:"bytes_sent"`
+}
+
+// Info is a point-in-time view of a session.
+type Info struct {
+	ID              string    `json:"id"`
+	Protocol        string    `json:"protocol"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Identity        string    `json:"identity"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	ReceiveRate     float64   `json:"receive_rate_bytes_per_second"`
+	SendRate        float64   `json:"send_rate_bytes_per_second"`
+	Samples         []Sample  `json:"samples,omitempty"`
+}
+
+// Session tracks a single client session on a server.
+type Session struct {
+	id         string
+	protocol   string
+	remoteAddr string
+	identity   string
+	startedAt  time.Time
+	cancel     context.CancelCauseFunc
+
+	bytesReceived atomic.Uint64
+	bytesSent     atomic.Uint64
+
+	mu           sync.Mutex
+	lastSampleAt time.Time
+	lastReceived uint64
+	lastSent     uint64
+	receiveRate  float64
+	sendRate     float64
+	samples      []Sample
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) Identity() string {
+	return s.identity
+}
+
+func (s *Session) AddReceived(n int) {
+	s.bytesReceived.Add(uint64(n))
+}
+
+func (s *Session) AddSent(n int) {
+	s.bytesSent.Add(uint64(n))
+}
+
+// Info returns a snapshot of the session. Interval samples are included only when withSamples is set.
+func (s *Session) Info(withSamples bool) Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := Info{
+		ID:              s.id,
+		Protocol:        s.protocol,
+		RemoteAddr:      s.remoteAddr,
+		Identity:        s.identity,
+		StartedAt:       s.startedAt,
+		DurationSeconds: time.Since(s.startedAt).Seconds(),
+		BytesReceived:   s.bytesReceived.Load(),
+		BytesSent:       s.bytesSent.Load(),
+		ReceiveRate:     s.receiveRate,
+		SendRate:        s.sendRate,
+	}
+
+	if withSamples {
+		info.Samples = append([]Sample(nil), s.samples...)
+	}
+
+	return info
+}
+
+func (s *Session) sample(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	received, sent := s.bytesReceived.Load(), s.bytesSent.Load()
+	sample := Sample{
+		At:            now,
+		BytesReceived: received - s.lastReceived,
+		BytesSent:     sent - s.lastSent,
+	}
+
+	if elapsed := now.Sub(s.lastSampleAt).Seconds(); elapsed > 0 {
+		s.receiveRate = float64(sample.BytesReceived) / elapsed
+		s.sendRate = float64(sample.BytesSent) / elapsed
+	}
+
+	if len(s.samples) == maxSamples {
+		s.samples = s.samples[1:]
+	}
+	s.samples = append(s.samples, sample)
+
+	s.lastSampleAt, s.lastReceived, s.lastSent = now, received, sent
+}
+
+// FinishFunc is called once for every session that ends. reason is nil when the
+// session completed normally.
+type FinishFunc func(info Info, endedAt time.Time, reason error)
+
+// Registry keeps track of the active sessions of a server.
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	onFinish []FinishFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Params describes a new session.
+type Params struct {
+	Protocol   string
+	RemoteAddr string
+	Identity   string
+}
+
+// ErrKilled is the cause of the session context when the session was killed by an operator.
+var ErrKilled = errors.New("session killed")
+
+// Start registers a new session. The returned context is canceled when the session
+// is killed or ctx is done; the caller must call Finish when the session ends.
+func (r *Registry) Start(ctx context.Context, params Params) (*Session, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	now := time.Now()
+
+	sess := &Session{
+		id:           newID(),
+		protocol:     params.Protocol,
+		remoteAddr:   params.RemoteAddr,
+		identity:     params.Identity,
+		startedAt:    now,
+		cancel:       cancel,
+		lastSampleAt: now,
+	}
+
+	r.mu.Lock()
+	r.sessions[sess.id] = sess
+	r.mu.Unlock()
+
+	return sess, ctx
+}
+
+// OnFinish registers fn to be called whenever a session ends. It must be called
+// before the server starts accepting sessions.
+func (r *Registry) OnFinish(fn FinishFunc) {
+	r.onFinish = append(r.onFinish, fn)
+}
+
+// Finish removes the session from the registry and releases its context.
+// reason describes why the session ended, nil meaning it completed normally.
+func (r *Registry) Finish(sess *Session, reason error) {
+	endedAt := time.Now()
+
+	r.mu.Lock()
+	delete(r.sessions, sess.id)
+	r.mu.Unlock()
+
+	sess.cancel(nil)
+
+	if len(r.onFinish) == 0 {
+		return
+	}
+
+	info := sess.Info(false)
+	for _, fn := range r.onFinish {
+		fn(info, endedAt, reason)
+	}
+}
+
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sess, ok := r.sessions[id]
+	return sess, ok
+}
+
+// List returns the active sessions ordered by start time.
+func (r *Registry) List() []*Session {
+	r.mu.RLock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].startedAt.Before(sessions[j].startedAt)
+	})
+
+	return sessions
+}
+
+// Kill cancels the session context. The protocol handler is expected to close
+// the underlying connection in response.
+func (r *Registry) Kill(id string) bool {
+	sess, ok := r.Get(id)
+	if !ok {
+		return false
+	}
+
+	sess.cancel(ErrKilled)
+	return true
+}
+
+// Run samples every active session once per interval until ctx is done.
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, sess := range r.List() {
+				sess.sample(now)
+			}
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
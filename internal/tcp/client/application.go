@@ -2,14 +2,17 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/results"
 )
 
 type Application struct {
@@ -34,7 +37,20 @@ func (a *Application) Start(ctx context.Context) error {
 
 	a.logger.Info("Starting TCP client", slog.String("Host:", cfg.ServerHost), slog.Int("Port", int(cfg.ServerPort)))
 
-	addr := fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.ServerPort)
+	addr := net.JoinHostPort(cfg.ServerHost, fmt.Sprintf("%d", cfg.ServerPort))
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	if cfg.Connections > 1 {
+		if err := a.runParallel(ctx, cfg, addr); err != nil {
+			return fmt.Errorf("start client: %w", err)
+		}
+
+		a.logger.Info("Application stopped gracefully")
+		return nil
+	}
+
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("connect to server: %w", err)
@@ -47,9 +63,6 @@ func (a *Application) Start(ctx context.Context) error {
 	})
 	defer client.Close()
 
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
-	defer cancel()
-
 	// Blocking mode, but with graceful shutdown
 	if err = client.Start(ctx); err != nil {
 		return fmt.Errorf("start client: %w", err)
@@ -58,3 +71,46 @@ func (a *Application) Start(ctx context.Context) error {
 	a.logger.Info("Application stopped gracefully")
 	return nil
 }
+
+// runParallel runs the test over several TCP connections at once, the baseline
+// for QUIC stream multiplexing, and prints the per-connection and combined results.
+func (a *Application) runParallel(ctx context.Context, cfg Config, addr string) error {
+	count := int(cfg.Connections)
+	a.logger.Info("Opening connections", "count", count)
+
+	summaries := make([]results.Summary, count)
+	reports := make([]*results.Report, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs[i] = fmt.Errorf("connect to server (connection %d): %w", i, err)
+				return
+			}
+
+			client := NewClient(Params{
+				Logger: a.logger.With("connection", i),
+				Cfg:    cfg,
+				Conn:   conn,
+			})
+			defer client.Close()
+
+			summaries[i], reports[i], errs[i] = client.Run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	for i := range count {
+		results.LogComparison(a.logger.With("connection", i), summaries[i], reports[i])
+	}
+
+	results.LogAggregate(a.logger, "connection", summaries)
+
+	return errors.Join(errs...)
+}
@@ -6,6 +6,10 @@ import (
 	"errors"
 	"log/slog"
 	"net"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/results"
 )
 
 type Client struct {
@@ -15,9 +19,14 @@ type Client struct {
 }
 
 type Config struct {
-	ServerHost string `env:"TCP_CLIENT_SERVER_HOST" envDefault:"127.0.0.1"`
-	ServerPort uint16 `env:"TCP_CLIENT_SERVER_PORT" envDefault:"1543"`
-	BufSize    uint16 `env:"TCP_CLIENT_BUF_SIZE" envDefault:"1024"`
+	ServerHost     string        `env:"TCP_CLIENT_SERVER_HOST" envDefault:"127.0.0.1"`
+	ServerPort     uint16        `env:"TCP_CLIENT_SERVER_PORT" envDefault:"1543"`
+	BufSize        uint16        `env:"TCP_CLIENT_BUF_SIZE" envDefault:"1024"`
+	AuthMode       auth.Mode     `env:"TCP_CLIENT_AUTH_MODE" envDefault:"none"`
+	AuthKey        string        `env:"TCP_CLIENT_AUTH_KEY"`
+	Connections    uint16        `env:"TCP_CLIENT_CONNECTIONS" envDefault:"1"`
+	Duration       time.Duration `env:"TCP_CLIENT_DURATION" envDefault:"0s"`
+	ResultsTimeout time.Duration `env:"TCP_CLIENT_RESULTS_TIMEOUT" envDefault:"10s"`
 }
 
 type Params struct {
@@ -34,41 +43,114 @@ func NewClient(params Params) *Client {
 	}
 }
 
+type readResult struct {
+	received uint64
+	report   *results.Report
+	err      error
+}
+
+// Start runs the test and prints both views of it.
 func (c *Client) Start(ctx context.Context) error {
+	summary, report, err := c.Run(ctx)
+	results.LogComparison(c.logger, summary, report)
+
+	return err
+}
+
+// Run sends data until ctx is done or the configured duration elapses. It then
+// closes the sending side and drains the remaining responses together with the
+// server's results.
+func (c *Client) Run(ctx context.Context) (results.Summary, *results.Report, error) {
 	if c.Conn == nil {
-		return errors.New("connection is not established")
+		return results.Summary{}, nil, errors.New("connection is not established")
+	}
+
+	if c.cfg.AuthMode != auth.ModeNone {
+		if err := auth.Handshake(c.Conn, c.cfg.AuthMode, c.cfg.AuthKey); err != nil {
+			c.logger.Error("Failed to authenticate", "error", err)
+			return results.Summary{}, nil, err
+		}
+
+		c.logger.Info("Authenticated", "mode", c.cfg.AuthMode)
+	}
+
+	if c.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Duration)
+		defer cancel()
+	}
+
+	started := time.Now()
+
+	readCh := make(chan readResult, 1)
+	go func() {
+		received, report, err := results.ReadTrailer(c.Conn, int(c.cfg.BufSize))
+		readCh <- readResult{received: received, report: report, err: err}
+	}()
+
+	sent, sendErr := c.send(ctx)
+	if sendErr != nil {
+		c.logger.Error("Failed to send random bytes", "error", sendErr)
+	}
+
+	if err := closeWrite(c.Conn); err != nil {
+		c.logger.Warn("Failed to close sending side", "error", err)
+	}
+
+	var res readResult
+	select {
+	case res = <-readCh:
+	case <-time.After(c.cfg.ResultsTimeout):
+		c.logger.Warn("Timed out waiting for server results")
+		_ = c.Conn.Close()
+		res = <-readCh
+	}
+
+	if res.err != nil && sendErr == nil {
+		c.logger.Error("Failed to read response", "error", res.err)
 	}
 
-	buf := make([]byte, c.cfg.BufSize)
+	summary := results.Summary{
+		Duration:      time.Since(started),
+		BytesSent:     sent,
+		BytesReceived: res.received,
+	}
+
+	return summary, res.report, sendErr
+}
+
+func (c *Client) send(ctx context.Context) (uint64, error) {
+	var sent uint64
 	for {
 		select {
 		case <-ctx.Done():
 			c.logger.Info("Client stopping due to context cancellation")
-			return nil
+			return sent, nil
 
 		default:
 			randomBytes := make([]byte, c.cfg.BufSize)
 			_, err := rand.Read(randomBytes)
 			if err != nil {
-				c.logger.Error("Failed to generate random bytes", "error", err)
-				return err
+				return sent, err
 			}
 
-			_, err = c.Conn.Write(randomBytes)
+			n, err := c.Conn.Write(randomBytes)
+			sent += uint64(n)
 			if err != nil {
-				c.logger.Error("Failed to send random bytes", "error", err)
-				return err
-			}
-
-			_, err = c.Conn.Read(buf)
-			if err != nil {
-				c.logger.Error("Failed to read response", "error", err)
-				return err
+				return sent, err
 			}
 		}
 	}
 }
 
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
 func (c *Client) Close() error {
 	if c.Conn != nil {
 		err := c.Conn.Close()
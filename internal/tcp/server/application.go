@@ -11,6 +11,10 @@ import (
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/accesslog"
+	"github.com/yvv4git/speed-test/internal/admin"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/proxyproto"
 )
 
 type Application struct {
@@ -33,22 +37,56 @@ func (a *Application) Start(ctx context.Context) error {
 		return fmt.Errorf("parse config: %w", err)
 	}
 
-	a.logger.Info("Loaded configuration", "host", cfg.Host, "port", cfg.Port)
+	a.logger.Info("Loaded configuration", "host", cfg.Host, "port", cfg.Port, "mode", cfg.Mode)
 
-	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	if _, err := admin.ParseMode(string(cfg.Mode)); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	authenticator, err := auth.NewAuthenticator(cfg.AuthMode, cfg.AuthKeys)
+	if err != nil {
+		return fmt.Errorf("create authenticator: %w", err)
+	}
+
+	addr := net.JoinHostPort(cfg.Host, fmt.Sprintf("%d", cfg.Port))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("start TCP server: %w", err)
 	}
 
+	if cfg.ProxyProtocol {
+		listener, err = proxyproto.NewListener(listener, cfg.ProxyTrusted, cfg.ProxyHeaderTimeout)
+		if err != nil {
+			return fmt.Errorf("enable proxy protocol: %w", err)
+		}
+
+		a.logger.Info("PROXY protocol enabled", "trusted", cfg.ProxyTrusted)
+	}
+
 	a.logger.Info("TCP server started", "address", addr)
 
 	srv := NewServer(Params{
 		Logger:   a.logger,
 		Cfg:      cfg,
+		Auth:     authenticator,
 		listener: listener,
 	})
 
+	accessLog, err := accesslog.New(accesslog.Config{
+		Path:       cfg.AccessLogPath,
+		MaxSizeMB:  cfg.AccessLogMaxSizeMB,
+		MaxBackups: cfg.AccessLogMaxBackups,
+	})
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	defer accessLog.Close()
+
+	if accessLog != nil {
+		srv.Sessions().OnFinish(accessLog.SessionFinished)
+		a.logger.Info("Access log enabled", "path", cfg.AccessLogPath)
+	}
+
 	srv.SetHandler(func(data []byte, remoteAddr string) []byte {
 		return data
 	})
@@ -64,7 +102,7 @@ func (a *Application) Start(ctx context.Context) error {
 	}()
 
 	go func() {
-		if err := startMetricsWebServer(cfg); err != nil {
+		if err := startMetricsWebServer(cfg, srv, a.logger); err != nil {
 			a.logger.Error("Failed to start metrics web server", "error", err)
 			cancel()
 		}
@@ -1,26 +1,44 @@
 package server
 
 import (
+	"log/slog"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yvv4git/speed-test/internal/admin"
 )
 
 var (
-	bytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "tcp_server_bytes_received_total",
 		Help: "Total number of bytes received from clients.",
-	})
+	}, []string{"identity"})
 
-	bytesSent = promauto.NewCounter(prometheus.CounterOpts{
+	bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "tcp_server_bytes_sent_total",
 		Help: "Total number of bytes sent to clients.",
-	})
+	}, []string{"identity"})
+
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_server_auth_attempts_total",
+		Help: "Total number of client authentication attempts.",
+	}, []string{"identity", "result"})
 )
 
-func startMetricsWebServer(cfg Config) error {
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(cfg.MetricsAddr, nil)
+func startMetricsWebServer(cfg Config, srv *Server, logger *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	if cfg.AdminToken != "" {
+		admin.Register(mux, admin.Params{
+			Token:    cfg.AdminToken,
+			Sessions: srv.Sessions(),
+			Modes:    srv,
+			Logger:   logger,
+		})
+	}
+
+	return http.ListenAndServe(cfg.MetricsAddr, mux)
 }
@@ -2,9 +2,19 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/admin"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/proxyproto"
+	"github.com/yvv4git/speed-test/internal/results"
+	"github.com/yvv4git/speed-test/internal/session"
 )
 
 type HandlerFunc func(data []byte, remoteAddr string) []byte
@@ -17,6 +27,9 @@ type Server struct {
 	wg       sync.WaitGroup
 	logger   *slog.Logger
 	handler  HandlerFunc
+	auth     *auth.Authenticator
+	sessions *session.Registry
+	modes    *admin.ModeSwitch
 }
 
 type Config struct {
@@ -24,11 +37,29 @@ type Config struct {
 	Port        uint16 `env:"TCP_SERVER_PORT" envDefault:"1543"`
 	BufSize     uint16 `env:"TCP_SERVER_BUF_SIZE" envDefault:"1024"`
 	MetricsAddr string `env:"TCP_SERVER_METRICS_ADDR" envDefault:"0.0.0.0:8080"`
+
+	ProxyProtocol      bool          `env:"TCP_SERVER_PROXY_PROTOCOL" envDefault:"false"`
+	ProxyTrusted       []string      `env:"TCP_SERVER_PROXY_TRUSTED" envSeparator:","`
+	ProxyHeaderTimeout time.Duration `env:"TCP_SERVER_PROXY_HEADER_TIMEOUT" envDefault:"5s"`
+
+	AuthMode    auth.Mode         `env:"TCP_SERVER_AUTH_MODE" envDefault:"none"`
+	AuthKeys    map[string]string `env:"TCP_SERVER_AUTH_KEYS" envSeparator:"," envKeyValSeparator:":"`
+	AuthTimeout time.Duration     `env:"TCP_SERVER_AUTH_TIMEOUT" envDefault:"10s"`
+
+	Mode           admin.Mode    `env:"TCP_SERVER_MODE" envDefault:"echo"`
+	AdminToken     string        `env:"TCP_SERVER_ADMIN_TOKEN"`
+	SampleInterval time.Duration `env:"TCP_SERVER_SAMPLE_INTERVAL" envDefault:"1s"`
+	Results        bool          `env:"TCP_SERVER_RESULTS" envDefault:"true"`
+
+	AccessLogPath       string `env:"TCP_SERVER_ACCESS_LOG"`
+	AccessLogMaxSizeMB  int    `env:"TCP_SERVER_ACCESS_LOG_MAX_SIZE_MB" envDefault:"100"`
+	AccessLogMaxBackups int    `env:"TCP_SERVER_ACCESS_LOG_MAX_BACKUPS" envDefault:"5"`
 }
 
 type Params struct {
 	Cfg      Config
 	Logger   *slog.Logger
+	Auth     *auth.Authenticator
 	listener net.Listener
 }
 
@@ -36,7 +67,10 @@ func NewServer(params Params) *Server {
 	return &Server{
 		cfg:      params.Cfg,
 		logger:   params.Logger,
+		auth:     params.Auth,
 		listener: params.listener,
+		sessions: session.NewRegistry(),
+		modes:    admin.NewModeSwitch(params.Cfg.Mode),
 	}
 }
 
@@ -44,9 +78,23 @@ func (s *Server) SetHandler(handler HandlerFunc) {
 	s.handler = handler
 }
 
+func (s *Server) Sessions() *session.Registry {
+	return s.sessions
+}
+
+func (s *Server) Mode() admin.Mode {
+	return s.modes.Mode()
+}
+
+func (s *Server) SetMode(mode admin.Mode) {
+	s.modes.SetMode(mode)
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
 
+	go s.sessions.Run(s.ctx, s.cfg.SampleInterval)
+
 	return s.acceptConnections() // Blocking mode
 }
 
@@ -74,38 +122,184 @@ func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	remoteAddr := conn.RemoteAddr().String()
-	s.logger.Info("New connection", "remote_addr", remoteAddr)
+	if proxyConn, ok := conn.(*proxyproto.Conn); ok {
+		s.logger.Info("New connection", "remote_addr", remoteAddr, "proxy_addr", proxyConn.ProxyAddr())
+	} else {
+		s.logger.Info("New connection", "remote_addr", remoteAddr)
+	}
+
+	identity, err := s.authenticate(conn)
+	if err != nil {
+		s.logger.Warn("Client authentication failed", "remote_addr", remoteAddr, "error", err)
+		return
+	}
+
+	sess, ctx := s.sessions.Start(s.ctx, session.Params{
+		Protocol:   "tcp",
+		RemoteAddr: remoteAddr,
+		Identity:   identity,
+	})
+
+	reason := s.serve(ctx, conn, sess, remoteAddr)
+	s.sessions.Finish(sess, reason)
+}
+
+// serve runs the session until the client finishes, the connection fails or ctx is
+// done. The returned error is the termination reason, nil for a completed test.
+func (s *Server) serve(ctx context.Context, conn net.Conn, sess *session.Session, remoteAddr string) error {
+	// Unblock the reader when the session is killed or the server shuts down
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	sourceCtx, stopSource := context.WithCancel(ctx)
+	sourceDone := make(chan struct{})
+	defer stopSource()
+
+	s.wg.Add(1)
+	go func() {
+		defer close(sourceDone)
+		s.runSource(sourceCtx, conn, sess)
+	}()
 
 	buf := make([]byte, s.cfg.BufSize)
 
 	for {
 		select {
-		case <-s.ctx.Done():
-			s.logger.Info("Connection handling stopped due to server shutdown")
-			return
+		case <-ctx.Done():
+			s.logger.Info("Connection handling stopped", "session_id", sess.ID(), "reason", context.Cause(ctx))
+			return context.Cause(ctx)
 		default:
 			n, err := conn.Read(buf)
 			if err != nil {
+				if ctx.Err() != nil {
+					continue // The session was stopped, report it above
+				}
+
+				if errors.Is(err, io.EOF) {
+					// The client finished sending: stop streaming and report the server's view
+					stopSource()
+					<-sourceDone
+					s.sendResults(conn, sess)
+					return nil
+				}
+
 				s.logger.Error("Error reading from connection", "error", err)
-				return
+				return err
 			}
 
-			bytesReceived.Add(float64(n)) // Increment bytes received counter
+			bytesReceived.WithLabelValues(sess.Identity()).Add(float64(n)) // Increment bytes received counter
+			sess.AddReceived(n)
 
-			if s.handler != nil {
+			if s.handler != nil && s.modes.Mode() == admin.ModeEcho {
 				response := s.handler(buf[:n], remoteAddr)
 
 				if n, err = conn.Write(response); err != nil {
 					s.logger.Error("Failed to send response to client", "error", err)
-					return
+					return err
 				}
 
-				bytesSent.Add(float64(n)) // Increment bytes sent counter
+				bytesSent.WithLabelValues(sess.Identity()).Add(float64(n)) // Increment bytes sent counter
+				sess.AddSent(n)
 			}
 		}
 	}
 }
 
+// runSource streams data to the client while the server is in source mode.
+func (s *Server) runSource(ctx context.Context, conn net.Conn, sess *session.Session) {
+	defer s.wg.Done()
+
+	buf := make([]byte, s.cfg.BufSize)
+	if _, err := rand.Read(buf); err != nil {
+		s.logger.Error("Failed to generate random bytes", "error", err)
+		return
+	}
+
+	for {
+		changed := s.modes.Changed()
+		if s.modes.Mode() != admin.ModeSource {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			n, err := conn.Write(buf)
+			if err != nil {
+				return // The reader reports connection errors
+			}
+
+			bytesSent.WithLabelValues(sess.Identity()).Add(float64(n)) // Increment bytes sent counter
+			sess.AddSent(n)
+		}
+	}
+}
+
+func (s *Server) sendResults(conn net.Conn, sess *session.Session) {
+	if !s.cfg.Results {
+		return
+	}
+
+	report := results.NewReport(sess)
+	report.TCPInfo = readTCPInfo(conn)
+
+	if err := results.WriteTrailer(conn, report); err != nil {
+		s.logger.Error("Failed to send results to client", "session_id", sess.ID(), "error", err)
+		return
+	}
+
+	s.logger.Info("Results sent to client", "session_id", sess.ID(),
+		"bytes_received", report.BytesReceived, "bytes_sent", report.BytesSent)
+}
+
+func readTCPInfo(conn net.Conn) *results.TCPInfo {
+	if proxyConn, ok := conn.(*proxyproto.Conn); ok {
+		conn = proxyConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	info, err := results.ReadTCPInfo(tcpConn)
+	if err != nil {
+		return nil
+	}
+
+	return info
+}
+
+func (s *Server) authenticate(conn net.Conn) (string, error) {
+	if !s.auth.Enabled() {
+		return auth.Anonymous, nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(s.cfg.AuthTimeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	identity, err := s.auth.Authenticate(conn)
+	if err != nil {
+		authAttempts.WithLabelValues("", "denied").Inc()
+		return "", err
+	}
+
+	authAttempts.WithLabelValues(identity, "ok").Inc()
+	s.logger.Info("Client authenticated", "remote_addr", conn.RemoteAddr().String(), "identity", identity)
+
+	return identity, nil
+}
+
 func (s *Server) Stop() {
 	if s.cancel != nil {
 		s.cancel()
@@ -0,0 +1,310 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+var (
+	ErrPinMismatch    = errors.New("server certificate does not match any pinned fingerprint")
+	ErrNoCertificates = errors.New("no certificates found")
+)
+
+// ServerParams describes where a server takes its certificate from.
+type ServerParams struct {
+	// CertFile and KeyFile are PEM files. When both are empty an ephemeral
+	// self-signed certificate is generated in memory.
+	CertFile string
+	KeyFile  string
+	// Generate creates a self-signed pair at CertFile/KeyFile when they do not exist yet.
+	Generate bool
+	// Hosts are the DNS names and IP addresses put into generated certificates.
+	Hosts []string
+}
+
+// LoadServerCertificate returns the server certificate described by params.
+func LoadServerCertificate(params ServerParams) (tls.Certificate, error) {
+	if params.CertFile == "" && params.KeyFile == "" {
+		certPEM, keyPEM, err := GenerateSelfSigned(params.Hosts)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+
+	if params.CertFile == "" || params.KeyFile == "" {
+		return tls.Certificate{}, errors.New("both certificate and key files must be set")
+	}
+
+	if params.Generate && !exists(params.CertFile) && !exists(params.KeyFile) {
+		if err := writeSelfSigned(params); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(params.CertFile, params.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load key pair: %w", err)
+	}
+
+	return cert, nil
+}
+
+// GenerateSelfSigned creates a PEM encoded self-signed ECDSA certificate and key.
+func GenerateSelfSigned(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "speed-test"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+func writeSelfSigned(params ServerParams) error {
+	certPEM, keyPEM, err := GenerateSelfSigned(params.Hosts)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{params.CertFile, params.KeyFile} {
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return fmt.Errorf("create directory for %s: %w", path, err)
+		}
+	}
+
+	if err = os.WriteFile(params.KeyFile, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+
+	if err = os.WriteFile(params.CertFile, certPEM, 0o644); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+
+	return nil
+}
+
+// Fingerprint returns the base64 encoded SHA-256 of the certificate's SubjectPublicKeyInfo,
+// the value clients pin.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LeafFingerprint returns the SPKI fingerprint of the first certificate in the chain.
+func LeafFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", ErrNoCertificates
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+
+	return Fingerprint(leaf), nil
+}
+
+// ClientParams describes how a client verifies the server.
+type ClientParams struct {
+	// CAFile is a PEM bundle of trusted roots. The system roots are used when it is empty.
+	CAFile string
+	// Pins are SPKI SHA-256 fingerprints, base64 or hex encoded. When set without a CA file,
+	// the pin alone authenticates the server, which suits self-signed certificates.
+	Pins []string
+	// ServerName overrides the name verified against the certificate and sent in SNI.
+	ServerName string
+	// Insecure disables every check. It must be requested explicitly.
+	Insecure bool
+	// CertFile and KeyFile are an optional PEM client certificate for servers that
+	// verify clients.
+	CertFile string
+	KeyFile  string
+}
+
+// NewClientConfig builds a client TLS configuration from params.
+func NewClientConfig(params ClientParams) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: params.ServerName,
+	}
+
+	if params.CertFile != "" || params.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(params.CertFile, params.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if params.Insecure {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+
+	pins, err := decodePins(params.Pins)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.CAFile != "" {
+		pool, err := LoadCertPool(params.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(pins) > 0 {
+		if params.CAFile == "" {
+			// The pin replaces chain verification
+			cfg.InsecureSkipVerify = true
+		}
+
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrPinMismatch
+			}
+
+			sum := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+					return nil
+				}
+			}
+
+			return ErrPinMismatch
+		}
+	}
+
+	return cfg, nil
+}
+
+// ClientAuthParams describes how a server verifies client certificates.
+type ClientAuthParams struct {
+	// CAFile is a PEM bundle of the roots client certificates must chain to. Clients
+	// are not asked for a certificate when it is empty.
+	CAFile string
+	// Optional accepts clients without a certificate, certificates that are presented
+	// are still verified.
+	Optional bool
+}
+
+// SetClientAuth makes cfg verify client certificates as params describe.
+func SetClientAuth(cfg *tls.Config, params ClientAuthParams) error {
+	if params.CAFile == "" {
+		return nil
+	}
+
+	pool, err := LoadCertPool(params.CAFile)
+	if err != nil {
+		return err
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if params.Optional {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return nil
+}
+
+// LoadCertPool reads a PEM bundle into a certificate pool.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w in %s", ErrNoCertificates, path)
+	}
+
+	return pool, nil
+}
+
+func decodePins(pins []string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimSpace(strings.TrimPrefix(pin, "sha256/"))
+		if pin == "" {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(value) != sha256.Size {
+			value, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		}
+
+		if err != nil || len(value) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", pin)
+		}
+
+		decoded = append(decoded, value)
+	}
+
+	return decoded, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/joho/godotenv"
+)
+
+type Application struct {
+	logger *slog.Logger
+}
+
+func NewApplication(log *slog.Logger) *Application {
+	return &Application{
+		logger: log,
+	}
+}
+
+func (a *Application) Start(ctx context.Context) error {
+	if err := godotenv.Load(); err != nil {
+		a.logger.Debug("load .env file", "error", err)
+	}
+
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	a.logger.Info("Starting UDP client", slog.String("Host", cfg.ServerHost), slog.Int("Port", int(cfg.ServerPort)))
+
+	addr := net.JoinHostPort(cfg.ServerHost, fmt.Sprintf("%d", cfg.ServerPort))
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("connect to server: %w", err)
+	}
+
+	client := NewClient(Params{
+		Logger: a.logger,
+		Cfg:    cfg,
+		Conn:   conn,
+	})
+	defer client.Close()
+
+	if err = client.Start(ctx); err != nil {
+		return fmt.Errorf("start client: %w", err)
+	}
+
+	a.logger.Info("Application stopped gracefully")
+	return nil
+}
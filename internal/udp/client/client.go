@@ -0,0 +1,338 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/results"
+	"github.com/yvv4git/speed-test/internal/udp"
+)
+
+type Client struct {
+	logger *slog.Logger
+	cfg    Config
+	Conn   net.Conn
+}
+
+type Config struct {
+	ServerHost     string        `env:"UDP_CLIENT_SERVER_HOST" envDefault:"127.0.0.1"`
+	ServerPort     uint16        `env:"UDP_CLIENT_SERVER_PORT" envDefault:"1543"`
+	Test           TestMode      `env:"UDP_CLIENT_TEST" envDefault:"throughput"`
+	RateMbps       float64       `env:"UDP_CLIENT_RATE_MBPS" envDefault:"10"`
+	DatagramSize   uint16        `env:"UDP_CLIENT_DATAGRAM_SIZE" envDefault:"1200"`
+	Duration       time.Duration `env:"UDP_CLIENT_DURATION" envDefault:"10s"`
+	Drain          time.Duration `env:"UDP_CLIENT_DRAIN" envDefault:"500ms"`
+	ResultsTimeout time.Duration `env:"UDP_CLIENT_RESULTS_TIMEOUT" envDefault:"3s"`
+	// HandshakeTimeout bounds the cookie exchange that starts a flow
+	HandshakeTimeout time.Duration `env:"UDP_CLIENT_HANDSHAKE_TIMEOUT" envDefault:"3s"`
+
+	VoiceCodec        string        `env:"UDP_CLIENT_VOICE_CODEC" envDefault:"g711"`
+	VoicePTime        time.Duration `env:"UDP_CLIENT_VOICE_PTIME" envDefault:"20ms"`
+	VoiceJitterBuffer time.Duration `env:"UDP_CLIENT_VOICE_JITTER_BUFFER" envDefault:"60ms"`
+
+	// MTUs include the IP and UDP headers
+	MTUMin      int           `env:"UDP_CLIENT_MTU_MIN" envDefault:"576"`
+	MTUMax      int           `env:"UDP_CLIENT_MTU_MAX" envDefault:"9000"`
+	MTUAttempts int           `env:"UDP_CLIENT_MTU_ATTEMPTS" envDefault:"3"`
+	MTUTimeout  time.Duration `env:"UDP_CLIENT_MTU_TIMEOUT" envDefault:"500ms"`
+}
+
+// TestMode selects what the client measures.
+type TestMode string
+
+const (
+	TestThroughput TestMode = "throughput" // paced datagrams at a target rate
+	TestVoice      TestMode = "voice"      // echoed voice-sized packets rated with the E-model
+	TestMTU        TestMode = "mtu"        // path MTU discovery with the don't-fragment bit
+)
+
+type Params struct {
+	Logger *slog.Logger
+	Cfg    Config
+	Conn   net.Conn
+}
+
+func NewClient(params Params) *Client {
+	return &Client{
+		logger: params.Logger,
+		cfg:    params.Cfg,
+		Conn:   params.Conn,
+	}
+}
+
+// finishRetry is how often the finish message is repeated until the final report arrives,
+// and the handshake messages until they are answered.
+const finishRetry = 200 * time.Millisecond
+
+func (c *Client) Start(ctx context.Context) error {
+	if c.Conn == nil {
+		return errors.New("connection is not established")
+	}
+
+	switch c.cfg.Test {
+	case TestThroughput:
+		return c.runThroughput(ctx)
+	case TestVoice:
+		return c.runVoice(ctx)
+	case TestMTU:
+		return c.runMTU()
+	default:
+		return fmt.Errorf("unknown test mode %q", c.cfg.Test)
+	}
+}
+
+// runThroughput sends sequence-numbered, timestamped datagrams at the target rate for
+// the configured duration, like iperf -u. The server reports what it received for every
+// interval and for the whole test.
+func (c *Client) runThroughput(ctx context.Context) error {
+	if c.cfg.DatagramSize < probe.HeaderSize {
+		return errors.New("datagram size is smaller than the probe header")
+	}
+
+	if c.cfg.RateMbps <= 0 {
+		return errors.New("rate must be positive")
+	}
+
+	pps := c.cfg.RateMbps * 1e6 / 8 / float64(c.cfg.DatagramSize)
+	c.logger.Info("Starting UDP test", "rate_mbps", c.cfg.RateMbps, "datagram_size", c.cfg.DatagramSize,
+		"rate_pps", pps, "duration", c.cfg.Duration)
+
+	if err := c.handshake(ctx); err != nil {
+		return fmt.Errorf("start flow: %w", err)
+	}
+
+	finals := make(chan udp.Report, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readReports(finals, nil)
+	}()
+
+	sendCtx := ctx
+	if c.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, c.cfg.Duration)
+		defer cancel()
+	}
+
+	started := time.Now()
+	sent, sendErr := c.send(sendCtx, time.Duration(float64(time.Second)/pps), int(c.cfg.DatagramSize), probe.Packet.Marshal)
+	duration := time.Since(started)
+	if sendErr != nil {
+		c.logger.Error("Failed to send datagram", "error", sendErr)
+	}
+
+	// Datagrams still in flight arrive before the server closes the flow
+	time.Sleep(c.cfg.Drain)
+
+	report, err := c.finish(sent, finals)
+
+	// Unblock the reader
+	_ = c.Conn.SetReadDeadline(time.Now())
+	<-readDone
+
+	c.logger.Info("Client results",
+		"duration", duration,
+		"sent", sent,
+		"bytes_sent", sent*uint64(c.cfg.DatagramSize),
+		"send_rate_mbps", results.Mbps(sent*uint64(c.cfg.DatagramSize), duration),
+	)
+
+	if err != nil {
+		c.logger.Warn("Server did not return results", "error", err)
+		return sendErr
+	}
+
+	c.logger.Info("Server results",
+		"session_id", report.SessionID,
+		"received", report.Stats.Received,
+		"bytes_received", report.Stats.Bytes,
+		"receive_rate_mbps", results.Mbps(report.Stats.Bytes, duration),
+		"lost", report.Stats.Lost,
+		"loss_ratio", report.Stats.LossRatio,
+		"reordered", report.Stats.Reordered,
+		"duplicates", report.Stats.Duplicates,
+		"jitter_ms", report.Stats.JitterMs,
+	)
+
+	return sendErr
+}
+
+// handshake starts a flow: the client asks for a cookie and returns it, which proves to
+// the server that the client receives at its address. Both messages are repeated until
+// they are answered.
+func (c *Client) handshake(ctx context.Context) error {
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	deadline := time.Now().Add(c.cfg.HandshakeTimeout)
+	request := udp.MarshalHello()
+	buf := make([]byte, 64<<10)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			return errors.New("timed out waiting for the server")
+		}
+
+		if _, err := c.Conn.Write(request); err != nil {
+			return err
+		}
+
+		retryAt := time.Now().Add(finishRetry)
+		if deadline.Before(retryAt) {
+			retryAt = deadline
+		}
+		if err := c.Conn.SetReadDeadline(retryAt); err != nil {
+			return err
+		}
+
+	read:
+		for {
+			n, err := c.Conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break read
+				}
+
+				// The server's port may be unreachable for a moment, e.g. before it starts
+				continue
+			}
+
+			if cookie, ok := udp.UnmarshalCookie(buf[:n]); ok {
+				request = udp.MarshalStart(cookie)
+				break read
+			}
+
+			if _, ok := udp.UnmarshalStart(buf[:n]); ok && bytes.Equal(buf[:n], request) {
+				return nil
+			}
+		}
+	}
+}
+
+// send paces datagrams of size to one per interval, marshal writes the header of each.
+func (c *Client) send(ctx context.Context, interval time.Duration, size int, marshal func(probe.Packet, []byte)) (uint64, error) {
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+
+	started := time.Now()
+	var seq uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return seq, nil
+
+		case now := <-ticker.C:
+			// Send everything that is due, the ticker is coarser than the interval at high rates
+			due := uint64(now.Sub(started)/interval) + 1
+			for ; seq < due; seq++ {
+				marshal(probe.Packet{Seq: seq, SentAt: time.Now().UnixNano()}, buf)
+				if _, err := c.Conn.Write(buf); err != nil {
+					return seq, err
+				}
+			}
+		}
+	}
+}
+
+// readReports logs the interval reports and hands the final one over. Echo packets
+// go to echoes, if set.
+func (c *Client) readReports(finals chan<- udp.Report, echoes func(packet probe.Packet, size int, at time.Time)) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return
+			}
+
+			// The server's port may be unreachable for a moment, e.g. before it starts
+			c.logger.Debug("Failed to read report", "error", err)
+			continue
+		}
+
+		if packet, ok := udp.UnmarshalEcho(buf[:n]); ok {
+			if echoes != nil {
+				echoes(packet, n, time.Now())
+			}
+			continue
+		}
+
+		report, err := udp.UnmarshalReport(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if report.Final {
+			select {
+			case finals <- report:
+			default:
+			}
+			continue
+		}
+
+		c.logger.Info("Interval results",
+			"interval", report.Interval,
+			"start_s", report.StartSeconds,
+			"end_s", report.EndSeconds,
+			"received", report.Stats.Received,
+			"receive_rate_mbps", report.Mbps(),
+			"lost", report.Stats.Lost,
+			"loss_ratio", report.Stats.LossRatio,
+			"reordered", report.Stats.Reordered,
+			"duplicates", report.Stats.Duplicates,
+			"jitter_ms", report.Stats.JitterMs,
+		)
+	}
+}
+
+// finish repeats the finish message until the final report arrives, either may be lost.
+func (c *Client) finish(sent uint64, finals <-chan udp.Report) (udp.Report, error) {
+	timeout := time.After(c.cfg.ResultsTimeout)
+	retry := time.NewTicker(finishRetry)
+	defer retry.Stop()
+
+	message := udp.MarshalFinish(sent)
+	for {
+		if _, err := c.Conn.Write(message); err != nil {
+			return udp.Report{}, err
+		}
+
+		select {
+		case report := <-finals:
+			return report, nil
+		case <-timeout:
+			return udp.Report{}, errors.New("timed out waiting for server results")
+		case <-retry.C:
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	if c.Conn != nil {
+		err := c.Conn.Close()
+		if err != nil {
+			return err
+		}
+
+		c.logger.Info("Connection closed")
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/udp"
+)
+
+const (
+	udpHeaderSize  = 8
+	tcpHeaderSize  = 20
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+
+	// ipv6MinMTU is the smallest MTU an IPv6 link may have.
+	ipv6MinMTU = 1280
+	// quicMinPacketSize is the smallest UDP payload QUIC works with.
+	quicMinPacketSize = 1200
+)
+
+// probeOutcome is what became of the probes of one size.
+type probeOutcome int
+
+const (
+	probeDelivered probeOutcome = iota
+	probeDropped                // no ack within the timeout, however often it was sent
+	probeTooBig                 // refused locally, the kernel knows the path MTU is smaller
+)
+
+// pathProbe searches the path MTU of a connected UDP socket with the don't-fragment bit set.
+type pathProbe struct {
+	client *Client
+	conn   *net.UDPConn
+	header int // IP and UDP headers
+	buf    []byte
+	seq    uint64
+
+	probes  int
+	dropped []int // MTUs probed without an answer
+	tooBig  []int // MTUs the kernel refused
+}
+
+// runMTU binary-searches the largest datagram that reaches the server with the
+// don't-fragment bit set and reports the path MTU, whether large packets vanish
+// without an ICMP error (a PMTUD black hole) and settings that fit the path.
+func (c *Client) runMTU() error {
+	conn, ok := c.Conn.(*net.UDPConn)
+	if !ok {
+		return errors.New("path MTU discovery needs a UDP socket")
+	}
+
+	ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	header, lo := ipv4HeaderSize+udpHeaderSize, c.cfg.MTUMin
+	if ipv6 {
+		header, lo = ipv6HeaderSize+udpHeaderSize, max(lo, ipv6MinMTU)
+	}
+	hi := c.cfg.MTUMax
+
+	if hi <= lo {
+		return errors.New("maximum MTU must be larger than the minimum")
+	}
+
+	if err := setDontFragment(conn, ipv6); err != nil {
+		return fmt.Errorf("set don't-fragment bit: %w", err)
+	}
+
+	kernelBefore, err := kernelPathMTU(conn, ipv6)
+	if err != nil {
+		c.logger.Warn("Failed to read the kernel path MTU", "error", err)
+	}
+
+	c.logger.Info("Starting path MTU discovery", "min_mtu", lo, "max_mtu", hi, "kernel_path_mtu", kernelBefore,
+		"attempts", c.cfg.MTUAttempts, "timeout", c.cfg.MTUTimeout)
+
+	p := &pathProbe{client: c, conn: conn, header: header, buf: make([]byte, hi-header)}
+	if _, err = rand.Read(p.buf); err != nil {
+		return err
+	}
+
+	outcome, err := p.probe(lo)
+	if err != nil {
+		return err
+	}
+	if outcome != probeDelivered {
+		return fmt.Errorf("no probe of the minimum MTU %d reached the server", lo)
+	}
+
+	outcome, err = p.probe(hi)
+	if err != nil {
+		return err
+	}
+
+	pathMTU := hi
+	if outcome != probeDelivered {
+		// lo is always delivered, hi never
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+
+			outcome, err = p.probe(mid)
+			if err != nil {
+				return err
+			}
+
+			if outcome == probeDelivered {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		pathMTU = lo
+	}
+
+	kernelAfter, err := kernelPathMTU(conn, ipv6)
+	if err != nil {
+		c.logger.Warn("Failed to read the kernel path MTU", "error", err)
+	}
+
+	// Packets above the path MTU vanished, yet the kernel never learned of a smaller
+	// MTU: no ICMP fragmentation needed message came back
+	blackHole := len(p.dropped) > 0 && kernelAfter > pathMTU
+
+	attrs := []any{
+		"path_mtu", pathMTU,
+		"max_udp_payload", pathMTU - header,
+		"kernel_path_mtu_before", kernelBefore,
+		"kernel_path_mtu_after", kernelAfter,
+		"probes", p.probes,
+		"dropped_sizes", p.dropped,
+		"refused_sizes", p.tooBig,
+		"black_hole", blackHole,
+	}
+	if pathMTU == c.cfg.MTUMax {
+		c.logger.Info("Path MTU is at least the configured maximum", attrs...)
+	} else {
+		c.logger.Info("Path MTU results", attrs...)
+	}
+
+	if blackHole {
+		c.logger.Warn("Packets larger than the path MTU are dropped silently, ICMP fragmentation needed does not arrive",
+			"path_mtu", pathMTU, "smallest_dropped_mtu", slices.Min(p.dropped))
+	}
+
+	c.logSuggestions(pathMTU, header-udpHeaderSize)
+	return nil
+}
+
+// logSuggestions derives packet sizes of the other tests from the path MTU.
+func (c *Client) logSuggestions(pathMTU, ipHeader int) {
+	quicPacketSize := pathMTU - ipHeader - udpHeaderSize
+	mss := pathMTU - ipHeader - tcpHeaderSize
+
+	if quicPacketSize < quicMinPacketSize {
+		c.logger.Warn("The path cannot carry full-sized QUIC packets without fragmentation",
+			"max_udp_payload", quicPacketSize, "quic_min_packet_size", quicMinPacketSize)
+	}
+
+	c.logger.Info("Suggested settings",
+		// quic-go grows the packet size further with its own path MTU discovery
+		"quic_initial_packet_size", max(min(quicPacketSize, 1<<16-1), quicMinPacketSize),
+		"tcp_mss", mss,
+		// A buffer of whole segments is written without a partly filled segment at the end
+		"buf_size", (1<<16-1)/mss*mss,
+	)
+}
+
+// probe sends a datagram of mtu bytes including the IP and UDP headers up to the
+// configured number of times and waits for the server to acknowledge it.
+func (p *pathProbe) probe(mtu int) (probeOutcome, error) {
+	size := mtu - p.header
+	cfg := p.client.cfg
+
+	for range cfg.MTUAttempts {
+		p.seq++
+		p.probes++
+		udp.MarshalMTUProbe(p.buf, p.seq)
+
+		if _, err := p.conn.Write(p.buf[:size]); err != nil {
+			if isMessageTooLong(err) {
+				p.tooBig = append(p.tooBig, mtu)
+				p.client.logger.Debug("Probe refused by the kernel", "mtu", mtu)
+				return probeTooBig, nil
+			}
+
+			return probeDropped, fmt.Errorf("send probe: %w", err)
+		}
+
+		acked, err := p.waitAck(p.seq, size, time.Now().Add(cfg.MTUTimeout))
+		if err != nil {
+			return probeDropped, err
+		}
+
+		if acked {
+			p.client.logger.Debug("Probe delivered", "mtu", mtu)
+			return probeDelivered, nil
+		}
+	}
+
+	p.dropped = append(p.dropped, mtu)
+	p.client.logger.Debug("Probe dropped", "mtu", mtu)
+	return probeDropped, nil
+}
+
+// waitAck reads until the ack of probe seq arrives or the deadline passes. Acks of
+// earlier probes that arrive late are skipped.
+func (p *pathProbe) waitAck(seq uint64, size int, deadline time.Time) (bool, error) {
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 64)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, nil
+			}
+
+			// ICMP errors of earlier probes surface on reads of a connected socket
+			continue
+		}
+
+		ackSeq, ackSize, ok := udp.UnmarshalAck(buf[:n])
+		if ok && ackSeq == seq && ackSize == size {
+			return true, nil
+		}
+	}
+}
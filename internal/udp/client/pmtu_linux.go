@@ -0,0 +1,69 @@
+//go:build linux
+
+package client
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets the don't-fragment bit on every datagram of conn. Datagrams
+// larger than the path MTU the kernel knows of fail with EMSGSIZE instead of being
+// fragmented.
+func setDontFragment(conn *net.UDPConn, ipv6 bool) error {
+	level, opt, value := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	if ipv6 {
+		level, opt, value = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// kernelPathMTU is the path MTU the kernel knows of for the peer of conn. It drops
+// below the interface MTU when an ICMP fragmentation needed message arrives.
+func kernelPathMTU(conn *net.UDPConn, ipv6 bool) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if ipv6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		mtu     int
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		mtu, sockErr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return mtu, sockErr
+}
+
+// isMessageTooLong reports whether a write failed because the datagram exceeds the
+// path MTU the kernel knows of.
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
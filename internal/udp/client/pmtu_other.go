@@ -0,0 +1,22 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+// setDontFragment is only supported on Linux.
+func setDontFragment(_ *net.UDPConn, _ bool) error {
+	return errors.ErrUnsupported
+}
+
+// kernelPathMTU is only supported on Linux.
+func kernelPathMTU(_ *net.UDPConn, _ bool) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func isMessageTooLong(_ error) bool {
+	return false
+}
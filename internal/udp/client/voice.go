@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/udp"
+	"github.com/yvv4git/speed-test/internal/voice"
+)
+
+// echo is a voice packet the server sent back.
+type echo struct {
+	sentAt, reflectedAt, arrivedAt time.Time
+}
+
+// echoes collects the echoed voice packets, the first copy of each.
+type echoes struct {
+	mu         sync.Mutex
+	packets    map[uint64]echo
+	upstream   probe.Jitter
+	downstream probe.Jitter
+	rttSum     time.Duration
+}
+
+func (e *echoes) add(packet probe.Packet, _ int, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.packets[packet.Seq]; ok {
+		return
+	}
+
+	p := echo{sentAt: time.Unix(0, packet.SentAt), reflectedAt: time.Unix(0, packet.ReflectedAt), arrivedAt: at}
+	e.packets[packet.Seq] = p
+
+	e.upstream.Add(p.reflectedAt.Sub(p.sentAt))
+	e.downstream.Add(p.arrivedAt.Sub(p.reflectedAt))
+	e.rttSum += p.arrivedAt.Sub(p.sentAt)
+}
+
+// runVoice sends packets shaped like a voice call, one codec frame every ptime, which
+// the server echoes back. Both directions are played through a simulated jitter buffer
+// and rated with the ITU-T G.107 E-model. The worse direction rates the call.
+func (c *Client) runVoice(ctx context.Context) error {
+	codec, err := voice.LookupCodec(c.cfg.VoiceCodec)
+	if err != nil {
+		return err
+	}
+
+	size := max(codec.PacketSize(c.cfg.VoicePTime), udp.EchoHeaderSize)
+	call := voice.Call{Codec: codec, PTime: c.cfg.VoicePTime, Buffer: voice.JitterBuffer{Depth: c.cfg.VoiceJitterBuffer}}
+
+	c.logger.Info("Starting voice test", "codec", codec.Name, "ptime", c.cfg.VoicePTime, "packet_size", size,
+		"jitter_buffer", c.cfg.VoiceJitterBuffer, "duration", c.cfg.Duration)
+
+	if err = c.handshake(ctx); err != nil {
+		return fmt.Errorf("start flow: %w", err)
+	}
+
+	collected := &echoes{packets: make(map[uint64]echo)}
+
+	finals := make(chan udp.Report, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readReports(finals, collected.add)
+	}()
+
+	sendCtx := ctx
+	if c.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, c.cfg.Duration)
+		defer cancel()
+	}
+
+	sent, sendErr := c.send(sendCtx, c.cfg.VoicePTime, size, func(p probe.Packet, buf []byte) {
+		udp.MarshalEcho(buf, p)
+	})
+	if sendErr != nil {
+		c.logger.Error("Failed to send voice packet", "error", sendErr)
+	}
+
+	time.Sleep(c.cfg.Drain)
+
+	report, err := c.finish(sent, finals)
+
+	_ = c.Conn.SetReadDeadline(time.Now())
+	<-readDone
+
+	collected.mu.Lock()
+	defer collected.mu.Unlock()
+
+	echoed := uint64(len(collected.packets))
+	if echoed == 0 {
+		c.logger.Warn("No voice packets came back, the call cannot be rated", "sent", sent)
+		return sendErr
+	}
+
+	// The server counts what reached it. Without its report the round-trip loss is
+	// split evenly between the directions.
+	upReceived := sent - (sent-echoed)/2
+	if err != nil {
+		c.logger.Warn("Server did not return results, assuming symmetric loss", "error", err)
+	} else {
+		upReceived = max(min(report.Stats.Received, sent), echoed)
+	}
+
+	var upArrivals, downArrivals []voice.Arrival
+	for seq, p := range collected.packets {
+		upArrivals = append(upArrivals, voice.Arrival{Seq: seq, Transit: p.reflectedAt.Sub(p.sentAt)})
+		downArrivals = append(downArrivals, voice.Arrival{Seq: seq, Transit: p.arrivedAt.Sub(p.reflectedAt)})
+	}
+
+	// Losses cannot be told apart by direction packet by packet, so both share the burst
+	// ratio of the round trip, counting packets either buffer discards as lost
+	upLate, downLate := call.Buffer.Late(upArrivals), call.Buffer.Late(downArrivals)
+	burstRatio := voice.BurstRatio(sent, func(seq uint64) bool {
+		_, ok := collected.packets[seq]
+		return ok && !upLate[seq] && !downLate[seq]
+	})
+
+	// Only the round trip is measured, each direction gets half of it
+	oneWay := collected.rttSum / time.Duration(echoed) / 2
+
+	upstream := call.Evaluate(voice.Leg{
+		Sent:       sent,
+		Lost:       sent - upReceived,
+		Arrivals:   upArrivals,
+		Delay:      oneWay,
+		BurstRatio: burstRatio,
+	})
+	downstream := call.Evaluate(voice.Leg{
+		Sent:       upReceived,
+		Lost:       upReceived - echoed,
+		Arrivals:   downArrivals,
+		Delay:      oneWay,
+		BurstRatio: burstRatio,
+	})
+
+	c.logger.Info("Voice results",
+		"codec", codec.Name,
+		"sent", sent,
+		"echoed", echoed,
+		"rtt_avg", collected.rttSum/time.Duration(echoed),
+		"upstream_jitter", collected.upstream.Value(),
+		"downstream_jitter", collected.downstream.Value(),
+		"burst_ratio", burstRatio,
+	)
+	c.logDirection("Upstream call quality", upstream)
+	c.logDirection("Downstream call quality", downstream)
+
+	quality := upstream
+	if downstream.R < upstream.R {
+		quality = downstream
+	}
+
+	c.logger.Info("Call quality",
+		"mos", quality.MOS,
+		"r_factor", quality.R,
+		"satisfaction", quality.Satisfaction,
+	)
+
+	return sendErr
+}
+
+func (c *Client) logDirection(msg string, q voice.Quality) {
+	c.logger.Info(msg,
+		"lost", q.Lost,
+		"late", q.Late,
+		"packet_loss", q.PacketLoss,
+		"mouth_to_ear_delay", q.Delay,
+		"r_factor", q.R,
+		"mos", q.MOS,
+		"satisfaction", q.Satisfaction,
+	)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/joho/godotenv"
+)
+
+type Application struct {
+	logger *slog.Logger
+}
+
+func NewApplication(log *slog.Logger) *Application {
+	return &Application{
+		logger: log,
+	}
+}
+
+func (a *Application) Start(ctx context.Context) error {
+	if err := godotenv.Load(); err != nil {
+		a.logger.Debug("load .env file", "error", err)
+	}
+
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+
+	a.logger.Info("Loaded configuration", "host", cfg.Host, "port", cfg.Port, "interval", cfg.Interval)
+
+	addr := net.JoinHostPort(cfg.Host, fmt.Sprintf("%d", cfg.Port))
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("resolve address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("start UDP server: %w", err)
+	}
+
+	// A small socket buffer drops packets in bursts, which would show up as network loss
+	if err = conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+		a.logger.Warn("Failed to set socket read buffer", "size", cfg.ReadBuffer, "error", err)
+	}
+
+	a.logger.Info("UDP server started", "address", addr)
+
+	srv := NewServer(Params{
+		Logger: a.logger,
+		Cfg:    cfg,
+		Conn:   conn,
+	})
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		if err := srv.Start(ctx); err != nil {
+			a.logger.Error("Server failed", "error", err)
+			cancel()
+		}
+	}()
+
+	go func() {
+		if err := startMetricsWebServer(cfg); err != nil {
+			a.logger.Error("Failed to start metrics web server", "error", err)
+			cancel()
+		}
+	}()
+
+	<-ctx.Done()
+
+	srv.Stop()
+	a.logger.Info("Application shutdown complete")
+	return nil
+}
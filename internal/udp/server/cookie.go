@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/udp"
+)
+
+// cookieLifetime is how long a cookie is at least accepted after it was handed out.
+const cookieLifetime = 30 * time.Second
+
+// cookieJar hands out cookies that prove a client receives at its address. Cookies are
+// derived from the address and the time, so the server keeps no state for clients that
+// never come back.
+type cookieJar struct {
+	secret []byte
+}
+
+func newCookieJar() *cookieJar {
+	secret := make([]byte, sha256.Size)
+	_, _ = rand.Read(secret)
+
+	return &cookieJar{secret: secret}
+}
+
+func (j *cookieJar) issue(addr *net.UDPAddr, now time.Time) []byte {
+	return j.cookie(addr, now.Unix()/int64(cookieLifetime.Seconds()))
+}
+
+// valid accepts cookies of the current and the previous lifetime.
+func (j *cookieJar) valid(cookie []byte, addr *net.UDPAddr, now time.Time) bool {
+	epoch := now.Unix() / int64(cookieLifetime.Seconds())
+
+	return hmac.Equal(cookie, j.cookie(addr, epoch)) || hmac.Equal(cookie, j.cookie(addr, epoch-1))
+}
+
+func (j *cookieJar) cookie(addr *net.UDPAddr, epoch int64) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(addr.String()))
+	_ = binary.Write(mac, binary.BigEndian, epoch)
+
+	return mac.Sum(nil)[:udp.CookieSize]
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	packetsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "udp_server_packets_received_total",
+		Help: "Total number of probe packets received from clients.",
+	})
+
+	bytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "udp_server_bytes_received_total",
+		Help: "Total number of bytes received from clients.",
+	})
+
+	packetsEchoed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "udp_server_packets_echoed_total",
+		Help: "Total number of echo packets sent back to clients.",
+	})
+
+	packetsLost = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "udp_server_packets_lost_total",
+		Help: "Total number of probe packets that never arrived.",
+	})
+
+	activeFlows = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "udp_server_flows",
+		Help: "Number of client flows the server keeps track of.",
+	})
+
+	rejectedFlows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "udp_server_rejected_flows_total",
+		Help: "Total number of flows refused, by reason: an invalid cookie or the flow limit.",
+	}, []string{"reason"})
+)
+
+func startMetricsWebServer(cfg Config) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(cfg.MetricsAddr, mux)
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/probe"
+	"github.com/yvv4git/speed-test/internal/session"
+	"github.com/yvv4git/speed-test/internal/udp"
+)
+
+var errFlowTimeout = errors.New("flow timed out")
+
+type Server struct {
+	cfg      Config
+	conn     *net.UDPConn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *slog.Logger
+	sessions *session.Registry
+	cookies  *cookieJar
+
+	mu    sync.Mutex
+	flows map[string]*flow
+}
+
+type Config struct {
+	Host        string `env:"UDP_SERVER_HOST" envDefault:"0.0.0.0"`
+	Port        uint16 `env:"UDP_SERVER_PORT" envDefault:"1543"`
+	MetricsAddr string `env:"UDP_SERVER_METRICS_ADDR" envDefault:"0.0.0.0:8080"`
+	ReadBuffer  int    `env:"UDP_SERVER_READ_BUFFER" envDefault:"4194304"`
+
+	Interval       time.Duration `env:"UDP_SERVER_INTERVAL" envDefault:"1s"`
+	FlowTimeout    time.Duration `env:"UDP_SERVER_FLOW_TIMEOUT" envDefault:"10s"`
+	MaxFlows       int           `env:"UDP_SERVER_MAX_FLOWS" envDefault:"1024"`
+	SampleInterval time.Duration `env:"UDP_SERVER_SAMPLE_INTERVAL" envDefault:"1s"`
+}
+
+type Params struct {
+	Cfg    Config
+	Logger *slog.Logger
+	Conn   *net.UDPConn
+}
+
+func NewServer(params Params) *Server {
+	return &Server{
+		cfg:      params.Cfg,
+		logger:   params.Logger,
+		conn:     params.Conn,
+		sessions: session.NewRegistry(),
+		cookies:  newCookieJar(),
+		flows:    make(map[string]*flow),
+	}
+}
+
+func (s *Server) Sessions() *session.Registry {
+	return s.sessions
+}
+
+// flow is the stream of probe packets from one client address.
+type flow struct {
+	addr     *net.UDPAddr
+	sess     *session.Session
+	receiver *probe.Receiver
+	started  time.Time
+	lastSeen time.Time
+
+	// interval is the number of interval reports sent, last the receiver stats at the latest one
+	interval     int
+	last         probe.Stats
+	lastAt       time.Time
+	lostReported uint64
+	finished     bool
+	finalAt      time.Time // when the final report was last sent
+}
+
+// finalReportGap is the least time between two final reports to the same flow. The
+// client repeats its finish until a report arrives, answering every copy would let a
+// flood of 12-byte finishes draw reports of hundreds of bytes.
+const finalReportGap = 100 * time.Millisecond
+
+func (s *Server) Start(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	go s.sessions.Run(s.ctx, s.cfg.SampleInterval)
+
+	s.wg.Add(1)
+	go s.reportIntervals()
+
+	return s.readPackets() // Blocking mode
+}
+
+func (s *Server) readPackets() error {
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				s.logger.Info("UDP server stopped reading packets")
+				return nil
+			default:
+				s.logger.Error("Failed to read UDP packet", "error", err)
+				continue
+			}
+		}
+
+		now := time.Now()
+		if udp.IsHello(buf[:n]) {
+			s.reply(addr, udp.MarshalCookie(s.cookies.issue(addr, now)))
+			continue
+		}
+
+		if cookie, ok := udp.UnmarshalStart(buf[:n]); ok {
+			s.start(addr, cookie, now)
+			continue
+		}
+
+		if sent, ok := udp.UnmarshalFinish(buf[:n]); ok {
+			s.finish(addr, sent, now)
+			continue
+		}
+
+		// Path MTU probes are answered right away and belong to no flow
+		if seq, ok := udp.UnmarshalMTUProbe(buf[:n]); ok {
+			s.reply(addr, udp.MarshalAck(seq, n))
+			continue
+		}
+
+		packet, echo := udp.UnmarshalEcho(buf[:n])
+		if !echo {
+			if packet, err = probe.Unmarshal(buf[:n]); err != nil {
+				continue
+			}
+		}
+
+		f := s.flow(addr, now)
+		if f == nil {
+			continue
+		}
+
+		f.receiver.Add(packet.Seq, n, now.Sub(time.Unix(0, packet.SentAt)))
+		f.sess.AddReceived(n)
+
+		packetsReceived.Inc()
+		bytesReceived.Add(float64(n))
+
+		if echo {
+			s.echo(addr, buf[:n], now)
+		}
+	}
+}
+
+// flow returns the flow of addr. Packets from addresses that did not start a flow, or
+// arriving after the client finished, belong to no flow and flow returns nil.
+func (s *Server) flow(addr *net.UDPAddr, now time.Time) *flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.flows[addr.String()]
+	if !ok || f.finished {
+		return nil
+	}
+
+	f.lastSeen = now
+	return f
+}
+
+// start begins the flow of a client that returned a valid cookie, and acknowledges it.
+// The client repeats the message until the acknowledgement arrives.
+func (s *Server) start(addr *net.UDPAddr, cookie []byte, now time.Time) {
+	if !s.cookies.valid(cookie, addr, now) {
+		rejectedFlows.WithLabelValues("cookie").Inc()
+		s.logger.Debug("Invalid cookie", "remote_addr", addr.String())
+		return
+	}
+
+	s.mu.Lock()
+	key := addr.String()
+	f, ok := s.flows[key]
+	if ok && f.finished {
+		s.mu.Unlock()
+		return
+	}
+
+	if !ok {
+		if len(s.flows) >= s.cfg.MaxFlows {
+			s.mu.Unlock()
+			rejectedFlows.WithLabelValues("limit").Inc()
+			s.logger.Warn("Too many UDP flows", "remote_addr", key, "max_flows", s.cfg.MaxFlows)
+			return
+		}
+
+		sess, _ := s.sessions.Start(s.ctx, session.Params{
+			Protocol:   "udp",
+			RemoteAddr: key,
+			Identity:   auth.Anonymous,
+		})
+
+		f = &flow{
+			addr:     addr,
+			sess:     sess,
+			receiver: probe.NewReceiver(),
+			started:  now,
+			lastAt:   now,
+		}
+		s.flows[key] = f
+		activeFlows.Inc()
+
+		s.logger.Info("New UDP flow", "session_id", sess.ID(), "remote_addr", key)
+	}
+	f.lastSeen = now
+	s.mu.Unlock()
+
+	s.reply(addr, udp.MarshalStart(cookie))
+}
+
+// finish answers the client's finish message with the final report. The client repeats
+// the message until a report arrives, so copies are answered too, at most one every
+// finalReportGap.
+func (s *Server) finish(addr *net.UDPAddr, sent uint64, now time.Time) {
+	s.mu.Lock()
+	f, ok := s.flows[addr.String()]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	first := !f.finished
+	if !first && now.Sub(f.finalAt) < finalReportGap {
+		s.mu.Unlock()
+		return
+	}
+	f.finished = true
+	f.lastSeen = now
+	f.finalAt = now
+
+	// The client's count is not trusted beyond what the receiver can account for
+	sent = min(sent, f.receiver.End()+probe.Window)
+
+	stats := f.receiver.Stats(sent)
+	report := udp.Report{
+		SessionID:  f.sess.ID(),
+		Final:      true,
+		Interval:   f.interval,
+		EndSeconds: now.Sub(f.started).Seconds(),
+		Stats:      stats,
+	}
+
+	if first && stats.Lost > f.lostReported {
+		packetsLost.Add(float64(stats.Lost - f.lostReported))
+		f.lostReported = stats.Lost
+	}
+	s.mu.Unlock()
+
+	s.send(addr, report)
+
+	if first {
+		s.sessions.Finish(f.sess, nil)
+		s.logger.Info("UDP flow finished", "session_id", f.sess.ID(), "remote_addr", addr.String(),
+			"sent", stats.Sent, "received", stats.Received, "lost", stats.Lost, "loss_ratio", stats.LossRatio,
+			"reordered", stats.Reordered, "duplicates", stats.Duplicates, "jitter_ms", stats.JitterMs)
+	}
+}
+
+// reportIntervals sends every active flow the stats of the last interval and drops
+// flows that went quiet.
+func (s *Server) reportIntervals() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reportInterval(now)
+		}
+	}
+}
+
+func (s *Server) reportInterval(now time.Time) {
+	type pending struct {
+		addr   *net.UDPAddr
+		report udp.Report
+	}
+
+	var (
+		reports []pending
+		expired []*flow
+	)
+
+	s.mu.Lock()
+	for key, f := range s.flows {
+		if now.Sub(f.lastSeen) > s.cfg.FlowTimeout {
+			delete(s.flows, key)
+			activeFlows.Dec()
+			if !f.finished {
+				expired = append(expired, f)
+			}
+			continue
+		}
+
+		if f.finished {
+			continue
+		}
+
+		stats := f.receiver.Stats(0)
+		f.interval++
+		reports = append(reports, pending{addr: f.addr, report: udp.Report{
+			SessionID:    f.sess.ID(),
+			Interval:     f.interval,
+			StartSeconds: f.lastAt.Sub(f.started).Seconds(),
+			EndSeconds:   now.Sub(f.started).Seconds(),
+			Stats:        stats.Since(f.last),
+		}})
+
+		if stats.Lost > f.lostReported {
+			packetsLost.Add(float64(stats.Lost - f.lostReported))
+			f.lostReported = stats.Lost
+		}
+		f.last, f.lastAt = stats, now
+	}
+	s.mu.Unlock()
+
+	for _, r := range reports {
+		s.send(r.addr, r.report)
+	}
+
+	for _, f := range expired {
+		s.sessions.Finish(f.sess, errFlowTimeout)
+		s.logger.Warn("UDP flow timed out before the client finished", "session_id", f.sess.ID(), "remote_addr", f.addr.String())
+	}
+}
+
+// echo sends an echo packet back with the receive time stamped in.
+func (s *Server) echo(addr *net.UDPAddr, packet []byte, now time.Time) {
+	udp.ReflectEcho(packet, now)
+	if _, err := s.conn.WriteToUDP(packet, addr); err != nil {
+		s.logger.Debug("Failed to echo packet", "remote_addr", addr.String(), "error", err)
+		return
+	}
+
+	packetsEchoed.Inc()
+}
+
+// reply sends a control message no larger than the one it answers.
+func (s *Server) reply(addr *net.UDPAddr, message []byte) {
+	if _, err := s.conn.WriteToUDP(message, addr); err != nil {
+		s.logger.Debug("Failed to reply", "remote_addr", addr.String(), "error", err)
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, report udp.Report) {
+	data, err := udp.MarshalReport(report)
+	if err != nil {
+		s.logger.Error("Failed to encode report", "error", err)
+		return
+	}
+
+	if _, err = s.conn.WriteToUDP(data, addr); err != nil {
+		s.logger.Error("Failed to send report", "remote_addr", addr.String(), "error", err)
+	}
+}
+
+func (s *Server) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			s.logger.Error("Failed to close UDP socket", "error", err)
+		}
+	}
+
+	s.wg.Wait()
+	s.logger.Info("UDP server stopped")
+}
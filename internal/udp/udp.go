@@ -0,0 +1,214 @@
+package udp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/yvv4git/speed-test/internal/probe"
+)
+
+// Control messages share the port with the probe packets and start with a magic of
+// their own: finish(4) | sent(8) from the client, report(4) | JSON from the server.
+// Echo packets are probe packets the server sends back: echo(4) | probe header | padding.
+// Path MTU probes are answered with a small ack: mtu(4) | seq(8) | padding from the
+// client, ack(4) | seq(8) | size(4) from the server.
+//
+// Before a flow starts the client proves it receives at its address, so that a spoofed
+// packet cannot point reports at someone else: hello(4) | padding(16) is answered with
+// cookie(4) | cookie(16), which the client returns as start(4) | cookie(16). The server
+// acknowledges a start with the same message. No reply is larger than its request.
+var (
+	finishMagic = []byte("STPF")
+	reportMagic = []byte("STPR")
+	echoMagic   = []byte("STPE")
+	mtuMagic    = []byte("STPM")
+	ackMagic    = []byte("STPK")
+	helloMagic  = []byte("STPH")
+	cookieMagic = []byte("STPC")
+	startMagic  = []byte("STPS")
+)
+
+// CookieSize is the size of the cookie the server hands out in reply to a hello.
+const CookieSize = 16
+
+const (
+	finishSize    = 4 + 8
+	ackSize       = 4 + 8 + 4
+	handshakeSize = 4 + CookieSize
+)
+
+// MTUProbeHeaderSize is the smallest path MTU probe, as large as the ack that answers it.
+const MTUProbeHeaderSize = ackSize
+
+// EchoHeaderSize is the smallest echo packet.
+const EchoHeaderSize = 4 + probe.HeaderSize
+
+var ErrInvalidMessage = errors.New("invalid control message")
+
+// Report describes what the server received from a flow. The server sends one for every
+// interval and, with Final set, one for the whole test in reply to the client's finish.
+type Report struct {
+	SessionID    string      `json:"session_id"`
+	Final        bool        `json:"final"`
+	Interval     int         `json:"interval"`
+	StartSeconds float64     `json:"start_seconds"`
+	EndSeconds   float64     `json:"end_seconds"`
+	Stats        probe.Stats `json:"stats"`
+}
+
+// Mbps is the receive rate over the report's time span.
+func (r Report) Mbps() float64 {
+	seconds := r.EndSeconds - r.StartSeconds
+	if seconds <= 0 {
+		return 0
+	}
+
+	return float64(r.Stats.Bytes) * 8 / seconds / 1e6
+}
+
+// MarshalFinish tells the server the client is done after sending sent packets.
+func MarshalFinish(sent uint64) []byte {
+	buf := make([]byte, finishSize)
+	copy(buf, finishMagic)
+	binary.BigEndian.PutUint64(buf[4:], sent)
+
+	return buf
+}
+
+// UnmarshalFinish reports false when buf is not a finish message.
+func UnmarshalFinish(buf []byte) (uint64, bool) {
+	if len(buf) != finishSize || string(buf[:4]) != string(finishMagic) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(buf[4:]), true
+}
+
+func MarshalReport(r Report) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, reportMagic...), data...), nil
+}
+
+func UnmarshalReport(buf []byte) (Report, error) {
+	if len(buf) < len(reportMagic) || string(buf[:4]) != string(reportMagic) {
+		return Report{}, ErrInvalidMessage
+	}
+
+	var r Report
+	if err := json.Unmarshal(buf[4:], &r); err != nil {
+		return Report{}, err
+	}
+
+	return r, nil
+}
+
+// MarshalEcho writes an echo packet header into the beginning of buf, which must hold
+// at least EchoHeaderSize bytes.
+func MarshalEcho(buf []byte, p probe.Packet) {
+	copy(buf, echoMagic)
+	p.Marshal(buf[4:])
+}
+
+// UnmarshalEcho reports false when buf is not an echo packet.
+func UnmarshalEcho(buf []byte) (probe.Packet, bool) {
+	if len(buf) < EchoHeaderSize || string(buf[:4]) != string(echoMagic) {
+		return probe.Packet{}, false
+	}
+
+	p, err := probe.Unmarshal(buf[4:])
+	return p, err == nil
+}
+
+// ReflectEcho stamps the receive time into an echo packet in place.
+func ReflectEcho(buf []byte, at time.Time) {
+	probe.Reflect(buf[4:], at)
+}
+
+// MarshalMTUProbe writes a path MTU probe header into the beginning of buf, which must
+// hold at least MTUProbeHeaderSize bytes.
+func MarshalMTUProbe(buf []byte, seq uint64) {
+	copy(buf, mtuMagic)
+	binary.BigEndian.PutUint64(buf[4:], seq)
+}
+
+// UnmarshalMTUProbe reports false when buf is not a path MTU probe.
+func UnmarshalMTUProbe(buf []byte) (uint64, bool) {
+	if len(buf) < MTUProbeHeaderSize || string(buf[:4]) != string(mtuMagic) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(buf[4:]), true
+}
+
+// MarshalAck acknowledges path MTU probe seq that arrived with size bytes.
+func MarshalAck(seq uint64, size int) []byte {
+	buf := make([]byte, ackSize)
+	copy(buf, ackMagic)
+	binary.BigEndian.PutUint64(buf[4:], seq)
+	binary.BigEndian.PutUint32(buf[12:], uint32(size))
+
+	return buf
+}
+
+// UnmarshalAck reports false when buf is not an ack.
+func UnmarshalAck(buf []byte) (seq uint64, size int, ok bool) {
+	if len(buf) != ackSize || string(buf[:4]) != string(ackMagic) {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint64(buf[4:]), int(binary.BigEndian.Uint32(buf[12:])), true
+}
+
+// MarshalHello asks the server for a cookie. It is padded to the size of the reply.
+func MarshalHello() []byte {
+	buf := make([]byte, handshakeSize)
+	copy(buf, helloMagic)
+
+	return buf
+}
+
+// IsHello reports whether buf is a hello.
+func IsHello(buf []byte) bool {
+	return len(buf) == handshakeSize && string(buf[:4]) == string(helloMagic)
+}
+
+func MarshalCookie(cookie []byte) []byte {
+	return marshalHandshake(cookieMagic, cookie)
+}
+
+// UnmarshalCookie reports false when buf is not a cookie.
+func UnmarshalCookie(buf []byte) ([]byte, bool) {
+	return unmarshalHandshake(cookieMagic, buf)
+}
+
+// MarshalStart asks the server to start a flow, returning the cookie it handed out.
+func MarshalStart(cookie []byte) []byte {
+	return marshalHandshake(startMagic, cookie)
+}
+
+// UnmarshalStart reports false when buf is not a start message.
+func UnmarshalStart(buf []byte) ([]byte, bool) {
+	return unmarshalHandshake(startMagic, buf)
+}
+
+func marshalHandshake(magic, cookie []byte) []byte {
+	buf := make([]byte, handshakeSize)
+	copy(buf, magic)
+	copy(buf[4:], cookie)
+
+	return buf
+}
+
+func unmarshalHandshake(magic, buf []byte) ([]byte, bool) {
+	if len(buf) != handshakeSize || string(buf[:4]) != string(magic) {
+		return nil, false
+	}
+
+	return buf[4:], true
+}
@@ -0,0 +1,142 @@
+package voice
+
+import (
+	"slices"
+	"time"
+)
+
+// Arrival is a voice packet as seen by the receiver.
+type Arrival struct {
+	Seq uint64
+	// Transit is the arrival time minus the send timestamp. A constant offset between
+	// the clocks of the hosts does not matter.
+	Transit time.Duration
+}
+
+// JitterBuffer is a fixed playout buffer. It plays every packet Depth after the
+// fastest packet of the call would have arrived, which is where a well-tuned
+// buffer settles, and discards packets that arrive later than that.
+type JitterBuffer struct {
+	Depth time.Duration
+}
+
+// Late returns the sequence numbers of the arrivals the buffer discards.
+func (b JitterBuffer) Late(arrivals []Arrival) map[uint64]bool {
+	if len(arrivals) == 0 {
+		return nil
+	}
+
+	fastest := slices.MinFunc(arrivals, func(a, b Arrival) int {
+		return int(a.Transit - b.Transit)
+	}).Transit
+
+	late := make(map[uint64]bool)
+	for _, a := range arrivals {
+		if a.Transit-fastest > b.Depth {
+			late[a.Seq] = true
+		}
+	}
+
+	return late
+}
+
+// BurstRatio estimates BurstR of G.107 from which of sent packets were played. It
+// fits a two-state Markov model to the loss pattern and compares its mean burst
+// length with that of random loss at the same rate.
+func BurstRatio(sent uint64, played func(seq uint64) bool) float64 {
+	var (
+		receivedRuns, lostRuns uint64 // packets followed by another one
+		toLost, toReceived     uint64 // state changes
+	)
+
+	for seq := uint64(1); seq < sent; seq++ {
+		prev, cur := played(seq-1), played(seq)
+		switch {
+		case prev && !cur:
+			receivedRuns++
+			toLost++
+		case prev:
+			receivedRuns++
+		case cur:
+			lostRuns++
+			toReceived++
+		default:
+			lostRuns++
+		}
+	}
+
+	if receivedRuns == 0 || lostRuns == 0 {
+		return 1
+	}
+
+	p := float64(toLost) / float64(receivedRuns)
+	q := float64(toReceived) / float64(lostRuns)
+	if p+q == 0 {
+		return 1
+	}
+
+	return 1 / (p + q)
+}
+
+// Leg is one direction of a call.
+type Leg struct {
+	Sent uint64
+	// Lost is the number of packets lost in the network.
+	Lost uint64
+	// Arrivals are the packets whose transit time is known, at most Sent - Lost.
+	Arrivals []Arrival
+	// Delay is the one-way network delay.
+	Delay time.Duration
+	// BurstRatio of the network losses, zero to estimate it from the arrivals.
+	BurstRatio float64
+}
+
+// Call configures the simulated call.
+type Call struct {
+	Codec  Codec
+	PTime  time.Duration // audio per packet
+	Buffer JitterBuffer
+}
+
+// Quality is the rating of one direction of a call.
+type Quality struct {
+	Lost         uint64        `json:"lost"`
+	Late         uint64        `json:"late"`
+	PacketLoss   float64       `json:"packet_loss"`
+	BurstRatio   float64       `json:"burst_ratio"`
+	Delay        time.Duration `json:"mouth_to_ear_delay"`
+	R            float64       `json:"r_factor"`
+	MOS          float64       `json:"mos"`
+	Satisfaction string        `json:"satisfaction"`
+}
+
+// Evaluate plays leg through the jitter buffer and rates what the listener hears.
+func (c Call) Evaluate(leg Leg) Quality {
+	late := c.Buffer.Late(leg.Arrivals)
+
+	arrived := make(map[uint64]bool, len(leg.Arrivals))
+	for _, a := range leg.Arrivals {
+		arrived[a.Seq] = true
+	}
+
+	q := Quality{
+		Lost:       leg.Lost,
+		Late:       uint64(len(late)),
+		BurstRatio: leg.BurstRatio,
+		Delay:      leg.Delay + c.Buffer.Depth + c.PTime + c.Codec.Lookahead,
+	}
+
+	if q.BurstRatio <= 0 {
+		q.BurstRatio = BurstRatio(leg.Sent, func(seq uint64) bool { return arrived[seq] && !late[seq] })
+	}
+
+	if leg.Sent > 0 {
+		q.PacketLoss = min(float64(q.Lost+q.Late)/float64(leg.Sent), 1)
+	}
+
+	q.R = RFactor(c.Codec, Impairments{Delay: q.Delay, PacketLoss: q.PacketLoss, BurstRatio: q.BurstRatio})
+	q.MOS = MOS(q.R)
+	q.Satisfaction = Satisfaction(q.R)
+
+	return q
+}
@@ -0,0 +1,138 @@
+package voice
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// RTPHeaderSize is added to the codec payload to get the size of a voice packet.
+const RTPHeaderSize = 12
+
+// Codec describes a voice codec for the E-model. Ie and Bpl are the equipment
+// impairment factor and packet-loss robustness factor of ITU-T G.113 Appendix I.
+type Codec struct {
+	Name      string
+	Bitrate   int // bits per second of the payload
+	Lookahead time.Duration
+	Ie        float64
+	Bpl       float64
+}
+
+var codecs = map[string]Codec{
+	// With packet loss concealment
+	"g711": {Name: "g711", Bitrate: 64000, Ie: 0, Bpl: 25.1},
+	"g729": {Name: "g729", Bitrate: 8000, Lookahead: 5 * time.Millisecond, Ie: 11, Bpl: 19},
+}
+
+// LookupCodec returns the codec called name, g711 or g729. Only codecs with
+// impairment factors in G.113 are supported.
+func LookupCodec(name string) (Codec, error) {
+	codec, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec %q", name)
+	}
+
+	return codec, nil
+}
+
+// PacketSize is the RTP packet size for frames of ptime.
+func (c Codec) PacketSize(ptime time.Duration) int {
+	return RTPHeaderSize + int(int64(c.Bitrate)*int64(ptime)/int64(8*time.Second))
+}
+
+// Impairments are the transport conditions of one direction of a call.
+type Impairments struct {
+	// Delay is the mouth-to-ear delay: network, jitter buffer, packetization and lookahead.
+	Delay time.Duration
+	// PacketLoss is the ratio of packets the decoder did not get, lost or too late to play.
+	PacketLoss float64
+	// BurstRatio is 1 for random loss and larger when losses come in bursts.
+	BurstRatio float64
+}
+
+// G.107 default values for everything the network does not affect.
+const (
+	ro   = 94.77 // basic signal-to-noise ratio
+	is   = 1.41  // simultaneous impairments
+	telr = 65    // talker echo loudness rating, dB
+	wepl = 110   // weighted echo path loss, dB
+)
+
+// RFactor is the transmission rating of ITU-T G.107 for the codec under imp. It
+// ranges from 0 to about 93 for narrowband calls.
+func RFactor(codec Codec, imp Impairments) float64 {
+	ta := float64(imp.Delay) / float64(time.Millisecond)
+
+	r := ro - is - delayImpairment(ta) - effectiveEquipmentImpairment(codec, imp)
+	return math.Max(r, 0)
+}
+
+// delayImpairment is Id for an absolute delay of ta milliseconds, assuming the echo
+// path delay matches it and the round trip is twice as long.
+func delayImpairment(ta float64) float64 {
+	// Talker echo
+	terv := telr - 40*math.Log10((1+ta/10)/(1+ta/150)) + 6*math.Exp(-0.3*ta*ta)
+	re := 80 + 2.5*(terv-14)
+	// Roe equals Ro with the default loudness ratings
+	idte := ((ro-re)/2 + math.Sqrt((ro-re)*(ro-re)/4+100) - 1) * (1 - math.Exp(-ta))
+
+	// Listener echo
+	rle := 10.5 * (wepl + 7) * math.Pow(2*ta+1, -0.25)
+	idle := (ro-rle)/2 + math.Sqrt((ro-rle)*(ro-rle)/4+169)
+
+	// Too long absolute delay
+	var idd float64
+	if ta > 100 {
+		x := math.Log2(ta / 100)
+		idd = 25 * (math.Pow(1+math.Pow(x, 6), 1.0/6) - 3*math.Pow(1+math.Pow(x/3, 6), 1.0/6) + 2)
+	}
+
+	return idte + idle + idd
+}
+
+// effectiveEquipmentImpairment is Ie-eff, the codec impairment raised by packet loss.
+func effectiveEquipmentImpairment(codec Codec, imp Impairments) float64 {
+	ppl := imp.PacketLoss * 100
+	if ppl <= 0 {
+		return codec.Ie
+	}
+
+	burstR := imp.BurstRatio
+	if burstR <= 0 {
+		burstR = 1
+	}
+
+	return codec.Ie + (95-codec.Ie)*ppl/(ppl/burstR+codec.Bpl)
+}
+
+// MOS estimates the mean opinion score, 1 to 4.5, of a call rated r (G.107 Annex B).
+func MOS(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	default:
+		return 1 + 0.035*r + r*(r-60)*(100-r)*7e-6
+	}
+}
+
+// Satisfaction is the user satisfaction of G.107 Annex B for a call rated r.
+func Satisfaction(r float64) string {
+	switch {
+	case r >= 90:
+		return "very satisfied"
+	case r >= 80:
+		return "satisfied"
+	case r >= 70:
+		return "some users dissatisfied"
+	case r >= 60:
+		return "many users dissatisfied"
+	case r >= 50:
+		return "nearly all users dissatisfied"
+	default:
+		return "not recommended"
+	}
+}
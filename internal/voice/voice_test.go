@@ -0,0 +1,73 @@
+package voice
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRFactor(t *testing.T) {
+	g711, g729 := codecs["g711"], codecs["g729"]
+
+	tests := []struct {
+		name  string
+		codec Codec
+		imp   Impairments
+		want  float64
+	}{
+		// G.107 default values give R = 93.2
+		{name: "default", codec: g711, want: 93.2},
+		{name: "g729 without loss", codec: g729, want: 93.2 - 11},
+		// Ie-eff = 95 * 1 / (1 + 25.1)
+		{name: "g711 random loss", codec: g711, imp: Impairments{PacketLoss: 0.01, BurstRatio: 1}, want: 89.57},
+		{name: "g711 bursty loss", codec: g711, imp: Impairments{PacketLoss: 0.01, BurstRatio: 2}, want: 89.50},
+		// Id = 3.8 at 150ms, mostly talker echo
+		{name: "150ms delay", codec: g711, imp: Impairments{Delay: 150 * time.Millisecond}, want: 89.54},
+		// Ie-eff = 95 * 100 / (100 + 25.1)
+		{name: "total loss", codec: g711, imp: Impairments{PacketLoss: 1, BurstRatio: 1}, want: 17.27},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RFactor(tt.codec, tt.imp); math.Abs(got-tt.want) > 0.05 {
+				t.Errorf("RFactor() = %.2f, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMOS(t *testing.T) {
+	tests := []struct {
+		r    float64
+		want float64
+	}{
+		{r: -5, want: 1},
+		{r: 0, want: 1},
+		{r: 50, want: 2.58},
+		{r: 60, want: 3.10},
+		{r: 70, want: 3.60},
+		{r: 80, want: 4.02},
+		{r: 90, want: 4.34},
+		{r: 93.2, want: 4.41},
+		{r: 100, want: 4.5},
+		{r: 120, want: 4.5},
+	}
+
+	for _, tt := range tests {
+		if got := MOS(tt.r); math.Abs(got-tt.want) > 0.005 {
+			t.Errorf("MOS(%v) = %.3f, want %.2f", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestLookupCodec(t *testing.T) {
+	for _, name := range []string{"g711", "G729"} {
+		if _, err := LookupCodec(name); err != nil {
+			t.Errorf("LookupCodec(%q) error = %v", name, err)
+		}
+	}
+
+	if _, err := LookupCodec("opus"); err == nil {
+		t.Error("LookupCodec(\"opus\") succeeded, G.113 has no impairment factors for it")
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
 )
 
 type Application struct {
@@ -33,6 +35,37 @@ func (a *Application) Start(ctx context.Context) error {
 		return fmt.Errorf("parse config: %w", err)
 	}
 
+	dialer, err := NewDialer(cfg)
+	if err != nil {
+		return fmt.Errorf("create TLS config: %w", err)
+	}
+
+	switch cfg.AuthMode {
+	case auth.ModeNone, auth.ModeToken:
+	case auth.ModeHMAC:
+		if cfg.AuthIdentity == "" {
+			return fmt.Errorf("parse config: %q authentication needs an identity", auth.ModeHMAC)
+		}
+	default:
+		return fmt.Errorf("parse config: %w: %q", auth.ErrUnknownMode, cfg.AuthMode)
+	}
+
+	if (cfg.Mux || cfg.Reverse) && cfg.MuxWindow == 0 {
+		return fmt.Errorf("parse config: %w: 0", mux.ErrInvalidWindow)
+	}
+
+	if cfg.TLSInsecure {
+		a.logger.Warn("TLS verification is disabled, the connection can be intercepted")
+	}
+
+	if cfg.Reverse {
+		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		a.logger.Info("Starting reverse tunnel", "url", cfg.ReverseURL, "port", cfg.ReversePort, "forward_to", cfg.ReverseTarget)
+		return RunReverse(ctx, dialer, cfg, a.logger)
+	}
+
 	addr := fmt.Sprintf("%s:%d", cfg.LocalBindHost, cfg.LocalBindPort)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -43,11 +76,20 @@ func (a *Application) Start(ctx context.Context) error {
 	a.logger.Info("Listening for local TCP connections",
 		slog.String("addr", addr),
 		slog.String("forward_to_ws", cfg.WebSocketURL),
+		slog.String("target", cfg.Target),
 	)
 
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	var pool *Pool
+	if cfg.Mux {
+		pool = NewPool(PoolParams{Cfg: cfg, Dialer: dialer, Logger: a.logger})
+		defer pool.Close()
+
+		a.logger.Info("Multiplexing tunnels", "websockets", cfg.MuxSessions, "window", cfg.MuxWindow)
+	}
+
 	go func() {
 		<-ctx.Done()
 		listener.Close()
@@ -64,6 +106,11 @@ func (a *Application) Start(ctx context.Context) error {
 			continue
 		}
 
-		go HandleLocalConnection(ctx, conn, cfg, a.logger)
+		if pool != nil {
+			go HandleMuxConnection(ctx, conn, pool, cfg, a.logger)
+			continue
+		}
+
+		go HandleLocalConnection(ctx, conn, dialer, cfg, a.logger)
 	}
 }
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff spaces out reconnect attempts, doubling the delay after every failure up to
+// a maximum. Delays are jittered so that clients cut off together do not reconnect in
+// lockstep.
+type backoff struct {
+	initial, limit time.Duration
+	next           time.Duration
+}
+
+func newBackoff(initial, limit time.Duration) *backoff {
+	return &backoff{initial: initial, limit: max(initial, limit)}
+}
+
+// Next returns the delay before the next attempt.
+func (b *backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.initial
+	}
+
+	delay := b.next
+	b.next = min(2*b.next, b.limit)
+
+	// Between half and all of the delay
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Reset starts over from the minimum delay after a successful attempt.
+func (b *backoff) Reset() {
+	b.next = 0
+}
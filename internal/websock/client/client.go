@@ -5,8 +5,15 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/auth"
+	"github.com/yvv4git/speed-test/internal/tlsconf"
+	"github.com/yvv4git/speed-test/internal/websock/keepalive"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
 )
 
 type Config struct {
@@ -14,13 +21,98 @@ type Config struct {
 	LocalBindPort uint16 `env:"WEB_CLIENT_BIND_PORT" envDefault:"1234"`
 	WebSocketURL  string `env:"WEB_CLIENT_WS_URL" envDefault:"ws://localhost:80/tunnel"`
 	BufSize       uint16 `env:"WEB_CLIENT_BUF_SIZE" envDefault:"1024"`
+	// Target is the host:port the server forwards to, empty for the server's default
+	Target string `env:"WEB_CLIENT_TARGET" envDefault:""`
+
+	Mux         bool   `env:"WEB_CLIENT_MUX" envDefault:"false"`
+	MuxSessions uint16 `env:"WEB_CLIENT_MUX_SESSIONS" envDefault:"1"`
+	MuxWindow   uint32 `env:"WEB_CLIENT_MUX_WINDOW" envDefault:"262144"`
+
+	// A tunnel is closed when nothing arrives within PongTimeout after a ping
+	PingInterval time.Duration `env:"WEB_CLIENT_PING_INTERVAL" envDefault:"30s"`
+	PongTimeout  time.Duration `env:"WEB_CLIENT_PONG_TIMEOUT" envDefault:"10s"`
+	WriteTimeout time.Duration `env:"WEB_CLIENT_WRITE_TIMEOUT" envDefault:"10s"`
+	// ConnectTimeout bounds how long a local connection waits for its tunnel
+	ConnectTimeout time.Duration `env:"WEB_CLIENT_CONNECT_TIMEOUT" envDefault:"30s"`
+	// Reconnect redials multiplexed WebSockets and reverse tunnels that were lost,
+	// waiting from ReconnectMin up to ReconnectMax between attempts
+	Reconnect    bool          `env:"WEB_CLIENT_RECONNECT" envDefault:"true"`
+	ReconnectMin time.Duration `env:"WEB_CLIENT_RECONNECT_MIN" envDefault:"1s"`
+	ReconnectMax time.Duration `env:"WEB_CLIENT_RECONNECT_MAX" envDefault:"30s"`
+
+	// TLS settings apply to wss:// URLs
+	TLSCAFile     string   `env:"WEB_CLIENT_TLS_CA"`
+	TLSPins       []string `env:"WEB_CLIENT_TLS_PINS" envSeparator:","`
+	TLSServerName string   `env:"WEB_CLIENT_TLS_SERVER_NAME"`
+	TLSInsecure   bool     `env:"WEB_CLIENT_TLS_INSECURE" envDefault:"false"`
+	TLSCertFile   string   `env:"WEB_CLIENT_TLS_CERT"`
+	TLSKeyFile    string   `env:"WEB_CLIENT_TLS_KEY"`
+
+	// AuthKey is the bearer token in token mode and the secret of AuthIdentity in HMAC
+	// mode, where every dial signs the URL for AuthURLTTL
+	AuthMode     auth.Mode     `env:"WEB_CLIENT_AUTH_MODE" envDefault:"none"`
+	AuthKey      string        `env:"WEB_CLIENT_AUTH_KEY"`
+	AuthIdentity string        `env:"WEB_CLIENT_AUTH_IDENTITY"`
+	AuthURLTTL   time.Duration `env:"WEB_CLIENT_AUTH_URL_TTL" envDefault:"1m"`
+	// Origin is sent with the upgrade request, for servers that only accept listed origins
+	Origin string `env:"WEB_CLIENT_ORIGIN"`
+
+	// Reverse registers at ReverseURL instead of listening locally. The server listens on
+	// ReversePort, or a port it picks when it is 0, and the client forwards the
+	// connections to ReverseTarget.
+	Reverse       bool   `env:"WEB_CLIENT_REVERSE" envDefault:"false"`
+	ReverseURL    string `env:"WEB_CLIENT_REVERSE_URL" envDefault:"ws://localhost:80/reverse"`
+	ReversePort   uint16 `env:"WEB_CLIENT_REVERSE_PORT" envDefault:"0"`
+	ReverseTarget string `env:"WEB_CLIENT_REVERSE_TARGET" envDefault:"127.0.0.1:8000"`
 }
 
-func HandleLocalConnection(ctx context.Context, conn net.Conn, cfg Config, logger *slog.Logger) {
+// NewDialer returns a WebSocket dialer that verifies wss:// servers as cfg describes,
+// presents the configured client certificate and gives up after the connect timeout.
+func NewDialer(cfg Config) (*websocket.Dialer, error) {
+	tlsConfig, err := tlsconf.NewClientConfig(tlsconf.ClientParams{
+		CAFile:     cfg.TLSCAFile,
+		Pins:       cfg.TLSPins,
+		ServerName: cfg.TLSServerName,
+		Insecure:   cfg.TLSInsecure,
+		CertFile:   cfg.TLSCertFile,
+		KeyFile:    cfg.TLSKeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	dialer.HandshakeTimeout = cfg.ConnectTimeout
+
+	return &dialer, nil
+}
+
+func HandleLocalConnection(ctx context.Context, conn net.Conn, dialer *websocket.Dialer, cfg Config, logger *slog.Logger) {
 	defer conn.Close()
 
-	wsConn, _, err := websocket.DefaultDialer.DialContext(ctx, cfg.WebSocketURL, nil)
+	// Multiplexed tunnels send the target with every stream instead
+	var params url.Values
+	if cfg.Target != "" {
+		params = url.Values{"target": {cfg.Target}}
+	}
+
+	wsURL, header, err := tunnelRequest(cfg, cfg.WebSocketURL, params)
 	if err != nil {
+		logger.Error("Invalid WebSocket URL", "error", err)
+		return
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	wsConn, resp, err := dialer.DialContext(dialCtx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			logger.Error("WebSocket dial error", "status", resp.Status, "error", err)
+			return
+		}
+
 		logger.Error("WebSocket dial error", "error", err)
 		return
 	}
@@ -28,6 +120,9 @@ func HandleLocalConnection(ctx context.Context, conn net.Conn, cfg Config, logge
 
 	logger.Info("New tunnel opened", "to", cfg.WebSocketURL, "from", conn.RemoteAddr())
 
+	alive := keepalive.Start(wsConn, cfg.keepalive())
+	defer alive.Stop()
+
 	errCh := make(chan error, 2)
 
 	go func() {
@@ -42,8 +137,8 @@ func HandleLocalConnection(ctx context.Context, conn net.Conn, cfg Config, logge
 					errCh <- err
 					return
 				}
-				if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					errCh <- err
+				if err := alive.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					errCh <- keepalive.Cause(err)
 					return
 				}
 			}
@@ -58,9 +153,10 @@ func HandleLocalConnection(ctx context.Context, conn net.Conn, cfg Config, logge
 			default:
 				_, msg, err := wsConn.ReadMessage()
 				if err != nil {
-					errCh <- err
+					errCh <- keepalive.Cause(err)
 					return
 				}
+				alive.Received()
 				if _, err := conn.Write(msg); err != nil {
 					errCh <- err
 					return
@@ -77,3 +173,69 @@ func HandleLocalConnection(ctx context.Context, conn net.Conn, cfg Config, logge
 		}
 	}
 }
+
+// HandleMuxConnection forwards conn as a stream over one of the pool's WebSockets
+// instead of dialing a WebSocket of its own.
+func HandleMuxConnection(ctx context.Context, conn net.Conn, pool *Pool, cfg Config, logger *slog.Logger) {
+	defer conn.Close()
+
+	openCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	stream, err := pool.Open(openCtx, cfg.Target)
+	if err != nil {
+		logger.Error("Failed to open mux stream", "error", err)
+		return
+	}
+
+	logger.Info("New tunnel stream opened", "stream", stream.ID(), "from", conn.RemoteAddr())
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset("client shutting down")
+		conn.Close()
+	})
+	defer stop()
+
+	if err = mux.Relay(stream, conn, int(cfg.BufSize), nil, nil); err != nil && ctx.Err() == nil {
+		logger.Warn("Connection error", "stream", stream.ID(), "error", err)
+	}
+}
+
+func (cfg Config) keepalive() keepalive.Config {
+	return keepalive.Config{
+		PingInterval: cfg.PingInterval,
+		PongTimeout:  cfg.PongTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+}
+
+// tunnelRequest returns rawURL with params added to the query and the headers of the
+// upgrade request.
+func tunnelRequest(cfg Config, rawURL string, params url.Values) (string, http.Header, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(params) > 0 {
+		query := u.Query()
+		for key, values := range params {
+			query[key] = values
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	header := http.Header{}
+	if cfg.Origin != "" {
+		header.Set("Origin", cfg.Origin)
+	}
+
+	switch cfg.AuthMode {
+	case auth.ModeToken:
+		header.Set("Authorization", "Bearer "+cfg.AuthKey)
+	case auth.ModeHMAC:
+		auth.SignURL(u, cfg.AuthIdentity, cfg.AuthKey, time.Now().Add(cfg.AuthURLTTL))
+	}
+
+	return u.String(), header, nil
+}
@@ -0,0 +1,305 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
+)
+
+// Pool keeps up to a fixed number of multiplexed WebSockets open and spreads streams
+// over them. WebSockets are dialed on demand and, with reconnects enabled, redialed
+// in the background once they are lost, backing off while the server is unreachable.
+// Dials run without holding the lock, streams keep going to open WebSockets meanwhile.
+type Pool struct {
+	cfg    Config
+	logger *slog.Logger
+	dialer *websocket.Dialer
+
+	// ctx ends background reconnects when the pool is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	dialing  int           // dials in progress
+	dialed   chan struct{} // closed and replaced whenever a dial ends
+	backoff  *backoff
+	retryAt  time.Time // no dial before, after a failed one
+	dialErr  error     // of the last failed dial
+}
+
+type PoolParams struct {
+	Cfg    Config
+	Dialer *websocket.Dialer
+	Logger *slog.Logger
+}
+
+func NewPool(params PoolParams) *Pool {
+	dialer := *params.Dialer
+	dialer.Subprotocols = []string{mux.Subprotocol}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Pool{
+		cfg:     params.Cfg,
+		logger:  params.Logger,
+		dialer:  &dialer,
+		ctx:     ctx,
+		cancel:  cancel,
+		dialed:  make(chan struct{}),
+		backoff: newBackoff(params.Cfg.ReconnectMin, params.Cfg.ReconnectMax),
+	}
+}
+
+// Open starts a stream on the least busy WebSocket. While the pool is not full another
+// WebSocket is dialed, in the background unless the pool is empty. With reconnects
+// enabled Open waits for the server to become reachable until ctx is done.
+func (p *Pool) Open(ctx context.Context, target string) (*mux.Stream, error) {
+	session, err := p.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.Open(target)
+}
+
+func (p *Pool) session(ctx context.Context) (*mux.Session, error) {
+	for {
+		p.mu.Lock()
+		p.prune()
+
+		dial := p.canDial()
+		if dial {
+			p.dialing++
+		}
+
+		if len(p.sessions) > 0 {
+			least := p.sessions[0]
+			for _, s := range p.sessions[1:] {
+				if s.NumStreams() < least.NumStreams() {
+					least = s
+				}
+			}
+			p.mu.Unlock()
+
+			if dial {
+				go p.connect(p.ctx)
+			}
+
+			return least, nil
+		}
+
+		if dial {
+			p.mu.Unlock()
+
+			session, err := p.connect(ctx)
+			if err == nil {
+				return session, nil
+			}
+
+			if !p.cfg.Reconnect {
+				return nil, err
+			}
+			continue
+		}
+
+		wait, dialErr, dialed := time.Until(p.retryAt), p.dialErr, p.dialed
+		p.mu.Unlock()
+
+		if err := p.wait(ctx, wait, dialed); err != nil {
+			if dialErr == nil {
+				return nil, fmt.Errorf("wait for WebSocket: %w", err)
+			}
+
+			return nil, fmt.Errorf("wait for WebSocket: %w: %w", err, dialErr)
+		}
+	}
+}
+
+// reconnect refills the pool after a WebSocket was lost.
+func (p *Pool) reconnect() {
+	for {
+		p.mu.Lock()
+		p.prune()
+
+		if len(p.sessions)+p.dialing >= p.size() {
+			p.mu.Unlock()
+			return
+		}
+
+		if p.canDial() {
+			p.dialing++
+			p.mu.Unlock()
+
+			if _, err := p.connect(p.ctx); err == nil {
+				return
+			}
+			continue
+		}
+
+		wait, dialed := time.Until(p.retryAt), p.dialed
+		p.mu.Unlock()
+
+		if p.wait(p.ctx, wait, dialed) != nil {
+			return
+		}
+	}
+}
+
+// watch starts a reconnect once session is lost.
+func (p *Pool) watch(session *mux.Session) {
+	select {
+	case <-p.ctx.Done():
+		return
+	case <-session.Done():
+	}
+
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	p.logger.Warn("Multiplexed WebSocket lost", "reason", session.Err(), "reconnect", p.cfg.Reconnect)
+
+	if p.cfg.Reconnect {
+		p.reconnect()
+	}
+}
+
+// connect dials a WebSocket and adds it to the pool, or schedules the next attempt.
+// The caller counted the dial in p.dialing and does not hold p.mu.
+func (p *Pool) connect(ctx context.Context) (*mux.Session, error) {
+	session, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+
+	// The pool was closed during the dial
+	if p.ctx.Err() != nil {
+		if err == nil {
+			session.Close()
+		}
+		return nil, p.ctx.Err()
+	}
+
+	if err != nil {
+		delay := p.backoff.Next()
+		p.retryAt, p.dialErr = time.Now().Add(delay), err
+
+		p.logger.Warn("Failed to dial WebSocket", "error", err, "retry_in", delay)
+		return nil, err
+	}
+
+	p.backoff.Reset()
+	p.retryAt, p.dialErr = time.Time{}, nil
+	p.sessions = append(p.sessions, session)
+
+	go p.watch(session)
+
+	return session, nil
+}
+
+// canDial reports whether the pool has room beside the dials in progress and, with
+// reconnects enabled, the backoff after a failed dial has passed. The caller holds p.mu.
+func (p *Pool) canDial() bool {
+	if len(p.sessions)+p.dialing >= p.size() {
+		return false
+	}
+
+	return !p.cfg.Reconnect || !time.Now().Before(p.retryAt)
+}
+
+// prune forgets WebSockets that closed. The caller holds p.mu.
+func (p *Pool) prune() {
+	open := p.sessions[:0]
+	for _, s := range p.sessions {
+		if s.Err() == nil {
+			open = append(open, s)
+		}
+	}
+	p.sessions = open
+}
+
+func (p *Pool) size() int {
+	return max(int(p.cfg.MuxSessions), 1)
+}
+
+// wait returns after d, or once a dial ends when d has already passed, since the pool
+// is then waiting for dials in progress.
+func (p *Pool) wait(ctx context.Context, d time.Duration, dialed <-chan struct{}) error {
+	var expired <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-expired:
+		return nil
+	case <-dialed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) dial(ctx context.Context) (*mux.Session, error) {
+	wsURL, header, err := tunnelRequest(p.cfg, p.cfg.WebSocketURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %w", err)
+	}
+	mux.SetWindow(header, p.cfg.MuxWindow)
+
+	ws, resp, err := p.dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial WebSocket: %s: %w", resp.Status, err)
+		}
+
+		return nil, fmt.Errorf("dial WebSocket: %w", err)
+	}
+
+	if ws.Subprotocol() != mux.Subprotocol {
+		ws.Close()
+		return nil, fmt.Errorf("server does not support multiplexing")
+	}
+
+	peerWindow, err := mux.PeerWindow(resp.Header)
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("dial WebSocket: %w", err)
+	}
+
+	p.logger.Info("Multiplexed WebSocket opened", "url", p.cfg.WebSocketURL)
+
+	return mux.NewSession(mux.Params{
+		Conn:       ws,
+		Client:     true,
+		Window:     p.cfg.MuxWindow,
+		PeerWindow: peerWindow,
+		Keepalive:  p.cfg.keepalive(),
+		Logger:     p.logger,
+	}), nil
+}
+
+// Close closes every WebSocket of the pool and stops reconnecting.
+func (p *Pool) Close() {
+	p.cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+}
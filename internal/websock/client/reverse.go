@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
+)
+
+// RunReverse registers a reverse tunnel and forwards every stream the server opens to
+// cfg.ReverseTarget until ctx is done. With reconnects enabled a lost tunnel is
+// registered again, otherwise RunReverse returns once the WebSocket closes.
+func RunReverse(ctx context.Context, dialer *websocket.Dialer, cfg Config, logger *slog.Logger) error {
+	retry := newBackoff(cfg.ReconnectMin, cfg.ReconnectMax)
+	for {
+		registered, err := serveReverse(ctx, dialer, cfg, logger)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !cfg.Reconnect {
+			return err
+		}
+
+		if registered {
+			retry.Reset()
+		}
+
+		delay := retry.Next()
+		logger.Warn("Reverse tunnel lost", "error", err, "retry_in", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// serveReverse runs one registration of the reverse tunnel and reports whether the
+// server accepted it.
+func serveReverse(ctx context.Context, dialer *websocket.Dialer, cfg Config, logger *slog.Logger) (bool, error) {
+	params := url.Values{"port": {strconv.Itoa(int(cfg.ReversePort))}}
+	wsURL, header, err := tunnelRequest(cfg, cfg.ReverseURL, params)
+	if err != nil {
+		return false, fmt.Errorf("invalid WebSocket URL: %w", err)
+	}
+	mux.SetWindow(header, cfg.MuxWindow)
+
+	muxDialer := *dialer
+	muxDialer.Subprotocols = []string{mux.Subprotocol}
+
+	ws, resp, err := muxDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return false, fmt.Errorf("dial WebSocket: %s: %w", resp.Status, err)
+		}
+
+		return false, fmt.Errorf("dial WebSocket: %w", err)
+	}
+
+	if ws.Subprotocol() != mux.Subprotocol {
+		ws.Close()
+		return false, fmt.Errorf("server does not support multiplexing")
+	}
+
+	peerWindow, err := mux.PeerWindow(resp.Header)
+	if err != nil {
+		ws.Close()
+		return false, fmt.Errorf("dial WebSocket: %w", err)
+	}
+
+	session := mux.NewSession(mux.Params{
+		Conn:       ws,
+		Client:     true,
+		Window:     cfg.MuxWindow,
+		PeerWindow: peerWindow,
+		Keepalive:  cfg.keepalive(),
+		Logger:     logger,
+	})
+	defer session.Close()
+
+	logger.Info("Reverse tunnel registered",
+		"public_addr", resp.Header.Get(mux.ReverseAddressHeader),
+		"forward_to", cfg.ReverseTarget,
+	)
+
+	stop := context.AfterFunc(ctx, func() {
+		session.Close()
+	})
+	defer stop()
+
+	for {
+		stream, errAccept := session.Accept()
+		if errAccept != nil {
+			break
+		}
+
+		go handleReverseStream(ctx, stream, cfg, logger)
+	}
+
+	return true, fmt.Errorf("reverse tunnel closed: %w", session.Err())
+}
+
+func handleReverseStream(ctx context.Context, stream *mux.Stream, cfg Config, logger *slog.Logger) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.ReverseTarget)
+	if err != nil {
+		logger.Error("TCP dial error", "target", cfg.ReverseTarget, "error", err)
+		stream.Reset(fmt.Sprintf("dial %s failed", cfg.ReverseTarget))
+		return
+	}
+	defer conn.Close()
+
+	logger.Info("New reverse stream opened", "stream", stream.ID(), "forward_to", cfg.ReverseTarget)
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset("client shutting down")
+		conn.Close()
+	})
+	defer stop()
+
+	if err = mux.Relay(stream, conn, int(cfg.BufSize), nil, nil); err != nil && ctx.Err() == nil {
+		logger.Warn("Connection error", "stream", stream.ID(), "error", err)
+	}
+}
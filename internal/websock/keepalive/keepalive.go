@@ -0,0 +1,114 @@
+package keepalive
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrDeadPeer = errors.New("peer stopped responding")
+
+// Config controls how a WebSocket is kept alive.
+type Config struct {
+	// PingInterval is how often a ping is sent, 0 disables pings and the read deadline.
+	PingInterval time.Duration
+	// PongTimeout is how long after a missed ping the peer is given up. Any message
+	// from the peer counts as an answer, not only pongs.
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write, 0 for no bound.
+	WriteTimeout time.Duration
+}
+
+// Keepalive pings a WebSocket and fails its reads once the peer stops responding, so
+// that a dead proxy or an expired NAT mapping does not leave the tunnel hanging.
+type Keepalive struct {
+	ws  *websocket.Conn
+	cfg Config
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start sets up the keepalive of ws. The caller reads ws and calls Received for every
+// message, and stops the keepalive when it is done with ws.
+func Start(ws *websocket.Conn, cfg Config) *Keepalive {
+	k := &Keepalive{
+		ws:   ws,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+
+	if cfg.PingInterval <= 0 {
+		return k
+	}
+
+	ws.SetPongHandler(func(string) error {
+		k.Received()
+		return nil
+	})
+	k.Received()
+
+	go k.ping()
+
+	return k
+}
+
+// Received pushes the read deadline back after the peer showed it is alive.
+func (k *Keepalive) Received() {
+	if k.cfg.PingInterval > 0 {
+		_ = k.ws.SetReadDeadline(time.Now().Add(k.cfg.PingInterval + k.cfg.PongTimeout))
+	}
+}
+
+// WriteMessage writes a data message within the write timeout.
+func (k *Keepalive) WriteMessage(messageType int, data []byte) error {
+	if k.cfg.WriteTimeout > 0 {
+		if err := k.ws.SetWriteDeadline(time.Now().Add(k.cfg.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+
+	return k.ws.WriteMessage(messageType, data)
+}
+
+func (k *Keepalive) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.done)
+	})
+}
+
+func (k *Keepalive) ping() {
+	ticker := time.NewTicker(k.cfg.PingInterval)
+	defer ticker.Stop()
+
+	timeout := k.cfg.WriteTimeout
+	if timeout <= 0 {
+		timeout = k.cfg.PongTimeout
+	}
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			// WriteControl may run concurrently with data writes
+			if err := k.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Cause explains errors of reads and writes that timed out by a dead peer.
+func Cause(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrDeadPeer, err)
+	}
+
+	return err
+}
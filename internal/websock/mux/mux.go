@@ -0,0 +1,322 @@
+package mux
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/websock/keepalive"
+)
+
+// Subprotocol is negotiated during the WebSocket upgrade to switch the tunnel from
+// one TCP connection per WebSocket to multiplexed streams.
+const Subprotocol = "speedtest-mux.v1"
+
+// ReverseAddressHeader carries the public address of a reverse tunnel in the response
+// to the WebSocket upgrade.
+const ReverseAddressHeader = "Speedtest-Reverse-Address"
+
+// WindowHeader advertises the receive window of the streams of each end during the
+// WebSocket upgrade: the client's in the request, the server's in the response. A
+// stream sends at most the peer's window before it waits for a window update.
+const WindowHeader = "Speedtest-Mux-Window"
+
+// DefaultWindow is the receive window of peers that advertise none.
+const DefaultWindow = 256 << 10
+
+// Every frame is one binary WebSocket message: type(1) | stream id(4) | payload.
+const (
+	frameOpen   byte = 1 // payload: requested target, empty for the default
+	frameData   byte = 2
+	frameClose  byte = 3 // the sender sends no more data on the stream
+	frameReset  byte = 4 // payload: reason, the stream is aborted in both directions
+	frameWindow byte = 5 // payload: uint32 number of bytes the receiver consumed
+)
+
+const headerSize = 1 + 4
+
+// maxFramePayload caps the data carried by one frame.
+const maxFramePayload = 32 << 10
+
+// closeTimeout bounds the wait for the close message to be sent.
+const closeTimeout = time.Second
+
+// acceptBacklog is the number of opened streams waiting for Accept. Streams opened
+// beyond it are reset.
+const acceptBacklog = 128
+
+var (
+	ErrSessionClosed = errors.New("mux session closed")
+	ErrStreamClosed  = errors.New("mux stream closed")
+	ErrStreamReset   = errors.New("mux stream reset")
+	ErrInvalidWindow = errors.New("invalid mux window")
+)
+
+// SetWindow advertises window in the upgrade header.
+func SetWindow(header http.Header, window uint32) {
+	header.Set(WindowHeader, strconv.FormatUint(uint64(window), 10))
+}
+
+// PeerWindow returns the window the peer advertised in its upgrade header.
+func PeerWindow(header http.Header) (uint32, error) {
+	value := header.Get(WindowHeader)
+	if value == "" {
+		return DefaultWindow, nil
+	}
+
+	window, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || window == 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidWindow, value)
+	}
+
+	return uint32(window), nil
+}
+
+// Session carries many streams over one WebSocket. Both ends may open streams, the
+// client uses odd stream IDs and the server even ones.
+type Session struct {
+	ws         *websocket.Conn
+	keepalive  *keepalive.Keepalive
+	window     uint32 // of this end, enforced on received data
+	peerWindow uint32 // of the peer, what a stream may send ahead
+	logger     *slog.Logger
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accepts   chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type Params struct {
+	Conn *websocket.Conn
+	// Client selects the stream ID space of this end.
+	Client bool
+	// Window is the number of bytes this end buffers per stream, the peer waits for it
+	// to consume them before it sends more. It must be positive.
+	Window uint32
+	// PeerWindow is the window the peer advertised, zero when it uses Window as well.
+	PeerWindow uint32
+	Keepalive  keepalive.Config
+	Logger     *slog.Logger
+}
+
+func NewSession(params Params) *Session {
+	s := &Session{
+		ws:         params.Conn,
+		keepalive:  keepalive.Start(params.Conn, params.Keepalive),
+		window:     params.Window,
+		peerWindow: cmp.Or(params.PeerWindow, params.Window),
+		logger:     params.Logger,
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		accepts:    make(chan *Stream, acceptBacklog),
+		done:       make(chan struct{}),
+	}
+	if params.Client {
+		s.nextID = 1
+	}
+
+	go s.readFrames()
+
+	return s
+}
+
+// Open starts a stream to target. The peer resets it when it cannot reach the target,
+// which surfaces on the next Read or Write.
+func (s *Session) Open(target string) (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	id := s.nextID
+	s.nextID += 2
+
+	stream := newStream(s, id, target)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, []byte(target)); err != nil {
+		stream.terminate(err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accepts:
+		return stream, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams is the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is the reason the session closed, nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close closes the WebSocket and aborts every stream.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.keepalive.Stop()
+
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.terminate(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+		}
+
+		// WriteControl may run concurrently with a blocked frame write
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = s.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeTimeout))
+		_ = s.ws.Close()
+
+		close(s.done)
+
+		if s.logger != nil {
+			s.logger.Debug("Mux session closed", "reason", err, "streams", len(streams))
+		}
+	})
+}
+
+func (s *Session) readFrames() {
+	for {
+		kind, data, err := s.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(keepalive.Cause(err))
+			return
+		}
+		s.keepalive.Received()
+
+		if kind != websocket.BinaryMessage || len(data) < headerSize {
+			s.closeWithError(errors.New("malformed mux frame"))
+			return
+		}
+
+		frame, id, payload := data[0], binary.BigEndian.Uint32(data[1:]), data[headerSize:]
+		if frame == frameOpen {
+			s.accept(id, string(payload))
+			continue
+		}
+
+		s.mu.Lock()
+		stream := s.streams[id]
+		s.mu.Unlock()
+
+		// Frames of streams that were just reset may still be in flight
+		if stream == nil {
+			continue
+		}
+
+		switch frame {
+		case frameData:
+			if !stream.receive(payload) {
+				stream.Reset("flow control window exceeded")
+			}
+		case frameClose:
+			stream.receiveClose()
+		case frameReset:
+			stream.terminate(fmt.Errorf("%w: %s", ErrStreamReset, payload))
+		case frameWindow:
+			if len(payload) == 4 {
+				stream.grow(binary.BigEndian.Uint32(payload))
+			}
+		}
+	}
+}
+
+// accept registers a stream the peer opened and queues it for Accept.
+func (s *Session) accept(id uint32, target string) {
+	s.mu.Lock()
+	if _, exists := s.streams[id]; exists || id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		_ = s.writeFrame(frameReset, id, []byte("invalid stream id"))
+		return
+	}
+
+	stream := newStream(s, id, target)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.accepts <- stream:
+	default:
+		stream.Reset("too many streams waiting to be accepted")
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(frame byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+
+	message := make([]byte, headerSize+len(payload))
+	message[0] = frame
+	binary.BigEndian.PutUint32(message[1:], id)
+	copy(message[headerSize:], payload)
+
+	if err := s.keepalive.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		// The WebSocket is unusable after a failed write
+		go s.closeWithError(keepalive.Cause(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newPair connects a client and a server session over a real WebSocket, each end
+// with its own receive window.
+func newPair(t *testing.T, clientWindow, serverWindow uint32) (*Session, *Session) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{Subprotocol}}
+	servers := make(chan *Session, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerWindow, err := PeerWindow(r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		header := http.Header{}
+		SetWindow(header, serverWindow)
+		ws, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+
+		servers <- NewSession(Params{Conn: ws, Window: serverWindow, PeerWindow: peerWindow})
+	}))
+	t.Cleanup(httpServer.Close)
+
+	header := http.Header{}
+	SetWindow(header, clientWindow)
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	peerWindow, err := PeerWindow(resp.Header)
+	if err != nil {
+		t.Fatalf("peer window: %v", err)
+	}
+
+	client := NewSession(Params{Conn: ws, Client: true, Window: clientWindow, PeerWindow: peerWindow})
+	server := <-servers
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func accept(t *testing.T, session *Session) *Stream {
+	t.Helper()
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, err := session.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		accepted <- stream
+	}()
+
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream accepted")
+		return nil
+	}
+}
+
+func TestPeerWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    uint32
+		wantErr bool
+	}{
+		{name: "missing", value: "", want: DefaultWindow},
+		{name: "valid", value: "1024", want: 1024},
+		{name: "largest", value: "4294967295", want: 1<<32 - 1},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "negative", value: "-1", wantErr: true},
+		{name: "too large", value: "4294967296", wantErr: true},
+		{name: "not a number", value: "lots", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set(WindowHeader, tt.value)
+			}
+
+			got, err := PeerWindow(header)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidWindow) {
+					t.Fatalf("PeerWindow() error = %v, want %v", err, ErrInvalidWindow)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Fatalf("PeerWindow() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		size   int
+	}{
+		{name: "default target", size: 1},
+		{name: "one frame", target: "db.internal:5432", size: maxFramePayload},
+		{name: "several frames", target: "10.0.0.1:22", size: 3*maxFramePayload + 7},
+	}
+
+	client, server := newPair(t, DefaultWindow, DefaultWindow)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.Open(tt.target)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+
+			// Client streams are odd, the server's even
+			if want := uint32(2*i + 1); stream.ID() != want {
+				t.Errorf("stream ID = %d, want %d", stream.ID(), want)
+			}
+
+			peer := accept(t, server)
+			if peer.ID() != stream.ID() || peer.Target() != tt.target {
+				t.Fatalf("accepted stream %d to %q, want %d to %q", peer.ID(), peer.Target(), stream.ID(), tt.target)
+			}
+
+			data := bytes.Repeat([]byte{byte(i + 1)}, tt.size)
+			go func() {
+				_, _ = stream.Write(data)
+				_ = stream.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(peer)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, %v, want %d", len(got), err, len(data))
+			}
+		})
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientWindow uint32
+		serverWindow uint32
+	}{
+		{name: "same windows", clientWindow: 64 << 10, serverWindow: 64 << 10},
+		// The client must not send more than the server buffers
+		{name: "larger client window", clientWindow: 1 << 20, serverWindow: 16 << 10},
+		{name: "smaller client window", clientWindow: 16 << 10, serverWindow: 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newPair(t, tt.clientWindow, tt.serverWindow)
+
+			stream, err := client.Open("")
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			peer := accept(t, server)
+
+			// The server does not read yet, the write stalls once its window is full
+			data := bytes.Repeat([]byte("x"), int(tt.serverWindow)+1)
+			written := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(data)
+				written <- err
+			}()
+
+			select {
+			case err := <-written:
+				t.Fatalf("write of more than the peer's window returned early: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+
+			if err := <-written; err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		})
+	}
+}
+
+func TestWindowExceeded(t *testing.T) {
+	client, server := newPair(t, 4096, 4096)
+
+	stream, err := client.Open("")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	accept(t, server)
+
+	// A peer ignoring flow control gets the stream reset
+	if err = client.writeFrame(frameData, stream.ID(), make([]byte, 4097)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+
+	if _, err = stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("read error = %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	client, server := newPair(t, DefaultWindow, DefaultWindow)
+
+	stream, err := client.Open("")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	peer := accept(t, server)
+
+	if _, err = stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = stream.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+
+	if _, err = stream.Write([]byte("more")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("write after CloseWrite error = %v, want %v", err, ErrStreamClosed)
+	}
+
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("server read %q, %v, want ping", got, err)
+	}
+
+	// The other direction stays open until the server closes it too
+	if _, err = peer.Write([]byte("pong")); err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+	if err = peer.Close(); err != nil {
+		t.Fatalf("server close: %v", err)
+	}
+
+	got, err = io.ReadAll(stream)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("client read %q, %v, want pong", got, err)
+	}
+
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Fatalf("open streams = %d and %d after both sides closed, want 0", client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestMalformedFrame(t *testing.T) {
+	client, server := newPair(t, DefaultWindow, DefaultWindow)
+
+	client.writeMu.Lock()
+	err := client.ws.WriteMessage(websocket.BinaryMessage, []byte{frameData, 0, 0})
+	client.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session survived a truncated frame header")
+	}
+}
@@ -0,0 +1,69 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Relay copies between stream and conn in both directions until both are done and
+// passes half closes on. The callbacks, if set, see the bytes written to conn and to
+// stream as they go. It returns the first error other than a clean end of data.
+func Relay(stream *Stream, conn net.Conn, bufSize int, toConn, toStream func(n int)) error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		err := copyCounted(conn, stream, bufSize, toConn)
+		if tcp, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+			_ = tcp.CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	go func() {
+		err := copyCounted(stream, conn, bufSize, toStream)
+		if err == nil {
+			_ = stream.CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	// The first failure aborts both directions
+	err := <-errCh
+	if err != nil {
+		stream.Reset(err.Error())
+		_ = conn.Close()
+		<-errCh
+		return err
+	}
+
+	err = <-errCh
+	_ = stream.Close()
+	_ = conn.Close()
+
+	return err
+}
+
+func copyCounted(dst io.Writer, src io.Reader, bufSize int, count func(n int)) error {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, errWrite := dst.Write(buf[:n]); errWrite != nil {
+				return errWrite
+			}
+
+			if count != nil {
+				count(n)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
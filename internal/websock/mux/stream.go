@@ -0,0 +1,216 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Stream is one logical connection of a Session. Like a TCP connection it can be
+// half-closed with CloseWrite, after which the peer reads io.EOF.
+type Stream struct {
+	id      uint32
+	target  string
+	session *Session
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	received     bytes.Buffer
+	consumed     uint32 // bytes read since the last window update
+	remoteClosed bool
+	localClosed  bool
+	sendWindow   uint32
+	err          error // set when the stream is reset or the session closes
+}
+
+func newStream(session *Session, id uint32, target string) *Stream {
+	s := &Stream{
+		id:         id,
+		target:     target,
+		session:    session,
+		sendWindow: session.peerWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Target is what the opener asked to be connected to, empty for the default.
+func (s *Stream) Target() string {
+	return s.target
+}
+
+// Read reads data the peer sent, io.EOF once the peer closed its side.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.received.Len() == 0 && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.received.Len() == 0 {
+		err := s.err
+		if err == nil {
+			err = io.EOF
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n, _ := s.received.Read(p)
+
+	// Grant the peer more credit once half of the window has been consumed
+	var update uint32
+	s.consumed += uint32(n)
+	if s.consumed >= s.session.window/2 {
+		update, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], update)
+		_ = s.session.writeFrame(frameWindow, s.id, payload[:])
+	}
+
+	return n, nil
+}
+
+// Write sends p, waiting whenever the peer's window is used up.
+func (s *Stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.err == nil && !s.localClosed {
+			s.cond.Wait()
+		}
+
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+
+		if s.localClosed {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(len(p), int(s.sendWindow), maxFramePayload)
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.session.writeFrame(frameData, s.id, p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data follows. Reading goes on until the peer
+// closes its side as well.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localClosed || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.session.writeFrame(frameClose, s.id, nil)
+	if done {
+		s.session.remove(s.id)
+	}
+
+	return err
+}
+
+// Close closes the stream. It is a clean close when the peer has closed its side and
+// everything it sent was read, otherwise the stream is reset.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	clean := s.remoteClosed && s.received.Len() == 0
+	s.mu.Unlock()
+
+	if !clean {
+		s.Reset("closed")
+		return nil
+	}
+
+	return s.CloseWrite()
+}
+
+// Reset aborts the stream in both directions and tells the peer why.
+func (s *Stream) Reset(reason string) {
+	if s.terminate(ErrStreamClosed) {
+		_ = s.session.writeFrame(frameReset, s.id, []byte(reason))
+	}
+}
+
+// terminate fails pending and future reads and writes with err. It reports false when
+// the stream was already over.
+func (s *Stream) terminate(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil || (s.localClosed && s.remoteClosed) {
+		return false
+	}
+
+	s.err = err
+	s.cond.Broadcast()
+	s.session.remove(s.id)
+
+	return true
+}
+
+// receive buffers data from the peer. It reports false when the peer sent more than
+// the window allows.
+func (s *Stream) receive(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil || s.remoteClosed {
+		return true
+	}
+
+	if uint32(s.received.Len()+len(data)) > s.session.window {
+		return false
+	}
+
+	s.received.Write(data)
+	s.cond.Broadcast()
+
+	return true
+}
+
+func (s *Stream) receiveClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	done := s.localClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.session.remove(s.id)
+	}
+}
+
+func (s *Stream) grow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yvv4git/speed-test/internal/auth"
+)
+
+var (
+	ErrTooManyTunnels    = errors.New("too many tunnels")
+	ErrTooManyListeners  = errors.New("too many reverse listeners")
+	ErrTooManyWebSockets = errors.New("too many multiplexed WebSockets")
+)
+
+// admit checks the origin and the credentials of a request for a tunnel and returns
+// the identity, or false after answering the request.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !s.upgrader.CheckOrigin(r) {
+		s.logger.Warn("Rejected tunnel origin", "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return "", false
+	}
+
+	identity, ok := s.authorize(r)
+	if !ok {
+		s.logger.Warn("Rejected unauthenticated tunnel", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return identity, true
+}
+
+// authorize returns the identity of a tunnel request. Token mode expects an
+// Authorization: Bearer header, HMAC mode a URL signed with auth.SignURL, which
+// browsers can use as well since they cannot set headers on WebSockets.
+func (s *Server) authorize(r *http.Request) (string, bool) {
+	if !s.auth.Enabled() {
+		return auth.Anonymous, true
+	}
+
+	identity, ok := "", false
+	switch s.auth.Mode() {
+	case auth.ModeToken:
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found {
+			identity, ok = s.auth.VerifyToken(token)
+		}
+	case auth.ModeHMAC:
+		identity, ok = s.auth.VerifyURL(r.URL, time.Now())
+	}
+
+	if !ok {
+		authAttempts.WithLabelValues("", "denied").Inc()
+		return "", false
+	}
+
+	authAttempts.WithLabelValues(identity, "ok").Inc()
+	return identity, true
+}
+
+// originChecker accepts the listed origins, * accepts any. Without a list only
+// requests without an Origin header, which are not sent by browsers, and same-origin
+// requests pass.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	origins := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		origins[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || origins["*"] || origins[strings.ToLower(origin)] {
+			return true
+		}
+
+		if len(origins) > 0 {
+			return false
+		}
+
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// tunnelLimits caps the number of tunnels, reverse listeners or multiplexed WebSockets
+// an identity keeps open at the same time.
+type tunnelLimits struct {
+	fallback int            // for identities without a limit of their own, 0 for none
+	limits   map[string]int // per identity
+	exceeded error
+	gauge    *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func newTunnelLimits(fallback int, limits map[string]int, exceeded error, gauge *prometheus.GaugeVec) *tunnelLimits {
+	return &tunnelLimits{
+		fallback: fallback,
+		limits:   limits,
+		exceeded: exceeded,
+		gauge:    gauge,
+		open:     make(map[string]int),
+	}
+}
+
+// acquire reserves a tunnel for identity. Every successful acquire must be followed by
+// a release.
+func (l *tunnelLimits) acquire(identity string) error {
+	limit, ok := l.limits[identity]
+	if !ok {
+		limit = l.fallback
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit > 0 && l.open[identity] >= limit {
+		return fmt.Errorf("%w: %s has %d open", l.exceeded, identity, limit)
+	}
+
+	l.open[identity]++
+	l.gauge.WithLabelValues(identity).Inc()
+
+	return nil
+}
+
+func (l *tunnelLimits) release(identity string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open[identity]--
+	if l.open[identity] == 0 {
+		delete(l.open, identity)
+	}
+	l.gauge.WithLabelValues(identity).Dec()
+}
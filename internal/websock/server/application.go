@@ -10,6 +10,7 @@ import (
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
+	"github.com/yvv4git/speed-test/internal/accesslog"
 )
 
 type Application struct {
@@ -41,10 +42,28 @@ func (a *Application) Start(ctx context.Context) error {
 
 	srv := NewServer(cfg, a.logger)
 
+	accessLog, err := accesslog.New(accesslog.Config{
+		Path:       cfg.AccessLogPath,
+		MaxSizeMB:  cfg.AccessLogMaxSizeMB,
+		MaxBackups: cfg.AccessLogMaxBackups,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	defer accessLog.Close()
+
+	if accessLog != nil {
+		srv.Sessions().OnFinish(accessLog.SessionFinished)
+		a.logger.Info("Access log enabled", "path", cfg.AccessLogPath)
+	}
+
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	serverDone := make(chan struct{})
 	go func() {
+		defer close(serverDone)
+
 		if err := srv.Start(ctx); err != nil {
 			a.logger.Error("WebSocket server error", "error", err)
 			cancel()
@@ -59,6 +78,9 @@ func (a *Application) Start(ctx context.Context) error {
 	}()
 
 	<-ctx.Done()
+
+	<-serverDone
+	srv.Wait()
 	a.logger.Info("Application shutdown complete")
 	return nil
 }
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/yvv4git/speed-test/internal/metrics"
+)
+
+var (
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_server_auth_attempts_total",
+		Help: "Total number of tunnel authentication attempts.",
+	}, []string{"identity", "result"})
+
+	openTunnels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_server_open_tunnels",
+		Help: "Number of open tunnels, counting every stream of multiplexed WebSockets.",
+	}, []string{"identity"})
+
+	muxWebSockets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_server_mux_websockets",
+		Help: "Number of open multiplexed WebSockets, with or without streams.",
+	}, []string{"identity"})
+
+	rejectedTunnels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_server_rejected_tunnels_total",
+		Help: "Total number of tunnels refused after authentication.",
+	}, []string{"identity", "reason"})
+
+	reverseListeners = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_server_reverse_listeners",
+		Help: "Number of public ports listening for reverse tunnels.",
+	}, []string{"identity"})
+
+	tunnelBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_server_tunnel_bytes_total",
+		Help: "Total number of bytes relayed through tunnels.",
+	}, []string{"identity", "direction"})
+)
+
+func startMetricsWebServer(cfg Config) error {
+	return metrics.StartMetricsWebServer(cfg.MetricsAddr)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/metrics"
+	"github.com/yvv4git/speed-test/internal/session"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
+)
+
+var (
+	ErrPortNotAllowed = errors.New("port not allowed for reverse tunnels")
+	ErrNoFreePort     = errors.New("no free port for reverse tunnels")
+)
+
+// portRange is the inclusive range of ports reverse tunnels listen on.
+type portRange struct {
+	lo, hi uint16
+}
+
+// handleReverse registers a reverse tunnel: the server listens on a public port and
+// opens a stream to the client for every connection, which the client forwards to a
+// service next to it. The client asks for a port with ?port=, or gets the first free one.
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	if s.reverse == nil {
+		http.Error(w, "reverse tunnels are disabled", http.StatusNotFound)
+		return
+	}
+
+	identity, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+
+	if !slices.Contains(websocket.Subprotocols(r), mux.Subprotocol) {
+		http.Error(w, "reverse tunnels need the "+mux.Subprotocol+" subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	peerWindow, err := mux.PeerWindow(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = s.listeners.acquire(identity); err != nil {
+		s.logger.Warn("Rejected reverse tunnel", "remote", r.RemoteAddr, "identity", identity, "error", err)
+		rejectedTunnels.WithLabelValues(identity, "limit").Inc()
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer s.listeners.release(identity)
+
+	listener, err := s.listenReverse(r.URL.Query().Get("port"))
+	if err != nil {
+		s.logger.Warn("Rejected reverse tunnel", "remote", r.RemoteAddr, "identity", identity, "error", err)
+		rejectedTunnels.WithLabelValues(identity, "port").Inc()
+
+		status := http.StatusConflict
+		if errors.Is(err, ErrPortNotAllowed) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer listener.Close()
+
+	publicAddr := listener.Addr().String()
+	header := http.Header{mux.ReverseAddressHeader: {publicAddr}}
+	mux.SetWindow(header, s.cfg.MuxWindow)
+
+	ws, err := s.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		s.logger.Error("WebSocket upgrade error", "error", err)
+		return
+	}
+
+	session := mux.NewSession(mux.Params{
+		Conn:       ws,
+		Window:     s.cfg.MuxWindow,
+		PeerWindow: peerWindow,
+		Keepalive:  s.keepalive(),
+		Logger:     s.logger,
+	})
+	defer session.Close()
+
+	remote := r.RemoteAddr
+	s.logger.Info("Reverse tunnel registered", "remote", remote, "identity", identity, "public_addr", publicAddr,
+		"client_cert", clientCertSubject(r))
+
+	// Accept returns once the listener closes
+	go func() {
+		select {
+		case <-s.ctx.Done():
+		case <-session.Done():
+		}
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveReverseConn(session, conn, identity)
+		}()
+	}
+
+	session.Close()
+	wg.Wait()
+	s.logger.Info("Reverse tunnel closed", "remote", remote, "identity", identity, "public_addr", publicAddr,
+		"reason", session.Err())
+}
+
+// listenReverse listens on the requested port, or on the first free one of the range
+// when none was requested.
+func (s *Server) listenReverse(requested string) (net.Listener, error) {
+	if requested != "" && requested != "0" {
+		port, err := strconv.ParseUint(requested, 10, 16)
+		if err != nil || uint16(port) < s.reverse.lo || uint16(port) > s.reverse.hi {
+			return nil, fmt.Errorf("%w: %s", ErrPortNotAllowed, requested)
+		}
+
+		return net.Listen("tcp", net.JoinHostPort(s.cfg.ReverseHost, requested))
+	}
+
+	for port := int(s.reverse.lo); port <= int(s.reverse.hi); port++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(s.cfg.ReverseHost, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+
+	return nil, ErrNoFreePort
+}
+
+// serveReverseConn forwards a connection to the public port through a new stream.
+func (s *Server) serveReverseConn(tunnel *mux.Session, conn net.Conn, identity string) {
+	defer conn.Close()
+
+	remote := conn.RemoteAddr().String()
+	if err := s.limits.acquire(identity); err != nil {
+		s.logger.Warn("Rejected tunnel", "remote", remote, "identity", identity, "error", err)
+		rejectedTunnels.WithLabelValues(identity, "limit").Inc()
+		return
+	}
+	defer s.limits.release(identity)
+
+	stream, err := tunnel.Open("")
+	if err != nil {
+		s.logger.Warn("Failed to open reverse stream", "remote", remote, "identity", identity, "error", err)
+		return
+	}
+
+	sess, ctx := s.sessions.Start(s.ctx, session.Params{
+		Protocol:   "websocket-reverse",
+		RemoteAddr: remote,
+		Identity:   identity,
+	})
+
+	received := tunnelBytes.WithLabelValues(identity, "received")
+	sent := tunnelBytes.WithLabelValues(identity, "sent")
+
+	// Killing the session aborts the stream
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset("session closed")
+		conn.Close()
+	})
+	defer stop()
+
+	s.logger.Debug("New reverse stream", "remote", remote, "identity", identity, "stream", stream.ID())
+
+	// Received and sent are seen from the tunnel client, as for forward tunnels
+	err = mux.Relay(stream, conn, int(s.cfg.BufSize),
+		func(n int) {
+			metrics.AddBytesReceived(n)
+			metrics.AddBytesSent(n)
+			received.Add(float64(n))
+			sess.AddReceived(n)
+		},
+		func(n int) {
+			metrics.AddBytesReceived(n)
+			metrics.AddBytesSent(n)
+			sent.Add(float64(n))
+			sess.AddSent(n)
+		},
+	)
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+
+	s.sessions.Finish(sess, err)
+}
@@ -2,14 +2,25 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/yvv4git/speed-test/internal/auth"
 	"github.com/yvv4git/speed-test/internal/metrics"
+	"github.com/yvv4git/speed-test/internal/proxyproto"
+	"github.com/yvv4git/speed-test/internal/session"
+	"github.com/yvv4git/speed-test/internal/tlsconf"
+	"github.com/yvv4git/speed-test/internal/websock/keepalive"
+	"github.com/yvv4git/speed-test/internal/websock/mux"
 )
 
 type Config struct {
@@ -19,33 +30,179 @@ type Config struct {
 	PortForwardTo uint16 `env:"WEB_FORWARD_TO_PORT" envDefault:"1544"`
 	BufSize       uint16 `env:"WEB_SERVER_BUF_SIZE" envDefault:"1024"`
 	MetricsAddr   string `env:"WEB_SERVER_METRICS_ADDR" envDefault:"0.0.0.0:8080"`
+	MuxWindow     uint32 `env:"WEB_SERVER_MUX_WINDOW" envDefault:"262144"`
+
+	// A tunnel is closed when nothing arrives within PongTimeout after a ping
+	PingInterval time.Duration `env:"WEB_SERVER_PING_INTERVAL" envDefault:"30s"`
+	PongTimeout  time.Duration `env:"WEB_SERVER_PONG_TIMEOUT" envDefault:"10s"`
+	WriteTimeout time.Duration `env:"WEB_SERVER_WRITE_TIMEOUT" envDefault:"10s"`
+
+	// AllowedTargets are the targets clients may request besides the default one
+	AllowedTargets []string `env:"WEB_SERVER_ALLOWED_TARGETS" envSeparator:","`
+
+	// TLS serves wss:// from the certificate below. Without a certificate file an
+	// ephemeral self-signed one is used.
+	TLS         bool     `env:"WEB_SERVER_TLS" envDefault:"false"`
+	TLSCertFile string   `env:"WEB_SERVER_TLS_CERT"`
+	TLSKeyFile  string   `env:"WEB_SERVER_TLS_KEY"`
+	TLSGenerate bool     `env:"WEB_SERVER_TLS_GENERATE" envDefault:"false"`
+	TLSHosts    []string `env:"WEB_SERVER_TLS_HOSTS" envSeparator:"," envDefault:"localhost,127.0.0.1"`
+	// TLSClientCA requires client certificates issued by these roots (mTLS)
+	TLSClientCA       string `env:"WEB_SERVER_TLS_CLIENT_CA"`
+	TLSClientOptional bool   `env:"WEB_SERVER_TLS_CLIENT_OPTIONAL" envDefault:"false"`
+
+	AuthMode auth.Mode         `env:"WEB_SERVER_AUTH_MODE" envDefault:"none"`
+	AuthKeys map[string]string `env:"WEB_SERVER_AUTH_KEYS" envSeparator:"," envKeyValSeparator:":"`
+	// MaxTunnels caps the open tunnels of each identity, 0 for no limit. IdentityMaxTunnels
+	// overrides it for single identities.
+	MaxTunnels         int            `env:"WEB_SERVER_MAX_TUNNELS" envDefault:"0"`
+	IdentityMaxTunnels map[string]int `env:"WEB_SERVER_IDENTITY_MAX_TUNNELS" envSeparator:"," envKeyValSeparator:":"`
+	// MaxMuxWebSockets caps the multiplexed WebSockets of each identity, 0 for no limit.
+	// Their streams count against MaxTunnels, the WebSockets themselves only here.
+	MaxMuxWebSockets int `env:"WEB_SERVER_MAX_MUX_WEBSOCKETS" envDefault:"8"`
+	// AllowedOrigins are the browser origins that may open tunnels, * for any. Without
+	// them only same-origin requests and clients that send no Origin are accepted.
+	AllowedOrigins []string `env:"WEB_SERVER_ALLOWED_ORIGINS" envSeparator:","`
+
+	// ReversePorts are the ports reverse tunnels may listen on, e.g. 20000-20099. Reverse
+	// tunnels are disabled without them and need authentication. MaxReverseListeners caps
+	// the ports each identity listens on, 0 for no limit.
+	ReverseHost         string `env:"WEB_SERVER_REVERSE_HOST" envDefault:"0.0.0.0"`
+	ReversePorts        string `env:"WEB_SERVER_REVERSE_PORTS"`
+	MaxReverseListeners int    `env:"WEB_SERVER_MAX_REVERSE_LISTENERS" envDefault:"1"`
+
+	ProxyProtocol      bool          `env:"WEB_SERVER_PROXY_PROTOCOL" envDefault:"false"`
+	ProxyTrusted       []string      `env:"WEB_SERVER_PROXY_TRUSTED" envSeparator:","`
+	ProxyHeaderTimeout time.Duration `env:"WEB_SERVER_PROXY_HEADER_TIMEOUT" envDefault:"5s"`
+
+	AccessLogPath       string `env:"WEB_SERVER_ACCESS_LOG"`
+	AccessLogMaxSizeMB  int    `env:"WEB_SERVER_ACCESS_LOG_MAX_SIZE_MB" envDefault:"100"`
+	AccessLogMaxBackups int    `env:"WEB_SERVER_ACCESS_LOG_MAX_BACKUPS" envDefault:"5"`
 }
 
 type Server struct {
-	cfg    Config
-	logger *slog.Logger
+	cfg      Config
+	logger   *slog.Logger
+	ctx      context.Context
+	sessions *session.Registry
+	targets  *allowlist
+	reverse  *portRange
+	auth     *auth.Authenticator
+	limits   *tunnelLimits
+	// listeners caps the public ports of reverse tunnels per identity
+	listeners *tunnelLimits
+	// websockets caps the multiplexed WebSockets per identity, idle ones included
+	websockets *tunnelLimits
+	upgrader   websocket.Upgrader
+	wg         sync.WaitGroup
 }
 
 func NewServer(cfg Config, logger *slog.Logger) *Server {
 	return &Server{
-		cfg:    cfg,
-		logger: logger,
+		cfg:        cfg,
+		logger:     logger,
+		ctx:        context.Background(),
+		sessions:   session.NewRegistry(),
+		limits:     newTunnelLimits(cfg.MaxTunnels, cfg.IdentityMaxTunnels, ErrTooManyTunnels, openTunnels),
+		listeners:  newTunnelLimits(cfg.MaxReverseListeners, nil, ErrTooManyListeners, reverseListeners),
+		websockets: newTunnelLimits(cfg.MaxMuxWebSockets, nil, ErrTooManyWebSockets, muxWebSockets),
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  originChecker(cfg.AllowedOrigins),
+			Subprotocols: []string{mux.Subprotocol},
+		},
 	}
 }
 
+func (s *Server) Sessions() *session.Registry {
+	return s.sessions
+}
+
+// Wait blocks until every open tunnel has been closed. It must be called after Start
+// returned.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
 func (s *Server) Start(ctx context.Context) error {
+	s.ctx = ctx
+
+	if s.cfg.MuxWindow == 0 {
+		return fmt.Errorf("parse config: %w: 0", mux.ErrInvalidWindow)
+	}
+
+	targets, err := parseAllowlist(s.cfg.AllowedTargets)
+	if err != nil {
+		return fmt.Errorf("parse allowed targets: %w", err)
+	}
+	s.targets = targets
+
+	authenticator, err := auth.NewAuthenticator(s.cfg.AuthMode, s.cfg.AuthKeys)
+	if err != nil {
+		return fmt.Errorf("create authenticator: %w", err)
+	}
+	s.auth = authenticator
+
+	if authenticator.Enabled() {
+		s.logger.Info("Tunnel authentication enabled", "mode", authenticator.Mode(), "identities", len(s.cfg.AuthKeys))
+	}
+
+	if s.cfg.ReversePorts != "" {
+		// Anyone could open public ports and relay traffic through the server
+		if !authenticator.Enabled() {
+			return errors.New("reverse tunnels need authentication, set WEB_SERVER_AUTH_MODE")
+		}
+
+		lo, hi, errPorts := parsePorts(s.cfg.ReversePorts)
+		if errPorts != nil {
+			return fmt.Errorf("parse reverse ports %q: %w", s.cfg.ReversePorts, errPorts)
+		}
+		s.reverse = &portRange{lo: lo, hi: hi}
+
+		s.logger.Info("Reverse tunnels enabled", "host", s.cfg.ReverseHost, "ports", s.cfg.ReversePorts,
+			"max_listeners", s.cfg.MaxReverseListeners)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/tunnel", s.handleTunnel)
+	mux.HandleFunc("/reverse", s.handleReverse)
 
-	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
-	s.logger.Info("Starting WebSocket server", "address", addr)
+	addr := net.JoinHostPort(s.cfg.Host, fmt.Sprintf("%d", s.cfg.Port))
+	s.logger.Info("Starting WebSocket server", "address", addr, "tls", s.cfg.TLS)
 
 	server := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 	}
 
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
+
+	if s.cfg.ProxyProtocol {
+		listener, err = proxyproto.NewListener(listener, s.cfg.ProxyTrusted, s.cfg.ProxyHeaderTimeout)
+		if err != nil {
+			return fmt.Errorf("enable proxy protocol: %w", err)
+		}
+
+		s.logger.Info("PROXY protocol enabled", "trusted", s.cfg.ProxyTrusted)
+	}
+
+	// The PROXY header precedes the TLS handshake, so TLS wraps the PROXY listener
+	if s.cfg.TLS {
+		tlsConfig, errTLS := s.loadTLSConfig()
+		if errTLS != nil {
+			listener.Close()
+			return fmt.Errorf("load TLS config: %w", errTLS)
+		}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	shutdown := make(chan struct{})
 	go func() {
+		defer close(shutdown)
+
 		<-ctx.Done()
 		s.logger.Info("Shutting down WebSocket server...")
 		if err := server.Shutdown(context.Background()); err != nil {
@@ -53,22 +210,72 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}()
 
-	return server.ListenAndServe()
-}
+	if err = server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 
-var upgrade = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	// No handler starts after Shutdown returned, so Wait cannot miss a tunnel
+	<-shutdown
+
+	return nil
 }
 
 func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrade.Upgrade(w, r, nil)
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	identity, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+
+	// Multiplexed tunnels request a target per stream
+	targetAddr, err := s.targetAddr(r.Context(), r.URL.Query().Get("target"))
+	if err != nil {
+		s.logger.Warn("Rejected tunnel target", "remote", r.RemoteAddr, "identity", identity, "error", err)
+		rejectedTunnels.WithLabelValues(identity, "target").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Streams of multiplexed WebSockets acquire a tunnel each, the WebSocket itself is
+	// limited separately so that idle ones cannot pile up
+	multiplexed := slices.Contains(websocket.Subprotocols(r), mux.Subprotocol)
+	limits := s.limits
+	if multiplexed {
+		limits = s.websockets
+	}
+
+	if err = limits.acquire(identity); err != nil {
+		s.logger.Warn("Rejected tunnel", "remote", r.RemoteAddr, "identity", identity, "error", err)
+		rejectedTunnels.WithLabelValues(identity, "limit").Inc()
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer limits.release(identity)
+
+	var peerWindow uint32
+	header := http.Header{}
+	if multiplexed {
+		if peerWindow, err = mux.PeerWindow(r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mux.SetWindow(header, s.cfg.MuxWindow)
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		s.logger.Error("WebSocket upgrade error", "error", err)
 		return
 	}
 	defer ws.Close()
 
-	targetAddr := fmt.Sprintf("%s:%d", s.cfg.HostForwardTo, s.cfg.PortForwardTo)
+	if ws.Subprotocol() == mux.Subprotocol {
+		s.serveMux(ws, peerWindow, r.RemoteAddr, identity, clientCertSubject(r))
+		return
+	}
+
 	tcpConn, err := net.Dial("tcp", targetAddr)
 	if err != nil {
 		s.logger.Error("TCP dial error", "target", targetAddr, "error", err)
@@ -77,46 +284,268 @@ func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
 	defer tcpConn.Close()
 
 	remote := r.RemoteAddr
-	s.logger.Info("New WebSocket connection", "remote", remote, "forward_to", targetAddr)
+	s.logger.Info("New WebSocket connection", "remote", remote, "identity", identity, "forward_to", targetAddr,
+		"client_cert", clientCertSubject(r))
+
+	sess, ctx := s.sessions.Start(s.ctx, session.Params{
+		Protocol:   "websocket",
+		RemoteAddr: remote,
+		Identity:   identity,
+	})
+
+	received := tunnelBytes.WithLabelValues(identity, "received")
+	sent := tunnelBytes.WithLabelValues(identity, "sent")
+
+	alive := keepalive.Start(ws, s.keepalive())
+	defer alive.Stop()
+
+	errCh := make(chan error, 2)
 
 	// Канал WebSocket → TCP
 	go func() {
 		for {
-			bytesReceived, data, errReadMessage := ws.ReadMessage()
+			_, data, errReadMessage := ws.ReadMessage()
 			if errReadMessage != nil {
+				if websocket.IsCloseError(errReadMessage, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					errCh <- nil
+					return
+				}
+
+				errReadMessage = keepalive.Cause(errReadMessage)
 				s.logger.Warn("WebSocket read error", "error", errReadMessage)
+				errCh <- errReadMessage
 				return
 			}
+			alive.Received()
 
 			bytesSent, errWriteMessage := tcpConn.Write(data)
 			if errWriteMessage != nil {
 				s.logger.Warn("TCP write error", "error", errWriteMessage)
+				errCh <- errWriteMessage
 				return
 			}
 
-			metrics.AddBytesReceived(bytesReceived)
+			metrics.AddBytesReceived(len(data))
 			metrics.AddBytesSent(bytesSent)
+			received.Add(float64(len(data)))
+			sess.AddReceived(len(data))
 		}
 	}()
 
 	// Канал TCP → WebSocket
-	buf := make([]byte, s.cfg.BufSize)
-	for {
-		n, errReadBuf := tcpConn.Read(buf)
-		if errReadBuf != nil {
-			if err != io.EOF {
+	go func() {
+		buf := make([]byte, s.cfg.BufSize)
+		for {
+			n, errReadBuf := tcpConn.Read(buf)
+			if errReadBuf != nil {
+				if errors.Is(errReadBuf, io.EOF) {
+					errCh <- nil
+					return
+				}
+
 				s.logger.Warn("TCP read error", "error", errReadBuf)
+				errCh <- errReadBuf
+				return
 			}
-			break
+
+			errWriteBuf := alive.WriteMessage(websocket.BinaryMessage, buf[:n])
+			if errWriteBuf != nil {
+				errWriteBuf = keepalive.Cause(errWriteBuf)
+				s.logger.Warn("WebSocket write error", "error", errWriteBuf)
+				errCh <- errWriteBuf
+				return
+			}
+
+			metrics.AddBytesReceived(n)
+			metrics.AddBytesSent(n)
+			sent.Add(float64(n))
+			sess.AddSent(n)
 		}
+	}()
+
+	var reason error
+	select {
+	case reason = <-errCh:
+	case <-ctx.Done():
+		reason = context.Cause(ctx)
+	}
+
+	// Unblock the other direction before the session is reported
+	ws.Close()
+	tcpConn.Close()
+
+	s.sessions.Finish(sess, reason)
+}
+
+func (s *Server) keepalive() keepalive.Config {
+	return keepalive.Config{
+		PingInterval: s.cfg.PingInterval,
+		PongTimeout:  s.cfg.PongTimeout,
+		WriteTimeout: s.cfg.WriteTimeout,
+	}
+}
+
+// targetAddr checks the target a client requested and returns the address to dial.
+// An empty request, or one for the default target, is always allowed.
+func (s *Server) targetAddr(ctx context.Context, requested string) (string, error) {
+	defaultAddr := net.JoinHostPort(s.cfg.HostForwardTo, fmt.Sprintf("%d", s.cfg.PortForwardTo))
+	if requested == "" || requested == defaultAddr {
+		return defaultAddr, nil
+	}
 
-		errWriteBuf := ws.WriteMessage(websocket.BinaryMessage, buf[:n])
-		if errWriteBuf != nil {
-			s.logger.Warn("WebSocket write error", "error", errWriteBuf)
+	return s.targets.resolve(ctx, requested)
+}
+
+// serveMux accepts the streams of a multiplexed tunnel until the WebSocket closes.
+// Every stream is forwarded to its own TCP connection.
+func (s *Server) serveMux(ws *websocket.Conn, peerWindow uint32, remote, identity, clientCert string) {
+	session := mux.NewSession(mux.Params{
+		Conn:       ws,
+		Window:     s.cfg.MuxWindow,
+		PeerWindow: peerWindow,
+		Keepalive:  s.keepalive(),
+		Logger:     s.logger,
+	})
+	defer session.Close()
+
+	s.logger.Info("New multiplexed WebSocket connection", "remote", remote, "identity", identity, "client_cert", clientCert)
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			session.Close()
+		case <-session.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		stream, err := session.Accept()
+		if err != nil {
 			break
 		}
 
-		metrics.AddBytesReceived(n)
-		metrics.AddBytesSent(n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveStream(stream, remote, identity)
+		}()
+	}
+
+	wg.Wait()
+	s.logger.Info("Multiplexed WebSocket connection closed", "remote", remote, "identity", identity, "reason", session.Err())
+}
+
+func (s *Server) serveStream(stream *mux.Stream, remote, identity string) {
+	targetAddr, err := s.targetAddr(s.ctx, stream.Target())
+	if err != nil {
+		s.logger.Warn("Rejected tunnel target", "remote", remote, "identity", identity, "stream", stream.ID(), "error", err)
+		rejectedTunnels.WithLabelValues(identity, "target").Inc()
+		stream.Reset(err.Error())
+		return
+	}
+
+	if err = s.limits.acquire(identity); err != nil {
+		s.logger.Warn("Rejected tunnel", "remote", remote, "identity", identity, "stream", stream.ID(), "error", err)
+		rejectedTunnels.WithLabelValues(identity, "limit").Inc()
+		stream.Reset(err.Error())
+		return
+	}
+	defer s.limits.release(identity)
+
+	tcpConn, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		s.logger.Error("TCP dial error", "target", targetAddr, "error", err)
+		stream.Reset(fmt.Sprintf("dial %s failed", targetAddr))
+		return
+	}
+
+	sess, ctx := s.sessions.Start(s.ctx, session.Params{
+		Protocol:   "websocket-mux",
+		RemoteAddr: remote,
+		Identity:   identity,
+	})
+
+	received := tunnelBytes.WithLabelValues(identity, "received")
+	sent := tunnelBytes.WithLabelValues(identity, "sent")
+
+	// Killing the session aborts the stream
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset("session closed")
+		tcpConn.Close()
+	})
+	defer stop()
+
+	s.logger.Debug("New mux stream", "remote", remote, "identity", identity, "stream", stream.ID(), "forward_to", targetAddr)
+
+	err = mux.Relay(stream, tcpConn, int(s.cfg.BufSize),
+		func(n int) {
+			metrics.AddBytesReceived(n)
+			metrics.AddBytesSent(n)
+			received.Add(float64(n))
+			sess.AddReceived(n)
+		},
+		func(n int) {
+			metrics.AddBytesReceived(n)
+			metrics.AddBytesSent(n)
+			sent.Add(float64(n))
+			sess.AddSent(n)
+		},
+	)
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+
+	s.sessions.Finish(sess, err)
+}
+
+func (s *Server) loadTLSConfig() (*tls.Config, error) {
+	cert, err := tlsconf.LoadServerCertificate(tlsconf.ServerParams{
+		CertFile: s.cfg.TLSCertFile,
+		KeyFile:  s.cfg.TLSKeyFile,
+		Generate: s.cfg.TLSGenerate,
+		Hosts:    s.cfg.TLSHosts,
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	if s.cfg.TLSCertFile == "" {
+		s.logger.Warn("Using an ephemeral self-signed certificate, clients can only pin it until restart")
+	}
+
+	fingerprint, err := tlsconf.LeafFingerprint(cert)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("TLS certificate loaded", "cert_file", s.cfg.TLSCertFile, "spki_sha256", fingerprint)
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+
+	err = tlsconf.SetClientAuth(cfg, tlsconf.ClientAuthParams{
+		CAFile:   s.cfg.TLSClientCA,
+		Optional: s.cfg.TLSClientOptional,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load client CA: %w", err)
+	}
+
+	if s.cfg.TLSClientCA != "" {
+		s.logger.Info("Client certificates verified", "ca_file", s.cfg.TLSClientCA, "optional", s.cfg.TLSClientOptional)
+	}
+
+	return cfg, nil
+}
+
+// clientCertSubject names the verified client certificate of r, empty without one.
+func clientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.String()
 }
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrTargetNotAllowed = errors.New("target not allowed")
+
+// targetRule is one allowlist entry.
+type targetRule struct {
+	anyHost bool
+	host    string     // lower-case hostname, empty for addresses
+	network *net.IPNet // address or CIDR
+	portLo  uint16
+	portHi  uint16
+}
+
+// allowlist decides which targets clients may ask the server to forward to.
+type allowlist struct {
+	rules []targetRule
+}
+
+// parseAllowlist parses entries of the form host:port. The host is a hostname, an IP
+// address, a CIDR or *, the port is a number, a range like 8000-8100 or *. IPv6
+// addresses and CIDRs go in brackets, e.g. [fd00::/8]:443.
+func parseAllowlist(entries []string) (*allowlist, error) {
+	a := &allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("parse allowed target %q: missing port", entry)
+		}
+		host, ports := strings.Trim(entry[:i], "[]"), entry[i+1:]
+
+		var rule targetRule
+		var err error
+		rule.portLo, rule.portHi, err = parsePorts(ports)
+		if err != nil {
+			return nil, fmt.Errorf("parse allowed target %q: %w", entry, err)
+		}
+
+		switch {
+		case host == "*":
+			rule.anyHost = true
+		case strings.Contains(host, "/"):
+			_, ipNet, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("parse allowed target %q: %w", entry, err)
+			}
+			rule.network = ipNet
+		case net.ParseIP(host) != nil:
+			ip := net.ParseIP(host)
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		case host != "":
+			rule.host = strings.ToLower(host)
+		default:
+			return nil, fmt.Errorf("parse allowed target %q: missing host", entry)
+		}
+
+		a.rules = append(a.rules, rule)
+	}
+
+	return a, nil
+}
+
+// resolve checks target against the allowlist and returns the address to dial. A
+// hostname is allowed by a rule naming it, or when every address it resolves to is
+// allowed; the checked address is dialed then, so DNS cannot change it in between.
+func (a *allowlist) resolve(ctx context.Context, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", fmt.Errorf("parse target %q: %w", target, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("parse target %q: invalid port", target)
+	}
+
+	// An empty host dials the server itself
+	if host == "" {
+		return "", fmt.Errorf("parse target %q: missing host", target)
+	}
+
+	for _, rule := range a.rules {
+		if !rule.allowsPort(uint16(port)) {
+			continue
+		}
+
+		if rule.anyHost || (rule.host != "" && rule.host == strings.ToLower(host)) {
+			return target, nil
+		}
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("resolve target %q: %w", host, err)
+	}
+
+	for _, ip := range ips {
+		if a.allowsIP(ip, uint16(port)) {
+			continue
+		}
+
+		if ip.String() == host {
+			return "", fmt.Errorf("%w: %s", ErrTargetNotAllowed, target)
+		}
+
+		return "", fmt.Errorf("%w: %s resolves to %s", ErrTargetNotAllowed, target, ip)
+	}
+
+	return net.JoinHostPort(ips[0].String(), portStr), nil
+}
+
+// parsePorts parses a port, a range like 8000-8100 or * for every port.
+func parsePorts(ports string) (uint16, uint16, error) {
+	switch {
+	case ports == "*":
+		return 1, 65535, nil
+	case strings.Contains(ports, "-"):
+		lo, hi, _ := strings.Cut(ports, "-")
+		portLo, errLo := strconv.ParseUint(lo, 10, 16)
+		portHi, errHi := strconv.ParseUint(hi, 10, 16)
+		if errLo != nil || errHi != nil || portLo == 0 || portLo > portHi {
+			return 0, 0, errors.New("invalid port range")
+		}
+		return uint16(portLo), uint16(portHi), nil
+	default:
+		port, err := strconv.ParseUint(ports, 10, 16)
+		if err != nil || port == 0 {
+			return 0, 0, errors.New("invalid port")
+		}
+		return uint16(port), uint16(port), nil
+	}
+}
+
+func (a *allowlist) allowsIP(ip net.IP, port uint16) bool {
+	for _, rule := range a.rules {
+		if rule.network != nil && rule.network.Contains(ip) && rule.allowsPort(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r targetRule) allowsPort(port uint16) bool {
+	return port >= r.portLo && port <= r.portHi
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		rules   int
+		wantErr bool
+	}{
+		{name: "empty", entries: nil},
+		{name: "blank entries", entries: []string{"", "  "}},
+		{name: "every kind", entries: []string{"127.0.0.1:1544", "10.0.0.0/8:5432", "db.internal:8000-8100", "[fd00::/8]:443", "[::1]:22", "*:*"}, rules: 6},
+		{name: "missing port", entries: []string{"db.internal"}, wantErr: true},
+		{name: "missing host", entries: []string{":22"}, wantErr: true},
+		{name: "port zero", entries: []string{"10.0.0.1:0"}, wantErr: true},
+		{name: "port out of range", entries: []string{"10.0.0.1:65536"}, wantErr: true},
+		{name: "reversed range", entries: []string{"10.0.0.1:9000-8000"}, wantErr: true},
+		{name: "range from zero", entries: []string{"10.0.0.1:0-80"}, wantErr: true},
+		{name: "invalid CIDR", entries: []string{"10.0.0.0/33:80"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseAllowlist(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAllowlist(%q) succeeded", tt.entries)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseAllowlist(%q) error = %v", tt.entries, err)
+			}
+
+			if len(a.rules) != tt.rules {
+				t.Fatalf("parseAllowlist(%q) has %d rules, want %d", tt.entries, len(a.rules), tt.rules)
+			}
+		})
+	}
+}
+
+func TestAllowlistResolve(t *testing.T) {
+	a, err := parseAllowlist([]string{"127.0.0.1:1544", "10.0.0.0/8:5432", "db.internal:8000-8100", "[fd00::/8]:443", "*:7000"})
+	if err != nil {
+		t.Fatalf("parse allowlist: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		want       string
+		notAllowed bool
+		wantErr    bool
+	}{
+		{name: "address", target: "127.0.0.1:1544", want: "127.0.0.1:1544"},
+		{name: "address on another port", target: "127.0.0.1:1545", notAllowed: true},
+		{name: "CIDR", target: "10.20.30.40:5432", want: "10.20.30.40:5432"},
+		{name: "outside CIDR", target: "11.0.0.1:5432", notAllowed: true},
+		{name: "IPv6 CIDR", target: "[fd12::1]:443", want: "[fd12::1]:443"},
+		// Hostnames match without a lookup, case-insensitively
+		{name: "hostname in range", target: "DB.internal:8050", want: "DB.internal:8050"},
+		{name: "any host", target: "anything.example:7000", want: "anything.example:7000"},
+		// An empty host dials the server itself, whatever the rules allow
+		{name: "port only", target: ":1544", wantErr: true},
+		{name: "port only with any host", target: ":7000", wantErr: true},
+		{name: "port only without rule", target: ":22", wantErr: true},
+		{name: "missing port", target: "127.0.0.1", wantErr: true},
+		{name: "port zero", target: "127.0.0.1:0", wantErr: true},
+		{name: "invalid port", target: "127.0.0.1:ssh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.resolve(context.Background(), tt.target)
+			switch {
+			case tt.notAllowed:
+				if !errors.Is(err, ErrTargetNotAllowed) {
+					t.Fatalf("resolve(%q) error = %v, want %v", tt.target, err, ErrTargetNotAllowed)
+				}
+			case tt.wantErr:
+				if err == nil {
+					t.Fatalf("resolve(%q) = %q, want an error", tt.target, got)
+				}
+			case err != nil || got != tt.want:
+				t.Fatalf("resolve(%q) = %q, %v, want %q", tt.target, got, err, tt.want)
+			}
+		})
+	}
+}